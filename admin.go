@@ -2,123 +2,191 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"net/http"
 	"strconv"
 	"time"
+
+	"github.com/gorilla/mux"
 )
 
-type History struct {
-	WhoBanned   string
-	WhenBanned  time.Time
-	Why         string
-	WhoUnbanned string
+type BanRecord struct {
+	WhoBanned    string     `json:"who_banned"`
+	WhenBanned   time.Time  `json:"when_banned"`
+	Why          string     `json:"why"`
+	Until        *time.Time `json:"until,omitempty"`
+	Unbanned     string     `json:"unbanned,omitempty"`
+	WhoUnbanned  string     `json:"who_unbanned,omitempty"`
+	WhenUnbanned *time.Time `json:"when_unbanned,omitempty"`
+	UnbanReason  string     `json:"unban_reason,omitempty"`
+}
+
+func newBanRecord(h History) BanRecord {
+	return BanRecord{
+		WhoBanned:    h.WhoBanned,
+		WhenBanned:   h.WhenBanned,
+		Why:          h.Why,
+		Until:        optionalTime(h.Until),
+		Unbanned:     string(h.Unbanned),
+		WhoUnbanned:  h.WhoUnbanned,
+		WhenUnbanned: optionalTime(h.WhenUnbanned),
+		UnbanReason:  h.UnbanReason,
+	}
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
 }
 
-type BanHistory struct {
-	history map[int]*History
+type UserDetails struct {
+	Email        string      `json:"email"`
+	FavoriteCake string      `json:"favorite_cake"`
+	Banned       bool        `json:"banned"`
+	Role         string      `json:"role"`
+	Verified     bool        `json:"verified"`
+	BanHistory   []BanRecord `json:"ban_history"`
 }
 
-func NewBanHistory() *BanHistory {
-	return &BanHistory{
-		history: make(map[int]*History),
+func newUserDetails(u User) UserDetails {
+	d := UserDetails{
+		Email:        u.Email,
+		FavoriteCake: u.FavoriteCake,
+		Banned:       u.Banned,
+		Role:         u.Role,
+		Verified:     u.Verified(),
+		BanHistory:   []BanRecord{},
 	}
+	for _, h := range u.BanHistory.Bans() {
+		d.BanHistory = append(d.BanHistory, newBanRecord(h))
+	}
+	return d
 }
 
+// BanParams describe a ban. It is permanent unless either Duration, like
+// "72h", or Until is given.
 type BanParams struct {
-	Email  string `json:"email"`
-	Reason string `json:"reason"`
+	Email    string     `json:"email"`
+	Reason   string     `json:"reason"`
+	Duration string     `json:"duration"`
+	Until    *time.Time `json:"until"`
+}
+
+// banEnd computes when the ban described by p ends, the zero time for a
+// permanent ban.
+func (p *BanParams) banEnd(now time.Time) (time.Time, error) {
+	if p.Duration != "" && p.Until != nil {
+		return time.Time{}, newValidationError("duration", "Give either a duration or an end date, not both")
+	}
+	if p.Duration != "" {
+		d, err := time.ParseDuration(p.Duration)
+		if err != nil || d <= 0 {
+			return time.Time{}, newValidationError("duration", "Invalid ban duration")
+		}
+		return now.Add(d), nil
+	}
+	if p.Until != nil {
+		if !p.Until.After(now) {
+			return time.Time{}, newValidationError("until", "The ban must end in the future")
+		}
+		return *p.Until, nil
+	}
+	return time.Time{}, nil
 }
 
 type UnBanParams struct {
 	Email string `json:"email"`
+	// Reason is only used by unbanHandler.
+	Reason string `json:"reason"`
 }
 
 func banHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
 	params := &BanParams{}
 	err := json.NewDecoder(r.Body).Decode(params)
 	if err != nil {
-		handleError(errors.New("could not read params"), w)
+		handleError(ErrInvalidParams, w)
 		return
 	}
 	user, err := us.Get(params.Email)
-	if (user.Role == "admin" || user.Role == "superadmin") && u.Role != "superadmin" {
-		w.WriteHeader(401)
-		w.Write([]byte("Only superadmin can ban admin!"))
+	if err != nil {
+		handleError(err, w)
 		return
 	}
-	if err != nil {
-		w.WriteHeader(401)
-		w.Write([]byte("This user doesn't exist"))
+	if isStaff(user.Role) && !allowed(r, u, PermAdminsManage) {
+		handleError(newForbiddenError("permission_denied", "Only superadmin can ban admin!"), w)
 		return
 	}
 	if user.Banned == true {
-		w.WriteHeader(401)
-		w.Write([]byte("This user is already banned!"))
+		handleError(newConflictError("user_already_banned", "This user is already banned!"), w)
+		return
+	}
+	now := time.Now()
+	until, err := params.banEnd(now)
+	if err != nil {
+		handleError(err, w)
 		return
 	}
 	Banhistory := user.BanHistory
-	Banhistory.history[len(Banhistory.history)+1] = &History{u.Email, time.Now(), params.Reason, ""}
+	Banhistory.Append(BanEvent{Type: BanEventBan, At: now, Actor: u.Email, Reason: params.Reason, Until: until})
 	Ban := User{
-		Email:          user.Email,
-		FavoriteCake:   user.FavoriteCake,
-		PasswordDigest: user.PasswordDigest,
-		Role:           user.Role,
-		Banned:         true,
-		BanHistory:     Banhistory,
+		Email:               user.Email,
+		FavoriteCake:        user.FavoriteCake,
+		PasswordDigest:      user.PasswordDigest,
+		Role:                user.Role,
+		Banned:              true,
+		BanHistory:          Banhistory,
+		PendingVerification: user.PendingVerification,
 	}
 	err = us.Update(user.Email, Ban)
 	if err != nil {
 		handleError(err, w)
 		return
 	}
+	revokeUserTokens(user.Email)
+	bans.Inc()
 	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte("The user have been banned bacause: " + params.Reason))
+	w.Write([]byte("The user have been banned bacause: " + params.Reason + banEndText(until)))
 }
 
 func unbanHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
 	params := &UnBanParams{}
 	err := json.NewDecoder(r.Body).Decode(params)
 	if err != nil {
-		handleError(errors.New("could not read params"), w)
+		handleError(ErrInvalidParams, w)
 		return
 	}
 	user, err := us.Get(params.Email)
-	if (user.Role == "admin" || user.Role == "superadmin") && u.Role != "superadmin" {
-		w.WriteHeader(401)
-		w.Write([]byte("Only superadmin can unban admin!"))
+	if err != nil {
+		handleError(err, w)
 		return
 	}
-	if err != nil {
-		w.WriteHeader(401)
-		w.Write([]byte("This user doesn't exist"))
+	if isStaff(user.Role) && !allowed(r, u, PermAdminsManage) {
+		handleError(newForbiddenError("permission_denied", "Only superadmin can unban admin!"), w)
 		return
 	}
 	if user.Banned == false {
-		w.WriteHeader(401)
-		w.Write([]byte("This user is not banned!"))
+		handleError(newConflictError("user_not_banned", "This user is not banned!"), w)
 		return
 	}
 
-	for key, _ := range user.BanHistory.history {
-		if user.BanHistory.history[key].WhoUnbanned == "" {
-			user.BanHistory.history[key].WhoUnbanned = u.Email
-		}
-	}
+	user.BanHistory.Append(BanEvent{Type: BanEventUnban, At: time.Now(), Actor: u.Email, Reason: params.Reason})
 
 	UnBan := User{
-		Email:          user.Email,
-		FavoriteCake:   user.FavoriteCake,
-		PasswordDigest: user.PasswordDigest,
-		Role:           user.Role,
-		Banned:         false,
-		BanHistory:     user.BanHistory,
+		Email:               user.Email,
+		FavoriteCake:        user.FavoriteCake,
+		PasswordDigest:      user.PasswordDigest,
+		Role:                user.Role,
+		Banned:              false,
+		BanHistory:          user.BanHistory,
+		PendingVerification: user.PendingVerification,
 	}
 	err = us.Update(user.Email, UnBan)
 	if err != nil {
 		handleError(err, w)
 		return
 	}
+	unbans.Inc()
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("The user have been unbanned"))
 }
@@ -127,67 +195,75 @@ func inspectHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepos
 	params := &UnBanParams{}
 	err := json.NewDecoder(r.Body).Decode(params)
 	if err != nil {
-		handleError(errors.New("could not read params"), w)
+		handleError(ErrInvalidParams, w)
 		return
 	}
 	user, err := us.Get(params.Email)
 	if err != nil {
-		w.WriteHeader(401)
-		w.Write([]byte("This user doesn't exist"))
+		handleError(err, w)
 		return
 	}
-	if (user.Role == "admin" || user.Role == "superadmin") && u.Role != "superadmin" {
-		w.WriteHeader(401)
-		w.Write([]byte("Only superadmin can inspect admin!"))
+	if isStaff(user.Role) && !allowed(r, u, PermAdminsManage) {
+		handleError(newForbiddenError("permission_denied", "Only superadmin can inspect admin!"), w)
 		return
 	}
 
-	/*email := r.URL.Query().Get("email")
-	w.Write([]byte(("email :" + email)))*/
-	w.Write([]byte("User : " + user.Email + "\n"))
-	w.Write([]byte("Favorite cake : " + user.FavoriteCake + "\n"))
-	w.Write([]byte("Banned : " + strconv.FormatBool(user.Banned) + "\n"))
-	w.Write([]byte("Role : " + user.Role + "\n"))
-	for key, _ := range user.BanHistory.history {
-		w.Write([]byte("History : " + strconv.Itoa(key) + "\n"))
-		w.Write([]byte("Who banned : " + user.BanHistory.history[key].WhoBanned + "\n"))
-		w.Write([]byte("When : " + user.BanHistory.history[key].WhenBanned.String() + "\n"))
-		w.Write([]byte("Why : " + user.BanHistory.history[key].Why + "\n"))
-		w.Write([]byte("Who unbanned : " + user.BanHistory.history[key].WhoUnbanned + "\n"))
+	if negotiate(r, contentTypeJSON, contentTypePlain) == contentTypePlain {
+		w.Header().Set("Content-Type", contentTypePlain)
+		w.Write([]byte("User : " + user.Email + "\n"))
+		w.Write([]byte("Favorite cake : " + user.FavoriteCake + "\n"))
+		w.Write([]byte("Banned : " + strconv.FormatBool(user.Banned) + "\n"))
+		w.Write([]byte("Role : " + user.Role + "\n"))
+		for i, h := range user.BanHistory.Bans() {
+			w.Write([]byte("History : " + strconv.Itoa(i+1) + "\n"))
+			w.Write([]byte("Who banned : " + h.WhoBanned + "\n"))
+			w.Write([]byte("When : " + h.WhenBanned.String() + "\n"))
+			w.Write([]byte("Why : " + h.Why + "\n"))
+			w.Write([]byte("Who unbanned : " + h.WhoUnbanned + "\n"))
+			if !h.Until.IsZero() {
+				w.Write([]byte("Until : " + h.Until.String() + "\n"))
+			}
+			if h.Unbanned != "" {
+				w.Write([]byte("When unbanned : " + h.WhenUnbanned.String() + "\n"))
+				w.Write([]byte("Unban reason : " + h.UnbanReason + "\n"))
+			}
+		}
+		return
 	}
+	writeJSON(w, http.StatusOK, newUserDetails(user))
 }
 
 func promoteHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
 	params := &UnBanParams{}
 	err := json.NewDecoder(r.Body).Decode(params)
 	if err != nil {
-		handleError(errors.New("could not read params"), w)
+		handleError(ErrInvalidParams, w)
 		return
 	}
-	if u.Role != "superadmin" {
-		w.WriteHeader(401)
-		w.Write([]byte("Only superadmin can promote!"))
+	if !allowed(r, u, PermAdminsPromote) {
+		handleError(newForbiddenError("permission_denied", "Only superadmin can promote!"), w)
 		return
 	}
 	user, err := us.Get(params.Email)
 	if err != nil {
-		w.WriteHeader(401)
-		w.Write([]byte("This user doesn't exist"))
+		handleError(err, w)
 		return
 	}
 	promote := User{
-		Email:          user.Email,
-		FavoriteCake:   user.FavoriteCake,
-		PasswordDigest: user.PasswordDigest,
-		Role:           "admin",
-		Banned:         user.Banned,
-		BanHistory:     user.BanHistory,
+		Email:               user.Email,
+		FavoriteCake:        user.FavoriteCake,
+		PasswordDigest:      user.PasswordDigest,
+		Role:                RoleAdmin,
+		Banned:              user.Banned,
+		BanHistory:          user.BanHistory,
+		PendingVerification: user.PendingVerification,
 	}
 	err = us.Update(user.Email, promote)
 	if err != nil {
 		handleError(err, w)
 		return
 	}
+	promotions.Inc()
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("The user have been promoted"))
 }
@@ -196,33 +272,229 @@ func fireHandler(w http.ResponseWriter, r *http.Request, u User, us UserReposito
 	params := &UnBanParams{}
 	err := json.NewDecoder(r.Body).Decode(params)
 	if err != nil {
-		handleError(errors.New("could not read params"), w)
+		handleError(ErrInvalidParams, w)
 		return
 	}
 	user, err := us.Get(params.Email)
 	if err != nil {
-		w.WriteHeader(401)
-		w.Write([]byte("This user doesn't exist"))
+		handleError(err, w)
 		return
 	}
-	if u.Role != "superadmin" {
-		w.WriteHeader(401)
-		w.Write([]byte("Only superadmin can fire!"))
+	if !allowed(r, u, PermAdminsFire) {
+		handleError(newForbiddenError("permission_denied", "Only superadmin can fire!"), w)
 		return
 	}
 	fire := User{
-		Email:          user.Email,
-		FavoriteCake:   user.FavoriteCake,
-		PasswordDigest: user.PasswordDigest,
-		Role:           "",
-		Banned:         user.Banned,
-		BanHistory:     user.BanHistory,
+		Email:               user.Email,
+		FavoriteCake:        user.FavoriteCake,
+		PasswordDigest:      user.PasswordDigest,
+		Role:                RoleUser,
+		Banned:              user.Banned,
+		BanHistory:          user.BanHistory,
+		PendingVerification: user.PendingVerification,
 	}
 	err = us.Update(user.Email, fire)
 	if err != nil {
 		handleError(err, w)
 		return
 	}
+	revokeUserTokens(user.Email)
+	fires.Inc()
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("The user have been fired"))
 }
+
+type BanEventRecord struct {
+	Seq    int          `json:"seq"`
+	Type   BanEventType `json:"type"`
+	At     time.Time    `json:"at"`
+	Actor  string       `json:"actor"`
+	Reason string       `json:"reason"`
+	Until  *time.Time   `json:"until,omitempty"`
+}
+
+type BanEventsPage struct {
+	Email  string           `json:"email"`
+	Banned bool             `json:"banned"`
+	Events []BanEventRecord `json:"events"`
+	// Next is the after parameter of the next page, empty on the last one.
+	Next string `json:"next,omitempty"`
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// pageSize reads the limit query parameter.
+func pageSize(r *http.Request) (int, error) {
+	limit := r.URL.Query().Get("limit")
+	if limit == "" {
+		return defaultPageSize, nil
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n < 1 || n > maxPageSize {
+		return 0, newValidationError("limit", "limit must be between 1 and "+strconv.Itoa(maxPageSize))
+	}
+	return n, nil
+}
+
+// banTarget loads the user named in the path, checking u may act on it.
+func banTarget(r *http.Request, u User, us UserRepository, action string) (User, error) {
+	user, err := us.Get(mux.Vars(r)["email"])
+	if err != nil {
+		return User{}, err
+	}
+	if isStaff(user.Role) && !allowed(r, u, PermAdminsManage) {
+		return User{}, newForbiddenError("permission_denied", "Only superadmin can "+action+" admin!")
+	}
+	return user, nil
+}
+
+// banEventsHandler pages through the ban log of a user, oldest first. The
+// after parameter is the seq of the last event already seen.
+func banEventsHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	limit, err := pageSize(r)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	after := 0
+	if v := r.URL.Query().Get("after"); v != "" {
+		after, err = strconv.Atoi(v)
+		if err != nil || after < 0 {
+			handleError(newValidationError("after", "after must be an event number"), w)
+			return
+		}
+	}
+	user, err := banTarget(r, u, us, "inspect")
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	page := BanEventsPage{Email: user.Email, Banned: user.Banned, Events: []BanEventRecord{}}
+	events := user.BanHistory.Events()
+	for _, e := range events {
+		if e.Seq <= after {
+			continue
+		}
+		if len(page.Events) == limit {
+			page.Next = strconv.Itoa(page.Events[len(page.Events)-1].Seq)
+			break
+		}
+		page.Events = append(page.Events, BanEventRecord{e.Seq, e.Type, e.At, e.Actor, e.Reason, optionalTime(e.Until)})
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+type AppealParams struct {
+	Accepted bool   `json:"accepted"`
+	Reason   string `json:"reason"`
+}
+
+// appealHandler records the outcome of an appeal against the ban in force,
+// an accepted appeal lifts it.
+func appealHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	params := &AppealParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(ErrInvalidParams, w)
+		return
+	}
+	user, err := banTarget(r, u, us, "unban")
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	if user.Banned == false {
+		handleError(newConflictError("user_not_banned", "This user is not banned!"), w)
+		return
+	}
+	outcome := BanEventAppealRejected
+	if params.Accepted {
+		outcome = BanEventAppealAccepted
+		user.Banned = false
+	}
+	user.BanHistory.Append(BanEvent{Type: outcome, At: time.Now(), Actor: u.Email, Reason: params.Reason})
+	err = us.Update(user.Email, user)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	if params.Accepted {
+		unbans.Inc()
+	}
+	w.WriteHeader(http.StatusCreated)
+	if params.Accepted {
+		w.Write([]byte("The appeal have been accepted"))
+	} else {
+		w.Write([]byte("The appeal have been rejected"))
+	}
+}
+
+type UserSummary struct {
+	Email        string `json:"email"`
+	FavoriteCake string `json:"favorite_cake"`
+	Role         string `json:"role"`
+	Banned       bool   `json:"banned"`
+	Verified     bool   `json:"verified"`
+}
+
+type UsersPage struct {
+	Users []UserSummary `json:"users"`
+	// Next is the cursor parameter of the next page, empty on the last one.
+	Next string `json:"next,omitempty"`
+}
+
+// listUsersHandler lists users matching the role, banned, email_prefix and
+// cake query parameters, sorted by sort. Like inspectHandler, it shows
+// admins only to those who may manage them.
+func listUsersHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	query := r.URL.Query()
+	limit, err := pageSize(r)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	opts := ListOptions{
+		Filter: UserFilter{
+			EmailPrefix:  query.Get("email_prefix"),
+			FavoriteCake: query.Get("cake"),
+		},
+		Sort:  query.Get("sort"),
+		After: query.Get("cursor"),
+		Limit: limit,
+	}
+	if role, ok := query["role"]; ok {
+		// the role of plain users is empty, "user" reads better
+		if role[0] == "user" {
+			role[0] = RoleUser
+		}
+		opts.Filter.Role = &role[0]
+	}
+	if banned := query.Get("banned"); banned != "" {
+		b, err := strconv.ParseBool(banned)
+		if err != nil {
+			handleError(newValidationError("banned", "banned must be true or false"), w)
+			return
+		}
+		opts.Filter.Banned = &b
+	}
+	if !allowed(r, u, PermAdminsManage) {
+		if opts.Filter.Role != nil && isStaff(*opts.Filter.Role) {
+			handleError(newForbiddenError("permission_denied", "Only superadmin can inspect admin!"), w)
+			return
+		}
+		opts.Filter.ExcludeStaff = true
+	}
+	page, err := us.List(opts)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	resp := UsersPage{Users: []UserSummary{}, Next: page.Next}
+	for _, user := range page.Users {
+		resp.Users = append(resp.Users, UserSummary{user.Email, user.FavoriteCake, user.Role, user.Banned, user.Verified()})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -10,12 +11,16 @@ import (
 
 func history(us User) string {
 	s := ""
-	for key, _ := range us.BanHistory.history {
-		s = s + "History : " + strconv.Itoa(key) + "\n"
-		s = s + "Who banned : " + us.BanHistory.history[key].WhoBanned + "\n"
-		s = s + "When : " + us.BanHistory.history[key].WhenBanned.String() + "\n"
-		s = s + "Why : " + us.BanHistory.history[key].Why + "\n"
-		s = s + "Who unbanned : " + us.BanHistory.history[key].WhoUnbanned + "\n"
+	for i, h := range us.BanHistory.Bans() {
+		s = s + "History : " + strconv.Itoa(i+1) + "\n"
+		s = s + "Who banned : " + h.WhoBanned + "\n"
+		s = s + "When : " + h.WhenBanned.String() + "\n"
+		s = s + "Why : " + h.Why + "\n"
+		s = s + "Who unbanned : " + h.WhoUnbanned + "\n"
+		if h.Unbanned != "" {
+			s = s + "When unbanned : " + h.WhenUnbanned.String() + "\n"
+			s = s + "Unban reason : " + h.UnbanReason + "\n"
+		}
 	}
 	return s
 }
@@ -25,14 +30,14 @@ func TestAdmin_JWT(t *testing.T) {
 	t.Run("ban user", func(t *testing.T) {
 		u := newTestUserService()
 		Superadmin := User{os.Getenv("CAKE_ADMIN_EMAIL"), os.Getenv("CAKE_ADMIN_PASSWORD"),
-			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}}
+			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}, "", ""}
 		u.repository.Add(Superadmin.Email, Superadmin)
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuthAdmin(u.repository, banHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, banHandler, PermUsersBan))
 		defer ts_1.Close()
 		defer ts_2.Close()
 		params := map[string]interface{}{
@@ -48,7 +53,7 @@ func TestAdmin_JWT(t *testing.T) {
 
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params)))
 
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		admin, _ := u.repository.Get(os.Getenv("CAKE_ADMIN_EMAIL"))
 		token, _ := jwtService.GenearateJWT(admin)
 
@@ -57,23 +62,19 @@ func TestAdmin_JWT(t *testing.T) {
 		resp := doRequest(req, err)
 		user, _ := u.repository.Get("test@mail.com")
 		assertStatus(t, 201, resp)
-		for key, _ := range user.BanHistory.history {
-			if user.BanHistory.history[key].WhoUnbanned == "" {
-				assertBody(t, "The user have been banned bacause: "+user.BanHistory.history[key].Why, resp)
-			}
-		}
+		assertBody(t, "The user have been banned bacause: "+user.BanHistory.active().Why, resp)
 	})
 
 	t.Run("ban unexisted user", func(t *testing.T) {
 		u := newTestUserService()
 		Superadmin := User{os.Getenv("CAKE_ADMIN_EMAIL"), os.Getenv("CAKE_ADMIN_PASSWORD"),
-			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}}
+			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}, "", ""}
 		u.repository.Add(Superadmin.Email, Superadmin)
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
-		ts_1 := httptest.NewServer(j.jwtAuthAdmin(u.repository, banHandler))
+		ts_1 := httptest.NewServer(j.jwtAuthorize(u.repository, banHandler, PermUsersBan))
 		defer ts_1.Close()
 
 		banparams := map[string]interface{}{
@@ -81,29 +82,28 @@ func TestAdmin_JWT(t *testing.T) {
 			"reason": "because",
 		}
 
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		admin, _ := u.repository.Get(os.Getenv("CAKE_ADMIN_EMAIL"))
 		token, _ := jwtService.GenearateJWT(admin)
 
 		req, _ := http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, banparams))
 		req.Header.Add("Authorization", "Bearer "+string(token))
 		resp := doRequest(req, err)
-		assertStatus(t, 401, resp)
-		assertBody(t, "This user doesn't exist", resp)
+		assertError(t, 404, "user_not_found", "This user doesn't exist", resp)
 	})
 
 	t.Run("admin ban admin", func(t *testing.T) {
 		u := newTestUserService()
 		Superadmin := User{os.Getenv("CAKE_ADMIN_EMAIL"), os.Getenv("CAKE_ADMIN_PASSWORD"),
-			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}}
+			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}, "", ""}
 		u.repository.Add(Superadmin.Email, Superadmin)
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuthAdmin(u.repository, promoteHandler))
-		ts_3 := httptest.NewServer(j.jwtAuthAdmin(u.repository, banHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, promoteHandler, PermAdminsPromote))
+		ts_3 := httptest.NewServer(j.jwtAuthorize(u.repository, banHandler, PermUsersBan))
 
 		defer ts_1.Close()
 		defer ts_2.Close()
@@ -137,7 +137,7 @@ func TestAdmin_JWT(t *testing.T) {
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, reg1)))
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, reg2)))
 
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		admin, _ := u.repository.Get(os.Getenv("CAKE_ADMIN_EMAIL"))
 		token, _ := jwtService.GenearateJWT(admin)
 
@@ -156,22 +156,21 @@ func TestAdmin_JWT(t *testing.T) {
 		req.Header.Add("Authorization", "Bearer "+string(user_token))
 		resp := doRequest(req, err)
 
-		assertStatus(t, 401, resp)
-		assertBody(t, "Only superadmin can ban admin!", resp)
+		assertError(t, 403, "permission_denied", "Only superadmin can ban admin!", resp)
 	})
 
 	t.Run("admin unban admin", func(t *testing.T) {
 		u := newTestUserService()
 		Superadmin := User{os.Getenv("CAKE_ADMIN_EMAIL"), os.Getenv("CAKE_ADMIN_PASSWORD"),
-			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}}
+			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}, "", ""}
 		u.repository.Add(Superadmin.Email, Superadmin)
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuthAdmin(u.repository, promoteHandler))
-		ts_3 := httptest.NewServer(j.jwtAuthAdmin(u.repository, unbanHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, promoteHandler, PermAdminsPromote))
+		ts_3 := httptest.NewServer(j.jwtAuthorize(u.repository, unbanHandler, PermUsersUnban))
 
 		defer ts_1.Close()
 		defer ts_2.Close()
@@ -204,7 +203,7 @@ func TestAdmin_JWT(t *testing.T) {
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, reg1)))
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, reg2)))
 
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		admin, _ := u.repository.Get(os.Getenv("CAKE_ADMIN_EMAIL"))
 		token, _ := jwtService.GenearateJWT(admin)
 
@@ -223,22 +222,21 @@ func TestAdmin_JWT(t *testing.T) {
 		req.Header.Add("Authorization", "Bearer "+string(user_token))
 		resp := doRequest(req, err)
 
-		assertStatus(t, 401, resp)
-		assertBody(t, "Only superadmin can unban admin!", resp)
+		assertError(t, 403, "permission_denied", "Only superadmin can unban admin!", resp)
 	})
 
 	t.Run("unban user", func(t *testing.T) {
 		u := newTestUserService()
 		Superadmin := User{os.Getenv("CAKE_ADMIN_EMAIL"), os.Getenv("CAKE_ADMIN_PASSWORD"),
-			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}}
+			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}, "", ""}
 		u.repository.Add(Superadmin.Email, Superadmin)
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuthAdmin(u.repository, banHandler))
-		ts_3 := httptest.NewServer(j.jwtAuthAdmin(u.repository, unbanHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, banHandler, PermUsersBan))
+		ts_3 := httptest.NewServer(j.jwtAuthorize(u.repository, unbanHandler, PermUsersUnban))
 		defer ts_1.Close()
 		defer ts_2.Close()
 		defer ts_3.Close()
@@ -259,7 +257,7 @@ func TestAdmin_JWT(t *testing.T) {
 
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params)))
 
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		admin, _ := u.repository.Get(os.Getenv("CAKE_ADMIN_EMAIL"))
 		token, _ := jwtService.GenearateJWT(admin)
 
@@ -277,14 +275,14 @@ func TestAdmin_JWT(t *testing.T) {
 	t.Run("inspect user", func(t *testing.T) {
 		u := newTestUserService()
 		Superadmin := User{os.Getenv("CAKE_ADMIN_EMAIL"), os.Getenv("CAKE_ADMIN_PASSWORD"),
-			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}}
+			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}, "", ""}
 		u.repository.Add(Superadmin.Email, Superadmin)
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuthAdmin(u.repository, inspectHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, inspectHandler, PermUsersInspect))
 		defer ts_1.Close()
 		defer ts_2.Close()
 		params := map[string]interface{}{
@@ -299,13 +297,26 @@ func TestAdmin_JWT(t *testing.T) {
 
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params)))
 
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		admin, _ := u.repository.Get(os.Getenv("CAKE_ADMIN_EMAIL"))
 		token, _ := jwtService.GenearateJWT(admin)
 
 		req, _ := http.NewRequest(http.MethodGet, ts_2.URL, prepareParams(t, inspectparams))
 		req.Header.Add("Authorization", "Bearer "+string(token))
 		resp := doRequest(req, err)
+		assertStatus(t, 200, resp)
+		details := UserDetails{}
+		if err := json.Unmarshal(resp.body, &details); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if details.Email != "test@mail.com" || details.FavoriteCake != "cake" || details.Banned || len(details.BanHistory) != 0 {
+			t.Errorf("Unexpected user details: %+v", details)
+		}
+
+		req, _ = http.NewRequest(http.MethodGet, ts_2.URL, prepareParams(t, inspectparams))
+		req.Header.Add("Authorization", "Bearer "+string(token))
+		req.Header.Add("Accept", "text/plain")
+		resp = doRequest(req, err)
 		user, _ := u.repository.Get("test@mail.com")
 		assertStatus(t, 200, resp)
 		assertBody(t, "User : "+user.Email+"\n"+"Favorite cake : "+user.FavoriteCake+"\n"+"Banned : "+strconv.FormatBool(user.Banned)+"\n"+"Role : "+user.Role+"\n"+history(user), resp)
@@ -314,15 +325,15 @@ func TestAdmin_JWT(t *testing.T) {
 	t.Run("admin inspect admin", func(t *testing.T) {
 		u := newTestUserService()
 		Superadmin := User{os.Getenv("CAKE_ADMIN_EMAIL"), os.Getenv("CAKE_ADMIN_PASSWORD"),
-			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}}
+			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}, "", ""}
 		u.repository.Add(Superadmin.Email, Superadmin)
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuthAdmin(u.repository, promoteHandler))
-		ts_3 := httptest.NewServer(j.jwtAuthAdmin(u.repository, inspectHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, promoteHandler, PermAdminsPromote))
+		ts_3 := httptest.NewServer(j.jwtAuthorize(u.repository, inspectHandler, PermUsersInspect))
 
 		defer ts_1.Close()
 		defer ts_2.Close()
@@ -355,7 +366,7 @@ func TestAdmin_JWT(t *testing.T) {
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, reg1)))
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, reg2)))
 
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		admin, _ := u.repository.Get(os.Getenv("CAKE_ADMIN_EMAIL"))
 		token, _ := jwtService.GenearateJWT(admin)
 
@@ -374,21 +385,20 @@ func TestAdmin_JWT(t *testing.T) {
 		req.Header.Add("Authorization", "Bearer "+string(user_token))
 		resp := doRequest(req, err)
 
-		assertStatus(t, 401, resp)
-		assertBody(t, "Only superadmin can inspect admin!", resp)
+		assertError(t, 403, "permission_denied", "Only superadmin can inspect admin!", resp)
 	})
 
 	t.Run("promote user", func(t *testing.T) {
 		u := newTestUserService()
 		Superadmin := User{os.Getenv("CAKE_ADMIN_EMAIL"), os.Getenv("CAKE_ADMIN_PASSWORD"),
-			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}}
+			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}, "", ""}
 		u.repository.Add(Superadmin.Email, Superadmin)
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuthAdmin(u.repository, promoteHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, promoteHandler, PermAdminsPromote))
 		defer ts_1.Close()
 		defer ts_2.Close()
 		params := map[string]interface{}{
@@ -403,7 +413,7 @@ func TestAdmin_JWT(t *testing.T) {
 
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params)))
 
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		admin, _ := u.repository.Get(os.Getenv("CAKE_ADMIN_EMAIL"))
 		token, _ := jwtService.GenearateJWT(admin)
 
@@ -417,14 +427,14 @@ func TestAdmin_JWT(t *testing.T) {
 	t.Run("admin promote user", func(t *testing.T) {
 		u := newTestUserService()
 		Superadmin := User{os.Getenv("CAKE_ADMIN_EMAIL"), os.Getenv("CAKE_ADMIN_PASSWORD"),
-			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}}
+			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}, "", ""}
 		u.repository.Add(Superadmin.Email, Superadmin)
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuthAdmin(u.repository, promoteHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, promoteHandler, PermAdminsPromote))
 
 		defer ts_1.Close()
 
@@ -451,7 +461,7 @@ func TestAdmin_JWT(t *testing.T) {
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, reg1)))
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, reg2)))
 
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		admin, _ := u.repository.Get(os.Getenv("CAKE_ADMIN_EMAIL"))
 		token, _ := jwtService.GenearateJWT(admin)
 
@@ -466,22 +476,21 @@ func TestAdmin_JWT(t *testing.T) {
 		req2.Header.Add("Authorization", "Bearer "+string(user_token))
 		resp := doRequest(req2, err)
 
-		assertStatus(t, 401, resp)
-		assertBody(t, "Only superadmin can promote!", resp)
+		assertError(t, 403, "permission_denied", "You don't have permission to access this page", resp)
 	})
 
 	t.Run("fire user", func(t *testing.T) {
 		u := newTestUserService()
 		Superadmin := User{os.Getenv("CAKE_ADMIN_EMAIL"), os.Getenv("CAKE_ADMIN_PASSWORD"),
-			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}}
+			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}, "", ""}
 		u.repository.Add(Superadmin.Email, Superadmin)
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuthAdmin(u.repository, promoteHandler))
-		ts_3 := httptest.NewServer(j.jwtAuthAdmin(u.repository, fireHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, promoteHandler, PermAdminsPromote))
+		ts_3 := httptest.NewServer(j.jwtAuthorize(u.repository, fireHandler, PermAdminsFire))
 		defer ts_1.Close()
 		defer ts_2.Close()
 		defer ts_3.Close()
@@ -501,7 +510,7 @@ func TestAdmin_JWT(t *testing.T) {
 
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params)))
 
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		admin, _ := u.repository.Get(os.Getenv("CAKE_ADMIN_EMAIL"))
 		token, _ := jwtService.GenearateJWT(admin)
 
@@ -519,15 +528,15 @@ func TestAdmin_JWT(t *testing.T) {
 	t.Run("admin fire user", func(t *testing.T) {
 		u := newTestUserService()
 		Superadmin := User{os.Getenv("CAKE_ADMIN_EMAIL"), os.Getenv("CAKE_ADMIN_PASSWORD"),
-			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}}
+			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}, "", ""}
 		u.repository.Add(Superadmin.Email, Superadmin)
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuthAdmin(u.repository, promoteHandler))
-		ts_3 := httptest.NewServer(j.jwtAuthAdmin(u.repository, fireHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, promoteHandler, PermAdminsPromote))
+		ts_3 := httptest.NewServer(j.jwtAuthorize(u.repository, fireHandler, PermAdminsFire))
 		defer ts_1.Close()
 		defer ts_2.Close()
 		defer ts_3.Close()
@@ -558,7 +567,7 @@ func TestAdmin_JWT(t *testing.T) {
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params_1)))
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params_2)))
 
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		admin, _ := u.repository.Get(os.Getenv("CAKE_ADMIN_EMAIL"))
 		token, _ := jwtService.GenearateJWT(admin)
 
@@ -576,7 +585,6 @@ func TestAdmin_JWT(t *testing.T) {
 		req, _ := http.NewRequest(http.MethodPost, ts_3.URL, prepareParams(t, fireteparams))
 		req.Header.Add("Authorization", "Bearer "+string(user_token))
 		resp := doRequest(req, err)
-		assertStatus(t, 401, resp)
-		assertBody(t, "Only superadmin can fire!", resp)
+		assertError(t, 403, "permission_denied", "You don't have permission to access this page", resp)
 	})
 }
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiKeyPrefix tells API keys from JWTs in the Authorization header.
+const apiKeyPrefix = "cake_"
+
+const (
+	defaultAPIKeyTTL = 90 * 24 * time.Hour
+	maxAPIKeyTTL     = 365 * 24 * time.Hour
+)
+
+// APIKey is a personal access token. Only its hash is stored. A key acts
+// as its owner, limited to its scopes on the routes which need permissions.
+type APIKey struct {
+	ID        string
+	Hash      string
+	Email     string
+	Name      string
+	Scopes    []Permission
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (k *APIKey) allows(perm Permission) bool {
+	for _, s := range k.Scopes {
+		if s == perm || s == PermAll {
+			return true
+		}
+	}
+	return false
+}
+
+type APIKeyStore interface {
+	Save(APIKey) error
+	// Get returns the key of hash.
+	Get(hash string) (APIKey, error)
+	// List returns the keys of email, newest first.
+	List(email string) ([]APIKey, error)
+	Delete(email, id string) error
+}
+
+var apiKeys APIKeyStore = NewInMemoryAPIKeyStore()
+
+var (
+	errAPIKeyNotFound   = newNotFoundError("api_key_not_found", "This API key doesn't exist")
+	errAPIKeyNotAllowed = newForbiddenError("api_key_not_allowed", "API keys can't access this page")
+)
+
+type apiKeyContextKey struct{}
+
+func withAPIKey(r *http.Request, k *APIKey) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, k))
+}
+
+// apiKeyFrom returns the key r was authenticated with, nil for a JWT.
+func apiKeyFrom(r *http.Request) *APIKey {
+	k, _ := r.Context().Value(apiKeyContextKey{}).(*APIKey)
+	return k
+}
+
+// authenticateAPIKey resolves the owner of key. Keys created before the
+// tokens of their owner were revoked are refused too.
+func authenticateAPIKey(key string, users UserRepository) (User, *APIKey, error) {
+	k, err := apiKeys.Get(hashToken(key))
+	if err != nil {
+		return User{}, nil, err
+	}
+	if time.Now().After(k.ExpiresAt) {
+		return User{}, nil, errAPIKeyNotFound
+	}
+	revoked, err := isRevoked(k.Email, "", k.CreatedAt)
+	if err != nil {
+		return User{}, nil, err
+	}
+	if revoked {
+		return User{}, nil, errAPIKeyNotFound
+	}
+	user, err := users.Get(k.Email)
+	if err != nil {
+		return User{}, nil, err
+	}
+	return user, &k, nil
+}
+
+// sessionOnly refuses requests authenticated with an API key, for what
+// would let a leaked key take over the account, and impersonation tokens.
+func sessionOnly(h ProtectedHandler) ProtectedHandler {
+	return func(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+		if apiKeyFrom(r) != nil {
+			handleError(errAPIKeyNotAllowed, w)
+			return
+		}
+		if impersonatorFrom(r) != "" {
+			handleError(errImpersonationForbidden, w)
+			return
+		}
+		h(w, r, u, us)
+	}
+}
+
+type CreateAPIKeyParams struct {
+	Name      string       `json:"name"`
+	Scopes    []Permission `json:"scopes"`
+	ExpiresAt *time.Time   `json:"expires_at"`
+}
+
+type APIKeyRecord struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Scopes    []Permission `json:"scopes"`
+	CreatedAt time.Time    `json:"created_at"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	// Key is only given once, on creation.
+	Key string `json:"key,omitempty"`
+}
+
+func newAPIKeyRecord(k APIKey) APIKeyRecord {
+	return APIKeyRecord{ID: k.ID, Name: k.Name, Scopes: k.Scopes, CreatedAt: k.CreatedAt, ExpiresAt: k.ExpiresAt}
+}
+
+type APIKeysResponse struct {
+	Keys []APIKeyRecord `json:"api_keys"`
+}
+
+func validateAPIKeyParams(p *CreateAPIKeyParams, u User, now time.Time) error {
+	if strings.TrimSpace(p.Name) == "" || len(p.Name) > 64 {
+		return newValidationError("name", "Name the key in 1 to 64 characters")
+	}
+	for _, s := range p.Scopes {
+		if !knownPermissions[s] {
+			return newValidationError("scopes", "Unknown scope "+string(s))
+		}
+		if !roles.Allows(u.Role, s) {
+			return newValidationError("scopes", "Your role doesn't grant "+string(s))
+		}
+	}
+	if p.ExpiresAt != nil && (!p.ExpiresAt.After(now) || p.ExpiresAt.Sub(now) > maxAPIKeyTTL) {
+		return newValidationError("expires_at", "The key must expire within a year")
+	}
+	return nil
+}
+
+// createAPIKeyHandler creates a key with some of the permissions of the
+// user. It expires after 90 days unless told otherwise.
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	params := &CreateAPIKeyParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(ErrInvalidParams, w)
+		return
+	}
+	now := time.Now()
+	if err := validateAPIKeyParams(params, u, now); err != nil {
+		handleError(err, w)
+		return
+	}
+	id, err := randomToken(8)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	key := apiKeyPrefix + secret
+	k := APIKey{
+		ID:        id,
+		Hash:      hashToken(key),
+		Email:     u.Email,
+		Name:      params.Name,
+		Scopes:    append([]Permission{}, params.Scopes...),
+		CreatedAt: now,
+		ExpiresAt: now.Add(defaultAPIKeyTTL),
+	}
+	if params.ExpiresAt != nil {
+		k.ExpiresAt = *params.ExpiresAt
+	}
+	if err := apiKeys.Save(k); err != nil {
+		handleError(err, w)
+		return
+	}
+	record := newAPIKeyRecord(k)
+	record.Key = key
+	writeJSON(w, http.StatusCreated, record)
+}
+
+func listAPIKeysHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	keys, err := apiKeys.List(u.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	resp := APIKeysResponse{Keys: []APIKeyRecord{}}
+	for _, k := range keys {
+		resp.Keys = append(resp.Keys, newAPIKeyRecord(k))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	if err := apiKeys.Delete(u.Email, mux.Vars(r)["id"]); err != nil {
+		handleError(err, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("The API key have been revoked"))
+}
+
+type InMemoryAPIKeyStore struct {
+	lock sync.Mutex
+	keys map[string]APIKey
+}
+
+func NewInMemoryAPIKeyStore() *InMemoryAPIKeyStore {
+	return &InMemoryAPIKeyStore{keys: make(map[string]APIKey)}
+}
+
+func (i *InMemoryAPIKeyStore) Save(k APIKey) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.keys[k.Hash] = k
+	return nil
+}
+
+func (i *InMemoryAPIKeyStore) Get(hash string) (APIKey, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	k, ok := i.keys[hash]
+	if !ok {
+		return APIKey{}, errAPIKeyNotFound
+	}
+	return k, nil
+}
+
+func (i *InMemoryAPIKeyStore) List(email string) ([]APIKey, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	keys := []APIKey{}
+	for _, k := range i.keys {
+		if k.Email == email {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a].CreatedAt.After(keys[b].CreatedAt) })
+	return keys, nil
+}
+
+func (i *InMemoryAPIKeyStore) Delete(email, id string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for hash, k := range i.keys {
+		if k.Email == email && k.ID == id {
+			delete(i.keys, hash)
+			return nil
+		}
+	}
+	return errAPIKeyNotFound
+}
+
+const apiKeysSchema = `
+CREATE TABLE IF NOT EXISTS api_keys (
+	hash       TEXT PRIMARY KEY,
+	id         TEXT NOT NULL,
+	email      TEXT NOT NULL,
+	name       TEXT NOT NULL,
+	scopes     TEXT NOT NULL DEFAULT '[]',
+	created_at DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS api_keys_email ON api_keys(email);
+`
+
+type SQLiteAPIKeyStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteAPIKeyStore(db *sql.DB) (*SQLiteAPIKeyStore, error) {
+	if _, err := db.Exec(apiKeysSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteAPIKeyStore{db: db}, nil
+}
+
+func (s *SQLiteAPIKeyStore) Save(k APIKey) error {
+	scopes, err := json.Marshal(append([]Permission{}, k.Scopes...))
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO api_keys (hash, id, email, name, scopes, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, k.Hash, k.ID, k.Email, k.Name, string(scopes), k.CreatedAt, k.ExpiresAt)
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	k := APIKey{}
+	var scopes string
+	if err := row.Scan(&k.Hash, &k.ID, &k.Email, &k.Name, &scopes, &k.CreatedAt, &k.ExpiresAt); err != nil {
+		return APIKey{}, err
+	}
+	if err := json.Unmarshal([]byte(scopes), &k.Scopes); err != nil {
+		return APIKey{}, err
+	}
+	return k, nil
+}
+
+func (s *SQLiteAPIKeyStore) Get(hash string) (APIKey, error) {
+	k, err := scanAPIKey(s.db.QueryRow(`SELECT hash, id, email, name, scopes, created_at, expires_at
+		FROM api_keys WHERE hash = ?`, hash))
+	if err == sql.ErrNoRows {
+		return APIKey{}, errAPIKeyNotFound
+	}
+	return k, err
+}
+
+func (s *SQLiteAPIKeyStore) List(email string) ([]APIKey, error) {
+	rows, err := s.db.Query(`SELECT hash, id, email, name, scopes, created_at, expires_at
+		FROM api_keys WHERE email = ? ORDER BY created_at DESC`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLiteAPIKeyStore) Delete(email, id string) error {
+	res, err := s.db.Exec(`DELETE FROM api_keys WHERE email = ? AND id = ?`, email, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// useAPIKeys gives the test its own API key store.
+func useAPIKeys(t *testing.T) {
+	old := apiKeys
+	apiKeys = NewInMemoryAPIKeyStore()
+	t.Cleanup(func() { apiKeys = old })
+}
+
+func TestAPIKeys(t *testing.T) {
+	doRequest := createRequester(t)
+	useAPIKeys(t)
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	u := newTestUserService()
+	superadmin := User{"super@mail.com", "", "cake", RoleSuperadmin, false, BanHistory{}, "", ""}
+	admin := User{"admin@mail.com", "", "cake", RoleAdmin, false, BanHistory{}, "", ""}
+	u.repository.Add(superadmin.Email, superadmin)
+	u.repository.Add(admin.Email, admin)
+	u.repository.Add("test@mail.com", User{"test@mail.com", "", "cake", RoleUser, false, BanHistory{}, "", ""})
+	r := mux.NewRouter()
+	r.HandleFunc("/user/api_keys", j.jwtAuthorize(u.repository, sessionOnly(createAPIKeyHandler))).Methods(http.MethodPost)
+	r.HandleFunc("/user/api_keys", j.jwtAuthorize(u.repository, listAPIKeysHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/user/api_keys/{id}", j.jwtAuthorize(u.repository, sessionOnly(revokeAPIKeyHandler))).Methods(http.MethodDelete)
+	r.HandleFunc("/admin/inspect", j.jwtAuthorize(u.repository, inspectHandler, PermUsersInspect)).Methods(http.MethodGet)
+	r.HandleFunc("/admin/ban", j.jwtAuthorize(u.repository, banHandler, PermUsersBan)).Methods(http.MethodPost)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	session, _ := j.GenearateJWT(superadmin)
+	send := func(method, path, token string, params map[string]interface{}) parsedResponse {
+		req, _ := http.NewRequest(method, ts.URL+path, prepareParams(t, params))
+		req.Header.Add("Authorization", "Bearer "+token)
+		return doRequest(req, nil)
+	}
+	create := func(params map[string]interface{}) APIKeyRecord {
+		t.Helper()
+		resp := send(http.MethodPost, "/user/api_keys", session, params)
+		assertStatus(t, 201, resp)
+		record := APIKeyRecord{}
+		json.Unmarshal(resp.body, &record)
+		return record
+	}
+
+	t.Run("validation", func(t *testing.T) {
+		assertError(t, 422, "validation_failed", "Name the key in 1 to 64 characters",
+			send(http.MethodPost, "/user/api_keys", session, map[string]interface{}{"name": " "}))
+		assertError(t, 422, "validation_failed", "Unknown scope cake:eat",
+			send(http.MethodPost, "/user/api_keys", session, map[string]interface{}{"name": "ci", "scopes": []string{"cake:eat"}}))
+		adminSession, _ := j.GenearateJWT(admin)
+		assertError(t, 422, "validation_failed", "Your role doesn't grant admins:fire",
+			send(http.MethodPost, "/user/api_keys", adminSession, map[string]interface{}{"name": "ci", "scopes": []string{"admins:fire"}}))
+		assertError(t, 422, "validation_failed", "The key must expire within a year",
+			send(http.MethodPost, "/user/api_keys", session, map[string]interface{}{"name": "ci", "expires_at": time.Now().Add(2 * maxAPIKeyTTL)}))
+	})
+
+	t.Run("scopes limit the key", func(t *testing.T) {
+		key := create(map[string]interface{}{"name": "inspector", "scopes": []string{"users:inspect", "users:ban"}})
+		if key.Key == "" || key.ExpiresAt.Sub(key.CreatedAt) != defaultAPIKeyTTL {
+			t.Fatalf("Unexpected key: %+v", key)
+		}
+		assertStatus(t, 200, send(http.MethodGet, "/admin/inspect", key.Key, map[string]interface{}{"email": "test@mail.com"}))
+		// the role of the owner allows it, the key doesn't
+		assertError(t, 403, "permission_denied", "Only superadmin can ban admin!",
+			send(http.MethodPost, "/admin/ban", key.Key, map[string]interface{}{"email": admin.Email, "reason": "test"}))
+
+		narrow := create(map[string]interface{}{"name": "reader", "scopes": []string{"users:inspect"}})
+		assertError(t, 403, "permission_denied", "You don't have permission to access this page",
+			send(http.MethodPost, "/admin/ban", narrow.Key, map[string]interface{}{"email": admin.Email, "reason": "test"}))
+	})
+
+	t.Run("keys can't manage keys", func(t *testing.T) {
+		key := create(map[string]interface{}{"name": "script"})
+		assertError(t, 403, "api_key_not_allowed", "API keys can't access this page",
+			send(http.MethodPost, "/user/api_keys", key.Key, map[string]interface{}{"name": "another"}))
+		assertError(t, 403, "api_key_not_allowed", "API keys can't access this page",
+			send(http.MethodDelete, "/user/api_keys/"+key.ID, key.Key, nil))
+		assertStatus(t, 200, send(http.MethodGet, "/user/api_keys", key.Key, nil))
+	})
+
+	t.Run("list and revoke", func(t *testing.T) {
+		key := create(map[string]interface{}{"name": "revoked", "scopes": []string{"users:inspect"}})
+		resp := send(http.MethodGet, "/user/api_keys", session, nil)
+		assertStatus(t, 200, resp)
+		list := APIKeysResponse{}
+		json.Unmarshal(resp.body, &list)
+		if len(list.Keys) == 0 || list.Keys[0].ID != key.ID || list.Keys[0].Key != "" {
+			t.Fatalf("Unexpected keys: %s", resp.body)
+		}
+		resp = send(http.MethodDelete, "/user/api_keys/"+key.ID, session, nil)
+		assertStatus(t, 200, resp)
+		assertBody(t, "The API key have been revoked", resp)
+		assertStatus(t, 401, send(http.MethodGet, "/admin/inspect", key.Key, map[string]interface{}{"email": "test@mail.com"}))
+		assertError(t, 404, "api_key_not_found", "This API key doesn't exist",
+			send(http.MethodDelete, "/user/api_keys/"+key.ID, session, nil))
+	})
+
+	t.Run("expired key", func(t *testing.T) {
+		key := create(map[string]interface{}{"name": "short", "expires_at": time.Now().Add(time.Hour)})
+		k, _ := apiKeys.Get(hashToken(key.Key))
+		k.ExpiresAt = time.Now().Add(-time.Minute)
+		apiKeys.Save(k)
+		assertStatus(t, 401, send(http.MethodGet, "/user/api_keys", key.Key, nil))
+	})
+}
+
+func TestSQLiteAPIKeyStore(t *testing.T) {
+	users := newTestSQLiteStorage(t)
+	s, err := NewSQLiteAPIKeyStore(users.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+	s.Save(APIKey{ID: "old", Hash: "h1", Email: "test@mail.com", Name: "ci", Scopes: []Permission{PermUsersInspect},
+		CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)})
+	s.Save(APIKey{ID: "new", Hash: "h2", Email: "test@mail.com", Name: "cron", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	k, err := s.Get("h1")
+	if err != nil || len(k.Scopes) != 1 || k.Scopes[0] != PermUsersInspect || !k.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Unexpected key: %+v, %v", k, err)
+	}
+	keys, err := s.List("test@mail.com")
+	if err != nil || len(keys) != 2 || keys[0].ID != "new" {
+		t.Fatalf("Unexpected keys: %+v, %v", keys, err)
+	}
+	if err := s.Delete("other@mail.com", "old"); err != errAPIKeyNotFound {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	s.Delete("test@mail.com", "old")
+	if _, err := s.Get("h1"); err != errAPIKeyNotFound {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
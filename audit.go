@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AuditEntry records a privileged action. Entries form a chain: Hash covers
+// every other field, PrevHash included, so changing, removing or reordering
+// entries breaks the chain from that point on. Hash is keyed with auditKey,
+// so that the chain can't be rebuilt by whoever can write to the store, and
+// the head of the chain is kept apart, so that dropping the newest entries
+// shows too.
+type AuditEntry struct {
+	Seq       int64           `json:"seq"`
+	Time      time.Time       `json:"time"`
+	RequestID string          `json:"request_id,omitempty"`
+	Actor     string          `json:"actor"`
+	Target    string          `json:"target,omitempty"`
+	Action    string          `json:"action"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	Status    int             `json:"status"`
+	Result    string          `json:"result"`
+	PrevHash  string          `json:"prev_hash"`
+	Hash      string          `json:"hash"`
+}
+
+// Audit results, derived from the response status.
+const (
+	AuditSuccess = "success"
+	AuditDenied  = "denied"
+	AuditFailure = "failure"
+)
+
+func auditResult(status int) string {
+	switch {
+	case status < 400:
+		return AuditSuccess
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return AuditDenied
+	default:
+		return AuditFailure
+	}
+}
+
+// auditKey keys the entry hashes, it comes from the configuration.
+var auditKey []byte
+
+func (e AuditEntry) computeHash() string {
+	payload, _ := json.Marshal(struct {
+		Seq       int64
+		Time      string
+		RequestID string
+		Actor     string
+		Target    string
+		Action    string
+		Params    json.RawMessage
+		Status    int
+		Result    string
+		PrevHash  string
+	}{e.Seq, e.Time.UTC().Format(time.RFC3339Nano), e.RequestID, e.Actor, e.Target, e.Action,
+		e.Params, e.Status, e.Result, e.PrevHash})
+	mac := hmac.New(sha256.New, auditKey)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AuditQuery selects entries, empty fields match everything. Entries come
+// in chain order starting after the After seq.
+type AuditQuery struct {
+	Actor  string
+	Target string
+	Action string
+	After  int64
+	Limit  int
+}
+
+func (q AuditQuery) matches(e AuditEntry) bool {
+	return e.Seq > q.After &&
+		(q.Actor == "" || e.Actor == q.Actor) &&
+		(q.Target == "" || e.Target == q.Target) &&
+		(q.Action == "" || e.Action == q.Action)
+}
+
+// AuditHead is the last entry appended to the chain.
+type AuditHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// AuditStore is an append-only store of audit entries. Append numbers the
+// entry and links it to the previous one. Head is kept where removing
+// entries doesn't change it.
+type AuditStore interface {
+	Append(AuditEntry) (AuditEntry, error)
+	Query(AuditQuery) ([]AuditEntry, error)
+	Head() (AuditHead, error)
+}
+
+var auditLog AuditStore = NewInMemoryAuditStore()
+
+// chain fills the fields of e which link it after prev.
+func chain(e AuditEntry, prev *AuditEntry) AuditEntry {
+	e.Seq, e.PrevHash = 1, ""
+	if prev != nil {
+		e.Seq, e.PrevHash = prev.Seq+1, prev.Hash
+	}
+	e.Time = e.Time.UTC()
+	e.Hash = e.computeHash()
+	return e
+}
+
+type InMemoryAuditStore struct {
+	lock    sync.RWMutex
+	entries []AuditEntry
+	head    AuditHead
+}
+
+func NewInMemoryAuditStore() *InMemoryAuditStore {
+	return &InMemoryAuditStore{}
+}
+
+func (s *InMemoryAuditStore) Append(e AuditEntry) (AuditEntry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var prev *AuditEntry
+	if len(s.entries) > 0 {
+		prev = &s.entries[len(s.entries)-1]
+	}
+	e = chain(e, prev)
+	s.entries = append(s.entries, e)
+	s.head = AuditHead{Seq: e.Seq, Hash: e.Hash}
+	return e, nil
+}
+
+func (s *InMemoryAuditStore) Head() (AuditHead, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.head, nil
+}
+
+func (s *InMemoryAuditStore) Query(q AuditQuery) ([]AuditEntry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	entries := []AuditEntry{}
+	for _, e := range s.entries {
+		if q.Limit > 0 && len(entries) == q.Limit {
+			break
+		}
+		if q.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+const auditSchema = `
+CREATE TABLE IF NOT EXISTS audit_log (
+	seq        INTEGER PRIMARY KEY,
+	time       TEXT NOT NULL,
+	request_id TEXT NOT NULL,
+	actor      TEXT NOT NULL,
+	target     TEXT NOT NULL,
+	action     TEXT NOT NULL,
+	params     TEXT NOT NULL,
+	status     INTEGER NOT NULL,
+	result     TEXT NOT NULL,
+	prev_hash  TEXT NOT NULL,
+	hash       TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_log_actor ON audit_log(actor);
+CREATE INDEX IF NOT EXISTS audit_log_target ON audit_log(target);
+`
+
+var errAuditHeadMissing = errors.New("the audit head is missing, but the audit log is not empty")
+
+// FileAuditHead keeps the head of the chain in a file, away from the
+// database.
+type FileAuditHead struct {
+	Path string
+}
+
+// Load fails with an error satisfying os.IsNotExist before the first Save.
+func (f FileAuditHead) Load() (AuditHead, error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return AuditHead{}, err
+	}
+	head := AuditHead{}
+	err = json.Unmarshal(data, &head)
+	return head, err
+}
+
+// Save replaces the file at once, a crash can't leave half a head.
+func (f FileAuditHead) Save(head AuditHead) error {
+	data, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	tmp := f.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.Path)
+}
+
+type SQLiteAuditStore struct {
+	lock sync.Mutex
+	db   *sql.DB
+	head FileAuditHead
+}
+
+// NewSQLiteAuditStore keeps the head of the chain in the file at headPath.
+func NewSQLiteAuditStore(db *sql.DB, headPath string) (*SQLiteAuditStore, error) {
+	if _, err := db.Exec(auditSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteAuditStore{db: db, head: FileAuditHead{Path: headPath}}, nil
+}
+
+const auditColumns = `seq, time, request_id, actor, target, action, params, status, result, prev_hash, hash`
+
+func scanAuditEntry(row interface{ Scan(...interface{}) error }) (AuditEntry, error) {
+	e := AuditEntry{}
+	var at, params string
+	err := row.Scan(&e.Seq, &at, &e.RequestID, &e.Actor, &e.Target, &e.Action, &params,
+		&e.Status, &e.Result, &e.PrevHash, &e.Hash)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+	e.Time, err = time.Parse(time.RFC3339Nano, at)
+	if params != "" {
+		e.Params = json.RawMessage(params)
+	}
+	return e, err
+}
+
+func (s *SQLiteAuditStore) Append(e AuditEntry) (AuditEntry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return AuditEntry{}, err
+	}
+	defer tx.Rollback()
+	var prev *AuditEntry
+	last, err := scanAuditEntry(tx.QueryRow(`SELECT ` + auditColumns + ` FROM audit_log ORDER BY seq DESC LIMIT 1`))
+	if err == nil {
+		prev = &last
+	} else if err != sql.ErrNoRows {
+		return AuditEntry{}, err
+	}
+	e = chain(e, prev)
+	_, err = tx.Exec(`INSERT INTO audit_log (`+auditColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Seq, e.Time.Format(time.RFC3339Nano), e.RequestID, e.Actor, e.Target, e.Action, string(e.Params),
+		e.Status, e.Result, e.PrevHash, e.Hash)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return AuditEntry{}, err
+	}
+	// a head behind the log only misses the truncation of what follows it
+	if err := s.head.Save(AuditHead{Seq: e.Seq, Hash: e.Hash}); err != nil {
+		log.Println("Could not save the audit head", s.head.Path, err)
+	}
+	return e, nil
+}
+
+// Head fails when the head file is missing but the log isn't empty, deleting
+// it would otherwise hide the truncation of the log.
+func (s *SQLiteAuditStore) Head() (AuditHead, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	head, err := s.head.Load()
+	if !os.IsNotExist(err) {
+		return head, err
+	}
+	var entries int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM audit_log`).Scan(&entries); err != nil {
+		return AuditHead{}, err
+	}
+	if entries > 0 {
+		return AuditHead{}, errAuditHeadMissing
+	}
+	return AuditHead{}, nil
+}
+
+func (s *SQLiteAuditStore) Query(q AuditQuery) ([]AuditEntry, error) {
+	query := `SELECT ` + auditColumns + ` FROM audit_log WHERE seq > ?`
+	args := []interface{}{q.After}
+	for column, value := range map[string]string{"actor": q.Actor, "target": q.Target, "action": q.Action} {
+		if value != "" {
+			query += ` AND ` + column + ` = ?`
+			args = append(args, value)
+		}
+	}
+	query += ` ORDER BY seq`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// AuditVerification is the outcome of VerifyAuditLog. BrokenAt is the seq
+// of the first entry which doesn't fit the chain.
+type AuditVerification struct {
+	OK       bool   `json:"ok"`
+	Entries  int    `json:"entries"`
+	BrokenAt int64  `json:"broken_at,omitempty"`
+	Problem  string `json:"problem,omitempty"`
+}
+
+// VerifyAuditLog walks the whole chain checking every link and hash, up to
+// the head at least.
+func VerifyAuditLog(store AuditStore) (AuditVerification, error) {
+	head, err := store.Head()
+	if err != nil {
+		return AuditVerification{}, err
+	}
+	v := AuditVerification{OK: true}
+	var prev *AuditEntry
+	var after int64
+	for {
+		entries, err := store.Query(AuditQuery{After: after, Limit: 500})
+		if err != nil {
+			return AuditVerification{}, err
+		}
+		if len(entries) == 0 {
+			if after < head.Seq {
+				return v.broken(after+1, "the newest entries are missing"), nil
+			}
+			return v, nil
+		}
+		for i := range entries {
+			e := entries[i]
+			expected := chain(e, prev)
+			switch {
+			case e.Seq != expected.Seq:
+				return v.broken(e.Seq, "entries are missing before this one"), nil
+			case e.PrevHash != expected.PrevHash:
+				return v.broken(e.Seq, "does not link to the previous entry"), nil
+			case e.Hash != expected.Hash:
+				return v.broken(e.Seq, "content does not match its hash"), nil
+			case e.Seq == head.Seq && e.Hash != head.Hash:
+				return v.broken(e.Seq, "does not match the head of the log"), nil
+			}
+			v.Entries++
+			prev = &entries[i]
+		}
+		after = prev.Seq
+	}
+}
+
+func (v AuditVerification) broken(seq int64, problem string) AuditVerification {
+	v.OK, v.BrokenAt, v.Problem = false, seq, problem
+	return v
+}
+
+// recordAudit appends to auditLog, an audit entry which can't be written is
+// logged so that it isn't lost entirely.
+func recordAudit(e AuditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if _, err := auditLog.Append(e); err != nil {
+		log.Println("Could not write audit entry", e.Action, e.Actor, e.Target, err)
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// audited records every call of h as action, whether it was allowed or not.
+// It goes outside jwtAuthorize, which tells it the actor.
+func audited(action string, h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			handleError(newBadRequestError("invalid_request", "could not read request"), rw)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		info := requestInfoFrom(r)
+		if r.Context().Value(requestInfoKey{}) == nil {
+			r = withRequestInfo(r, info)
+		}
+		writer := &statusWriter{ResponseWriter: rw}
+		h(writer, r)
+		if writer.status == 0 {
+			writer.status = http.StatusOK
+		}
+		params, target := auditParams(r, body)
+		actor := info.User
+		// the superadmin answers for what is tried while impersonating
+		if info.Impersonator != "" {
+			actor = info.Impersonator
+			if target == "" {
+				target = info.User
+			}
+		}
+		recordAudit(AuditEntry{
+			RequestID: info.ID,
+			Actor:     actor,
+			Target:    target,
+			Action:    action,
+			Params:    params,
+			Status:    writer.status,
+			Result:    auditResult(writer.status),
+		})
+	}
+}
+
+// auditParams gathers the path variables, query and JSON body of r, redacted
+// like in the access log, and picks the email they refer to.
+func auditParams(r *http.Request, body []byte) (json.RawMessage, string) {
+	params := map[string]interface{}{}
+	for name, value := range mux.Vars(r) {
+		params[name] = value
+	}
+	for name, values := range r.URL.Query() {
+		params[name] = values[0]
+	}
+	if fields, ok := redactBody(body, len(body), false).(map[string]interface{}); ok {
+		for name, value := range fields {
+			params[name] = value
+		}
+	}
+	target, _ := params["email"].(string)
+	if len(params) == 0 {
+		return nil, target
+	}
+	raw, _ := json.Marshal(params)
+	return raw, target
+}
+
+type AuditPage struct {
+	Entries []AuditEntry `json:"entries"`
+	// Next is the after parameter of the next page, empty on the last one.
+	Next string `json:"next,omitempty"`
+}
+
+// auditQueryHandler pages through the audit log filtered by the actor,
+// target and action query parameters.
+func auditQueryHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	limit, err := pageSize(r)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	query := r.URL.Query()
+	q := AuditQuery{
+		Actor:  query.Get("actor"),
+		Target: query.Get("target"),
+		Action: query.Get("action"),
+		Limit:  limit + 1,
+	}
+	if after := query.Get("after"); after != "" {
+		q.After, err = strconv.ParseInt(after, 10, 64)
+		if err != nil || q.After < 0 {
+			handleError(newValidationError("after", "after must be an entry number"), w)
+			return
+		}
+	}
+	entries, err := auditLog.Query(q)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	page := AuditPage{Entries: entries}
+	if len(entries) > limit {
+		page.Entries = entries[:limit]
+		page.Next = strconv.FormatInt(page.Entries[limit-1].Seq, 10)
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func auditVerifyHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	v, err := VerifyAuditLog(auditLog)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useAuditStore makes s the audit log for the duration of the test.
+func useAuditStore(t *testing.T, s AuditStore) {
+	old := auditLog
+	auditLog = s
+	t.Cleanup(func() { auditLog = old })
+}
+
+func appendAuditEntries(t *testing.T, s AuditStore, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := s.Append(AuditEntry{Actor: "admin@mail.com", Target: "test@mail.com", Action: "user.ban",
+			Params: json.RawMessage(`{"reason":"spam"}`), Status: 201, Result: AuditSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	t.Run("memory chain", func(t *testing.T) {
+		s := NewInMemoryAuditStore()
+		appendAuditEntries(t, s, 3)
+		if v, _ := VerifyAuditLog(s); !v.OK || v.Entries != 3 {
+			t.Fatalf("Unexpected verification: %+v", v)
+		}
+		s.entries[1].Target = "someone@mail.com"
+		if v, _ := VerifyAuditLog(s); v.OK || v.BrokenAt != 2 || v.Problem != "content does not match its hash" {
+			t.Errorf("Unexpected verification: %+v", v)
+		}
+		s.entries[1] = chain(s.entries[1], &s.entries[0])
+		if v, _ := VerifyAuditLog(s); v.OK || v.BrokenAt != 3 {
+			t.Errorf("rehashing an entry should break the next link: %+v", v)
+		}
+	})
+
+	t.Run("removed entry", func(t *testing.T) {
+		s := NewInMemoryAuditStore()
+		appendAuditEntries(t, s, 3)
+		s.entries = append(s.entries[:1], s.entries[2:]...)
+		if v, _ := VerifyAuditLog(s); v.OK || v.BrokenAt != 3 || v.Problem != "entries are missing before this one" {
+			t.Errorf("Unexpected verification: %+v", v)
+		}
+	})
+
+	t.Run("truncated log", func(t *testing.T) {
+		s := NewInMemoryAuditStore()
+		appendAuditEntries(t, s, 3)
+		s.entries = s.entries[:2]
+		if v, _ := VerifyAuditLog(s); v.OK || v.BrokenAt != 3 || v.Problem != "the newest entries are missing" {
+			t.Errorf("Unexpected verification: %+v", v)
+		}
+	})
+
+	t.Run("chain rebuilt without the key", func(t *testing.T) {
+		defer func(old []byte) { auditKey = old }(auditKey)
+		auditKey = []byte("audit key")
+		s := NewInMemoryAuditStore()
+		appendAuditEntries(t, s, 2)
+		auditKey = nil
+		s.entries[1].Target = "someone@mail.com"
+		s.entries[1] = chain(s.entries[1], &s.entries[0])
+		s.head = AuditHead{Seq: 2, Hash: s.entries[1].Hash}
+		auditKey = []byte("audit key")
+		if v, _ := VerifyAuditLog(s); v.OK || v.BrokenAt != 2 || v.Problem != "content does not match its hash" {
+			t.Errorf("Unexpected verification: %+v", v)
+		}
+	})
+
+	t.Run("sqlite chain", func(t *testing.T) {
+		users := newTestSQLiteStorage(t)
+		head := filepath.Join(t.TempDir(), "audit.head")
+		s, err := NewSQLiteAuditStore(users.db, head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		appendAuditEntries(t, s, 600)
+		if v, err := VerifyAuditLog(s); err != nil || !v.OK || v.Entries != 600 {
+			t.Fatalf("Unexpected verification: %+v, %v", v, err)
+		}
+		if h, _ := (FileAuditHead{Path: head}).Load(); h.Seq != 600 {
+			t.Errorf("Unexpected head: %+v", h)
+		}
+		users.db.Exec(`UPDATE audit_log SET params = '{"reason":"nothing"}' WHERE seq = 550`)
+		if v, _ := VerifyAuditLog(s); v.OK || v.BrokenAt != 550 {
+			t.Errorf("Unexpected verification: %+v", v)
+		}
+		users.db.Exec(`DELETE FROM audit_log WHERE seq >= 550`)
+		if v, _ := VerifyAuditLog(s); v.OK || v.BrokenAt != 550 || v.Problem != "the newest entries are missing" {
+			t.Errorf("Unexpected verification: %+v", v)
+		}
+	})
+
+	t.Run("sqlite head deleted", func(t *testing.T) {
+		users := newTestSQLiteStorage(t)
+		head := filepath.Join(t.TempDir(), "audit.head")
+		s, err := NewSQLiteAuditStore(users.db, head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := VerifyAuditLog(s); err != nil || !v.OK {
+			t.Fatalf("an empty log without a head should verify: %+v, %v", v, err)
+		}
+		appendAuditEntries(t, s, 3)
+		users.db.Exec(`DELETE FROM audit_log WHERE seq = 3`)
+		if err := os.Remove(head); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := VerifyAuditLog(s); err != errAuditHeadMissing {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestAudited(t *testing.T) {
+	doRequest := createRequester(t)
+	store := NewInMemoryAuditStore()
+	useAuditStore(t, store)
+	u := newTestUserService()
+	admin := User{"admin@mail.com", "", "cake", RoleAdmin, false, BanHistory{}, "", ""}
+	boss := User{"boss@mail.com", "", "cake", RoleSuperadmin, false, BanHistory{}, "", ""}
+	u.repository.Add(admin.Email, admin)
+	u.repository.Add(boss.Email, boss)
+	u.repository.Add("test@mail.com", User{"test@mail.com", "", "cake", RoleUser, false, BanHistory{}, "", ""})
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	ban := httptest.NewServer(audited("user.ban", j.jwtAuthorize(u.repository, banHandler, PermUsersBan)))
+	defer ban.Close()
+	promote := httptest.NewServer(audited("admin.promote", j.jwtAuthorize(u.repository, promoteHandler, PermAdminsPromote)))
+	defer promote.Close()
+	audit := httptest.NewServer(j.jwtAuthorize(u.repository, auditQueryHandler, PermAuditRead))
+	defer audit.Close()
+	verify := httptest.NewServer(j.jwtAuthorize(u.repository, auditVerifyHandler, PermAuditRead))
+	defer verify.Close()
+	adminToken, _ := j.GenearateJWT(admin)
+	bossToken, _ := j.GenearateJWT(boss)
+	send := func(method, url, token string, params map[string]interface{}) parsedResponse {
+		req, _ := http.NewRequest(method, url, prepareParams(t, params))
+		req.Header.Add("Authorization", "Bearer "+token)
+		return doRequest(req, nil)
+	}
+
+	assertStatus(t, 201, send(http.MethodPost, ban.URL, adminToken,
+		map[string]interface{}{"email": "test@mail.com", "reason": "spam", "password": "secret"}))
+	assertStatus(t, 403, send(http.MethodPost, promote.URL, adminToken, map[string]interface{}{"email": "test@mail.com"}))
+
+	entries, _ := store.Query(AuditQuery{})
+	if len(entries) != 2 {
+		t.Fatalf("Unexpected entries: %+v", entries)
+	}
+	if e := entries[0]; e.Actor != admin.Email || e.Target != "test@mail.com" || e.Result != AuditSuccess || e.Status != 201 {
+		t.Errorf("Unexpected ban entry: %+v", e)
+	}
+	if params := string(entries[0].Params); !strings.Contains(params, `"reason":"spam"`) || strings.Contains(params, "secret") {
+		t.Errorf("Unexpected params: %s", params)
+	}
+	if e := entries[1]; e.Action != "admin.promote" || e.Result != AuditDenied {
+		t.Errorf("Unexpected promote entry: %+v", e)
+	}
+
+	t.Run("query is superadmin only", func(t *testing.T) {
+		assertError(t, 403, "permission_denied", "You don't have permission to access this page",
+			send(http.MethodGet, audit.URL, adminToken, nil))
+		resp := send(http.MethodGet, audit.URL+"?action=admin.promote", bossToken, nil)
+		assertStatus(t, 200, resp)
+		page := AuditPage{}
+		json.Unmarshal(resp.body, &page)
+		if len(page.Entries) != 1 || page.Entries[0].Seq != 2 || page.Next != "" {
+			t.Errorf("Unexpected page: %+v", page)
+		}
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		resp := send(http.MethodGet, verify.URL, bossToken, nil)
+		v := AuditVerification{}
+		json.Unmarshal(resp.body, &v)
+		if !v.OK || v.Entries != 2 {
+			t.Errorf("Unexpected verification: %s", resp.body)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// systemActor is recorded as the one who unbanned when a ban runs out.
+const systemActor = "system"
+
+// ExpiredBanFinder is implemented by repositories able to find the users
+// whose temporary ban has ended.
+type ExpiredBanFinder interface {
+	ExpiredBans(now time.Time) ([]string, error)
+}
+
+func banEndText(until time.Time) string {
+	if until.IsZero() {
+		return ""
+	}
+	return " (until " + until.UTC().Format(time.RFC3339) + ")"
+}
+
+func banExpired(u User, now time.Time) bool {
+	if !u.Banned {
+		return false
+	}
+	ban := u.BanHistory.active()
+	return ban != nil && !ban.Until.IsZero() && !ban.Until.After(now)
+}
+
+// liftExpiredBan unbans u if its ban has ended and tells whether it did.
+// The update only applies to the user as read, if it has been banned or
+// unbanned since it fails with ErrUserChanged.
+func liftExpiredBan(us UserRepository, u User, now time.Time) (User, bool, error) {
+	if !banExpired(u, now) {
+		return u, false, nil
+	}
+	u.BanHistory.Append(BanEvent{Type: BanEventExpired, At: now, Actor: systemActor, Reason: "ban expired"})
+	u.Banned = false
+	if err := us.Update(u.Email, u); err != nil {
+		return u, false, err
+	}
+	unbans.Inc()
+	recordAudit(AuditEntry{Time: now, Actor: systemActor, Target: u.Email, Action: "user.ban_expired",
+		Status: http.StatusOK, Result: AuditSuccess})
+	return u, true, nil
+}
+
+// liftExpiredBans unbans every user whose ban has ended and returns how
+// many were unbanned.
+func liftExpiredBans(us UserRepository, now time.Time) (int, error) {
+	finder, ok := us.(ExpiredBanFinder)
+	if !ok {
+		return 0, nil
+	}
+	emails, err := finder.ExpiredBans(now)
+	if err != nil {
+		return 0, err
+	}
+	lifted := 0
+	for _, email := range emails {
+		// the user may have been unbanned or banned again meanwhile,
+		// liftExpiredBan checks again
+		user, err := us.Get(email)
+		if err != nil {
+			continue
+		}
+		_, ok, err := liftExpiredBan(us, user, now)
+		if err == ErrUserChanged {
+			// changed between the Get and the lift, the next run sees it
+			continue
+		}
+		if err != nil {
+			return lifted, err
+		}
+		if ok {
+			lifted++
+		}
+	}
+	return lifted, nil
+}
+
+// runBanExpiry lifts expired bans every interval until ctx is done.
+func runBanExpiry(ctx context.Context, us UserRepository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := liftExpiredBans(us, now)
+			if err != nil {
+				log.Println("Could not lift expired bans:", err)
+			}
+			if n > 0 {
+				log.Println("Lifted expired bans:", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func bannedUser(t *testing.T, email string, until time.Time) User {
+	t.Helper()
+	digest, err := hashPassword("somepass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := NewBanHistory()
+	history.Append(BanEvent{Type: BanEventBan, At: time.Now().Add(-time.Hour), Actor: "admin@mail.com", Reason: "because", Until: until})
+	return User{email, digest, "cake", RoleUser, true, *history, "", ""}
+}
+
+func TestBanExpiry(t *testing.T) {
+	doRequest := createRequester(t)
+
+	t.Run("temporary ban", func(t *testing.T) {
+		u := newTestUserService()
+		admin := User{"admin@mail.com", "", "cake", RoleSuperadmin, false, *NewBanHistory(), "", ""}
+		u.repository.Add(admin.Email, admin)
+		u.repository.Add("test@mail.com", User{"test@mail.com", "", "cake", RoleUser, false, *NewBanHistory(), "", ""})
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+		if err != nil {
+			t.FailNow()
+		}
+		ts := httptest.NewServer(j.jwtAuthorize(u.repository, banHandler, PermUsersBan))
+		defer ts.Close()
+		token, _ := j.GenearateJWT(admin)
+
+		params := map[string]interface{}{"email": "test@mail.com", "reason": "because", "duration": "soon"}
+		req, _ := http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params))
+		req.Header.Add("Authorization", "Bearer "+token)
+		assertError(t, 422, "validation_failed", "Invalid ban duration", doRequest(req, nil))
+
+		params["duration"] = "2h"
+		req, _ = http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params))
+		req.Header.Add("Authorization", "Bearer "+token)
+		resp := doRequest(req, nil)
+		assertStatus(t, 201, resp)
+		user, _ := u.repository.Get("test@mail.com")
+		until := user.BanHistory.active().Until
+		if d := time.Until(until); d < time.Hour || d > 2*time.Hour {
+			t.Errorf("Unexpected ban end: %v", until)
+		}
+		assertBody(t, "The user have been banned bacause: because"+banEndText(until), resp)
+	})
+
+	t.Run("lift expired bans", func(t *testing.T) {
+		u := newTestUserService()
+		now := time.Now()
+		u.repository.Add("expired@mail.com", bannedUser(t, "expired@mail.com", now.Add(-time.Minute)))
+		u.repository.Add("later@mail.com", bannedUser(t, "later@mail.com", now.Add(time.Minute)))
+		u.repository.Add("forever@mail.com", bannedUser(t, "forever@mail.com", time.Time{}))
+		n, err := liftExpiredBans(u.repository, now)
+		if err != nil || n != 1 {
+			t.Fatalf("expected one lifted ban, got %d, %v", n, err)
+		}
+		user, _ := u.repository.Get("expired@mail.com")
+		if ban := user.BanHistory.Bans()[0]; user.Banned || ban.Unbanned != BanEventExpired || ban.WhoUnbanned != systemActor {
+			t.Errorf("Ban has not been lifted: %+v", ban)
+		}
+		for _, email := range []string{"later@mail.com", "forever@mail.com"} {
+			if user, _ := u.repository.Get(email); !user.Banned {
+				t.Errorf("%s should still be banned", email)
+			}
+		}
+	})
+
+	t.Run("a stale lift is refused", func(t *testing.T) {
+		repositories := map[string]UserRepository{
+			"in-memory": newTestUserService().repository,
+			"sqlite":    newTestSQLiteStorage(t),
+		}
+		for name, us := range repositories {
+			now := time.Now()
+			us.Add("expired@mail.com", bannedUser(t, "expired@mail.com", now.Add(-time.Minute)))
+			read, _ := us.Get("expired@mail.com")
+			// an admin unbans and bans again for good before the lift
+			again, _ := us.Get("expired@mail.com")
+			again.BanHistory.Append(BanEvent{Type: BanEventUnban, At: now, Actor: "admin@mail.com"})
+			again.BanHistory.Append(BanEvent{Type: BanEventBan, At: now, Actor: "admin@mail.com", Reason: "again"})
+			if err := us.Update(again.Email, again); err != nil {
+				t.Fatalf("%s: unexpected error: %v", name, err)
+			}
+			if _, ok, err := liftExpiredBan(us, read, now); ok || err != ErrUserChanged {
+				t.Errorf("%s: expected a conflict, got %v, %v", name, ok, err)
+			}
+			user, _ := us.Get("expired@mail.com")
+			if ban := user.BanHistory.active(); !user.Banned || ban == nil || ban.Why != "again" {
+				t.Errorf("%s: the new ban has been lifted: %+v", name, user.BanHistory.Events())
+			}
+		}
+	})
+
+	t.Run("login tells when the ban ends", func(t *testing.T) {
+		u := newTestUserService()
+		until := time.Now().Add(time.Hour)
+		u.repository.Add("test@mail.com", bannedUser(t, "test@mail.com", until))
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+		if err != nil {
+			t.FailNow()
+		}
+		ts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		defer ts.Close()
+		params := map[string]interface{}{"email": "test@mail.com", "password": "somepass"}
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		assertError(t, 403, "user_banned", "Your are banned because : because"+banEndText(until), resp)
+	})
+
+	t.Run("login after the ban ended", func(t *testing.T) {
+		u := newTestUserService()
+		u.repository.Add("test@mail.com", bannedUser(t, "test@mail.com", time.Now().Add(-time.Second)))
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+		if err != nil {
+			t.FailNow()
+		}
+		ts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		defer ts.Close()
+		params := map[string]interface{}{"email": "test@mail.com", "password": "somepass"}
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		assertStatus(t, 200, resp)
+		if user, _ := u.repository.Get("test@mail.com"); user.Banned {
+			t.Errorf("ban should have been lifted on login")
+		}
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		s := newTestSQLiteStorage(t)
+		now := time.Now()
+		s.Add("expired@mail.com", bannedUser(t, "expired@mail.com", now.Add(-time.Minute)))
+		s.Add("later@mail.com", bannedUser(t, "later@mail.com", now.Add(time.Minute)))
+		s.Add("forever@mail.com", bannedUser(t, "forever@mail.com", time.Time{}))
+		emails, err := s.ExpiredBans(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(emails, ",") != "expired@mail.com" {
+			t.Errorf("Unexpected expired bans: %v", emails)
+		}
+		if n, err := liftExpiredBans(s, now); err != nil || n != 1 {
+			t.Errorf("expected one lifted ban, got %d, %v", n, err)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"time"
+)
+
+type BanEventType string
+
+const (
+	BanEventBan            BanEventType = "ban"
+	BanEventUnban          BanEventType = "unban"
+	BanEventExpired        BanEventType = "expired"
+	BanEventAppealAccepted BanEventType = "appeal_accepted"
+	BanEventAppealRejected BanEventType = "appeal_rejected"
+)
+
+// endsBan tells whether an event of this type lifts the ban in force.
+func (t BanEventType) endsBan() bool {
+	return t == BanEventUnban || t == BanEventExpired || t == BanEventAppealAccepted
+}
+
+// BanEvent is an entry of a user's ban log. Seq numbers the events of a user
+// from 1 in the order they happened.
+type BanEvent struct {
+	Seq    int
+	Type   BanEventType
+	At     time.Time
+	Actor  string
+	Reason string
+	// Until is when a temporary ban ends, zero for permanent bans and for
+	// the other events.
+	Until time.Time
+}
+
+// BanHistory is the append-only ban log of a user. The zero value is an
+// empty log.
+type BanHistory struct {
+	events []BanEvent
+}
+
+func NewBanHistory() *BanHistory {
+	return &BanHistory{}
+}
+
+// Append adds e at the end of the log and returns it numbered.
+func (b *BanHistory) Append(e BanEvent) BanEvent {
+	e.Seq = len(b.events) + 1
+	// copies of a User share the events, never write into their array
+	b.events = append(b.events[:len(b.events):len(b.events)], e)
+	return e
+}
+
+func (b BanHistory) Events() []BanEvent {
+	events := make([]BanEvent, len(b.events))
+	copy(events, b.events)
+	return events
+}
+
+func (b BanHistory) Len() int {
+	return len(b.events)
+}
+
+// same tells whether e and other are the same event of a log.
+func (e BanEvent) same(other BanEvent) bool {
+	return e.Seq == other.Seq && e.Type == other.Type && e.At.Equal(other.At) && e.Actor == other.Actor &&
+		e.Reason == other.Reason && e.Until.Equal(other.Until)
+}
+
+// last is the latest event of the log, the zero event when it's empty.
+func (b BanHistory) last() BanEvent {
+	if len(b.events) == 0 {
+		return BanEvent{}
+	}
+	return b.events[len(b.events)-1]
+}
+
+// follows tells whether b was read when last was the latest stored event.
+// A log read before an event was stored, or which appends its own event in
+// place of it, doesn't.
+func (b BanHistory) follows(last BanEvent) bool {
+	if last.Seq == 0 {
+		return true
+	}
+	return len(b.events) >= last.Seq && b.events[last.Seq-1].same(last)
+}
+
+// appendedTo returns old followed by the events of b which old doesn't have
+// yet. Repositories use it so that an update can't rewrite the log, an
+// update from a stale read of the user fails with ErrUserChanged.
+func (b BanHistory) appendedTo(old BanHistory) (BanHistory, error) {
+	if !b.follows(old.last()) {
+		return old, ErrUserChanged
+	}
+	merged := old.Events()
+	return BanHistory{events: append(merged, b.events[len(old.events):]...)}, nil
+}
+
+// History is a ban together with the event which ended it, if any.
+type History struct {
+	WhoBanned  string
+	WhenBanned time.Time
+	Why        string
+	Until      time.Time
+
+	Unbanned     BanEventType
+	WhoUnbanned  string
+	WhenUnbanned time.Time
+	UnbanReason  string
+}
+
+// Bans pairs every ban of the log with the event which lifted it, oldest
+// first.
+func (b BanHistory) Bans() []History {
+	bans := []History{}
+	for _, e := range b.events {
+		switch {
+		case e.Type == BanEventBan:
+			bans = append(bans, History{WhoBanned: e.Actor, WhenBanned: e.At, Why: e.Reason, Until: e.Until})
+		case e.Type.endsBan() && len(bans) > 0 && bans[len(bans)-1].Unbanned == "":
+			h := &bans[len(bans)-1]
+			h.Unbanned, h.WhoUnbanned, h.WhenUnbanned, h.UnbanReason = e.Type, e.Actor, e.At, e.Reason
+		}
+	}
+	return bans
+}
+
+// active returns the ban which is in force, nil if there is none.
+func (b BanHistory) active() *History {
+	bans := b.Bans()
+	if len(bans) == 0 || bans[len(bans)-1].Unbanned != "" {
+		return nil
+	}
+	return &bans[len(bans)-1]
+}
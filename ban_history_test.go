@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestBanHistory(t *testing.T) {
+	t.Run("bans pair with what ended them", func(t *testing.T) {
+		b := BanHistory{}
+		b.Append(BanEvent{Type: BanEventBan, Actor: "admin@mail.com", Reason: "spam"})
+		b.Append(BanEvent{Type: BanEventAppealRejected, Actor: "admin@mail.com", Reason: "no"})
+		b.Append(BanEvent{Type: BanEventAppealAccepted, Actor: "boss@mail.com", Reason: "fine"})
+		b.Append(BanEvent{Type: BanEventBan, Actor: "admin@mail.com", Reason: "spam again"})
+		bans := b.Bans()
+		if len(bans) != 2 {
+			t.Fatalf("Unexpected bans: %+v", bans)
+		}
+		if bans[0].Unbanned != BanEventAppealAccepted || bans[0].WhoUnbanned != "boss@mail.com" || bans[0].UnbanReason != "fine" {
+			t.Errorf("Unexpected first ban: %+v", bans[0])
+		}
+		if active := b.active(); active == nil || active.Why != "spam again" {
+			t.Errorf("Unexpected active ban: %+v", active)
+		}
+		for i, e := range b.Events() {
+			if e.Seq != i+1 {
+				t.Errorf("Unexpected numbering: %+v", b.Events())
+			}
+		}
+	})
+
+	t.Run("copies don't share appends", func(t *testing.T) {
+		b := BanHistory{}
+		b.Append(BanEvent{Type: BanEventBan})
+		copy1, copy2 := b, b
+		copy1.Append(BanEvent{Type: BanEventUnban})
+		copy2.Append(BanEvent{Type: BanEventExpired})
+		if copy1.Events()[1].Type != BanEventUnban || b.Len() != 1 {
+			t.Errorf("Appending to a copy changed another one")
+		}
+	})
+
+	t.Run("updates can't rewrite the log", func(t *testing.T) {
+		u := newTestUserService()
+		history := NewBanHistory()
+		history.Append(BanEvent{Type: BanEventBan, Reason: "spam"})
+		u.repository.Add("test@mail.com", User{Email: "test@mail.com", Banned: true, BanHistory: *history})
+		if err := u.repository.Update("test@mail.com", User{Email: "test@mail.com", Banned: true}); err != ErrUserChanged {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		user, _ := u.repository.Get("test@mail.com")
+		if user.BanHistory.Len() != 1 {
+			t.Errorf("ban log has been dropped: %+v", user.BanHistory.Events())
+		}
+	})
+
+	t.Run("updates from the same read conflict", func(t *testing.T) {
+		repositories := map[string]UserRepository{
+			"in-memory": newTestUserService().repository,
+			"sqlite":    newTestSQLiteStorage(t),
+		}
+		for name, us := range repositories {
+			history := NewBanHistory()
+			history.Append(BanEvent{Type: BanEventBan, At: time.Now(), Actor: "admin@mail.com", Reason: "spam"})
+			us.Add("race@mail.com", User{Email: "race@mail.com", Banned: true, BanHistory: *history})
+			read, _ := us.Get("race@mail.com")
+
+			unban := read
+			unban.Banned = false
+			unban.BanHistory.Append(BanEvent{Type: BanEventUnban, At: time.Now(), Actor: "admin@mail.com"})
+			if err := us.Update(read.Email, unban); err != nil {
+				t.Fatalf("%s: unexpected error: %v", name, err)
+			}
+			rejected := read
+			rejected.BanHistory.Append(BanEvent{Type: BanEventAppealRejected, At: time.Now(), Actor: "boss@mail.com"})
+			if err := us.Update(read.Email, rejected); err != ErrUserChanged {
+				t.Errorf("%s: an event appended to a stale read should conflict: %v", name, err)
+			}
+			promote := read
+			promote.Role = RoleAdmin
+			if err := us.Update(read.Email, promote); err != ErrUserChanged {
+				t.Errorf("%s: a stale read should not ban the user again: %v", name, err)
+			}
+			if err := us.Rename(read.Email, User{Email: "renamed@mail.com", Banned: true, BanHistory: read.BanHistory}); err != ErrUserChanged {
+				t.Errorf("%s: a stale read should not be renamed: %v", name, err)
+			}
+			user, _ := us.Get("race@mail.com")
+			events := user.BanHistory.Events()
+			if user.Banned || user.Role != "" || len(events) != 2 || events[1].Type != BanEventUnban {
+				t.Errorf("%s: unexpected user: %+v", name, user)
+			}
+		}
+	})
+
+	t.Run("sqlite migration", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.db")
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`
+			CREATE TABLE users (email TEXT PRIMARY KEY, password_digest TEXT NOT NULL, favorite_cake TEXT NOT NULL,
+				role TEXT NOT NULL DEFAULT '', banned INTEGER NOT NULL DEFAULT 0);
+			CREATE TABLE ban_history (id INTEGER PRIMARY KEY AUTOINCREMENT, user_email TEXT NOT NULL,
+				who_banned TEXT NOT NULL, when_banned DATETIME NOT NULL, why TEXT NOT NULL,
+				who_unbanned TEXT NOT NULL DEFAULT '');
+			INSERT INTO users VALUES ('test@mail.com', 'digest', 'cake', '', 1);
+			INSERT INTO ban_history (user_email, who_banned, when_banned, why, who_unbanned)
+				VALUES ('test@mail.com', 'admin@mail.com', '2020-01-01 10:00:00', 'spam', 'admin@mail.com'),
+				('test@mail.com', 'admin@mail.com', '2020-02-01 10:00:00', 'spam again', '');`)
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := NewSQLiteUserStorage(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer s.Close()
+		user, err := s.Get("test@mail.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		events := user.BanHistory.Events()
+		if len(events) != 3 || events[0].Type != BanEventBan || events[1].Type != BanEventUnban || events[2].Reason != "spam again" {
+			t.Errorf("Unexpected migrated events: %+v", events)
+		}
+	})
+}
+
+func TestBanEventsEndpoint(t *testing.T) {
+	doRequest := createRequester(t)
+	u := newTestUserService()
+	admin := User{"admin@mail.com", "", "cake", RoleAdmin, false, BanHistory{}, "", ""}
+	u.repository.Add(admin.Email, admin)
+	u.repository.Add("boss@mail.com", User{"boss@mail.com", "", "cake", RoleSuperadmin, false, BanHistory{}, "", ""})
+	history := NewBanHistory()
+	for i := 0; i < 3; i++ {
+		history.Append(BanEvent{Type: BanEventBan, At: time.Now(), Actor: admin.Email, Reason: "spam"})
+		history.Append(BanEvent{Type: BanEventUnban, At: time.Now(), Actor: admin.Email, Reason: "sorry"})
+	}
+	history.Append(BanEvent{Type: BanEventBan, At: time.Now(), Actor: admin.Email, Reason: "spam"})
+	u.repository.Add("test@mail.com", User{"test@mail.com", "", "cake", RoleUser, true, *history, "", ""})
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/users/{email}/bans", j.jwtAuthorize(u.repository, banEventsHandler, PermUsersInspect))
+	r.HandleFunc("/admin/users/{email}/bans/appeal", j.jwtAuthorize(u.repository, appealHandler, PermUsersUnban))
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	token, _ := j.GenearateJWT(admin)
+	get := func(query string) parsedResponse {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/admin/users/test@mail.com/bans"+query, nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		return doRequest(req, nil)
+	}
+
+	t.Run("pages", func(t *testing.T) {
+		seen := []int{}
+		query := "?limit=3"
+		for pages := 0; pages < 5; pages++ {
+			resp := get(query)
+			assertStatus(t, 200, resp)
+			page := BanEventsPage{}
+			json.Unmarshal(resp.body, &page)
+			for _, e := range page.Events {
+				seen = append(seen, e.Seq)
+			}
+			if page.Next == "" {
+				break
+			}
+			query = "?limit=3&after=" + page.Next
+		}
+		if len(seen) != 7 {
+			t.Fatalf("Unexpected events: %v", seen)
+		}
+		for i, seq := range seen {
+			if seq != i+1 {
+				t.Errorf("Unexpected order: %v", seen)
+			}
+		}
+	})
+
+	t.Run("bad limit", func(t *testing.T) {
+		assertError(t, 422, "validation_failed", "limit must be between 1 and 100", get("?limit=0"))
+	})
+
+	t.Run("admin events are superadmin only", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/admin/users/boss@mail.com/bans", nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		assertError(t, 403, "permission_denied", "Only superadmin can inspect admin!", doRequest(req, nil))
+	})
+
+	t.Run("appeal", func(t *testing.T) {
+		appeal := func(accepted bool) parsedResponse {
+			params := map[string]interface{}{"accepted": accepted, "reason": "first time"}
+			req, _ := http.NewRequest(http.MethodPost, ts.URL+"/admin/users/test@mail.com/bans/appeal", prepareParams(t, params))
+			req.Header.Add("Authorization", "Bearer "+token)
+			return doRequest(req, nil)
+		}
+		assertStatus(t, 201, appeal(false))
+		if user, _ := u.repository.Get("test@mail.com"); !user.Banned {
+			t.Errorf("a rejected appeal should keep the ban")
+		}
+		assertStatus(t, 201, appeal(true))
+		user, _ := u.repository.Get("test@mail.com")
+		events := user.BanHistory.Events()
+		if user.Banned || events[len(events)-2].Type != BanEventAppealRejected || events[len(events)-1].Type != BanEventAppealAccepted {
+			t.Errorf("Unexpected events: %+v", events)
+		}
+		assertError(t, 409, "user_not_banned", "This user is not banned!", appeal(true))
+	})
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written as "15m" in config files.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+type SuperadminConfig struct {
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	FavoriteCake string `json:"favorite_cake"`
+}
+
+type VerificationConfig struct {
+	// Required refuses tokens to the users whose email isn't verified.
+	Required bool     `json:"required"`
+	TTL      Duration `json:"ttl"`
+	// URL is the link of the mails, the token is appended to it.
+	URL string `json:"url"`
+}
+
+type PasswordResetConfig struct {
+	TTL Duration `json:"ttl"`
+	// URL is the link of the mails, the token is appended to it.
+	URL string `json:"url"`
+}
+
+type TwoFactorConfig struct {
+	Issuer string `json:"issuer"`
+	// RequiredForStaff keeps admins out of the admin routes until they
+	// enable two-factor authentication.
+	RequiredForStaff bool     `json:"required_for_staff"`
+	ChallengeTTL     Duration `json:"challenge_ttl"`
+}
+
+type KeyRotationConfig struct {
+	// Dir keeps the rotated keys, the configured pair stays the first key.
+	Dir string `json:"dir"`
+	// Interval is how often a new key is made, zero never rotates.
+	Interval Duration `json:"interval"`
+	// Overlap is how long a replaced key still verifies tokens. It must
+	// outlive every token signed with it.
+	Overlap Duration `json:"overlap"`
+}
+
+type OIDCConfig struct {
+	// Issuer is the public URL of the server, as the apps reach it.
+	Issuer string `json:"issuer"`
+	// LoginURL is the page signed out users are sent to by the
+	// authorization endpoint, with the URL to come back to in return_to.
+	LoginURL string   `json:"login_url"`
+	CodeTTL  Duration `json:"code_ttl"`
+}
+
+type AuditConfig struct {
+	// Key keys the hashes of the audit log entries.
+	Key string `json:"key"`
+	// HeadPath is the file keeping the last entry of the audit log, apart
+	// from the database.
+	HeadPath string `json:"head_path"`
+}
+
+type Config struct {
+	// Dev allows to start with the insecure defaults below.
+	Dev bool `json:"dev"`
+
+	ListenAddr      string   `json:"listen_addr"`
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	PrivateKeyPath string `json:"private_key_path"`
+	PublicKeyPath  string `json:"public_key_path"`
+
+	KeyRotation KeyRotationConfig `json:"key_rotation"`
+
+	// Storage is either "sqlite" or "memory".
+	Storage      string `json:"storage"`
+	DatabasePath string `json:"database_path"`
+	RolesPath    string `json:"roles_path"`
+
+	Audit AuditConfig `json:"audit"`
+
+	AccessTokenTTL  Duration `json:"access_token_ttl"`
+	RefreshTokenTTL Duration `json:"refresh_token_ttl"`
+	// ImpersonationTTL is the lifetime of the impersonation tokens.
+	ImpersonationTTL Duration `json:"impersonation_ttl"`
+
+	Superadmin SuperadminConfig `json:"superadmin"`
+
+	// MailOutbox is the directory the mails are written to.
+	MailOutbox    string              `json:"mail_outbox"`
+	Verification  VerificationConfig  `json:"email_verification"`
+	PasswordReset PasswordResetConfig `json:"password_reset"`
+	TwoFactor     TwoFactorConfig     `json:"two_factor"`
+	OIDC          OIDCConfig          `json:"oidc"`
+
+	// RateLimits are the policies of NewRateLimiter, by route.
+	RateLimits map[string]RateLimitPolicy `json:"rate_limits"`
+
+	// BanExpiryInterval is how often expired temporary bans are lifted.
+	BanExpiryInterval Duration `json:"ban_expiry_interval"`
+
+	// TrustProxy takes the client IP from the X-Forwarded-For header set by
+	// the proxy in front of the server.
+	TrustProxy bool `json:"trust_proxy"`
+
+	LogMaxBodySize int `json:"log_max_body_size"`
+}
+
+const (
+	StorageSQLite = "sqlite"
+	StorageMemory = "memory"
+)
+
+// The key pair shipped with the repository.
+const (
+	bundledPrivateKey = "privkey.rsa"
+	bundledPublicKey  = "pubkey.rsa"
+)
+
+func defaultConfig() Config {
+	return Config{
+		ListenAddr:      ":8080",
+		ShutdownTimeout: Duration{5 * time.Second},
+		PrivateKeyPath:  bundledPrivateKey,
+		PublicKeyPath:   bundledPublicKey,
+		KeyRotation: KeyRotationConfig{
+			Dir:      "keys",
+			Interval: Duration{defaultKeyRotationInterval},
+			Overlap:  Duration{defaultKeyOverlap},
+		},
+		Storage:          StorageSQLite,
+		DatabasePath:     "users.db",
+		RolesPath:        "roles.json",
+		Audit:            AuditConfig{HeadPath: "audit.head"},
+		AccessTokenTTL:   Duration{defaultAccessTTL},
+		RefreshTokenTTL:  Duration{defaultRefreshTTL},
+		ImpersonationTTL: Duration{defaultImpersonationTTL},
+		Superadmin: SuperadminConfig{
+			Email:        "admin@gmail.com",
+			Password:     "pass",
+			FavoriteCake: "cake",
+		},
+		MailOutbox: "outbox",
+		Verification: VerificationConfig{
+			TTL: Duration{defaultVerificationTTL},
+			URL: defaultVerificationURL,
+		},
+		PasswordReset: PasswordResetConfig{
+			TTL: Duration{defaultPasswordResetTTL},
+			URL: defaultPasswordResetURL,
+		},
+		TwoFactor: TwoFactorConfig{
+			Issuer:       defaultTwoFactorPolicy().Issuer,
+			ChallengeTTL: Duration{defaultTwoFactorPolicy().ChallengeTTL},
+		},
+		OIDC: OIDCConfig{
+			Issuer:  defaultOIDCIssuer,
+			CodeTTL: Duration{defaultAuthorizationCodeTTL},
+		},
+		RateLimits:        defaultRateLimits(),
+		BanExpiryInterval: Duration{time.Minute},
+		LogMaxBodySize:    defaultLogPolicy().MaxBodySize,
+	}
+}
+
+// LoadConfig builds the configuration from, in increasing priority, the
+// defaults, the JSON file given by -config or CAKE_CONFIG, environment
+// variables and command line flags.
+func LoadConfig(args []string, getenv func(string) string) (*Config, error) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("cake", flag.ContinueOnError)
+	configPath := fs.String("config", getenv("CAKE_CONFIG"), "path to a JSON config file")
+	flagValues := Config{}
+	fs.BoolVar(&flagValues.Dev, "dev", false, "allow insecure defaults")
+	fs.StringVar(&flagValues.ListenAddr, "listen", "", "address to listen on")
+	fs.DurationVar(&flagValues.ShutdownTimeout.Duration, "shutdown-timeout", 0, "graceful shutdown timeout")
+	fs.StringVar(&flagValues.PrivateKeyPath, "private-key", "", "path to the RSA private key")
+	fs.StringVar(&flagValues.PublicKeyPath, "public-key", "", "path to the RSA public key")
+	fs.StringVar(&flagValues.KeyRotation.Dir, "keys-dir", "", "directory of the rotated signing keys")
+	fs.DurationVar(&flagValues.KeyRotation.Interval.Duration, "key-rotation", 0, "how often the signing key is rotated, 0 never")
+	fs.StringVar(&flagValues.Storage, "storage", "", "storage backend: sqlite or memory")
+	fs.StringVar(&flagValues.DatabasePath, "database", "", "path to the sqlite database")
+	fs.StringVar(&flagValues.RolesPath, "roles", "", "path to the roles file")
+	fs.DurationVar(&flagValues.AccessTokenTTL.Duration, "access-token-ttl", 0, "access token lifetime")
+	fs.DurationVar(&flagValues.RefreshTokenTTL.Duration, "refresh-token-ttl", 0, "refresh token lifetime")
+	fs.StringVar(&flagValues.Superadmin.Email, "admin-email", "", "superadmin email")
+	fs.StringVar(&flagValues.Superadmin.FavoriteCake, "admin-cake", "", "superadmin favorite cake")
+	fs.StringVar(&flagValues.MailOutbox, "mail-outbox", "", "directory the mails are written to")
+	fs.BoolVar(&flagValues.Verification.Required, "require-verified-email", false, "refuse tokens to unverified users")
+	fs.BoolVar(&flagValues.TwoFactor.RequiredForStaff, "require-staff-2fa", false, "keep admins without two-factor authentication out")
+	fs.StringVar(&flagValues.OIDC.Issuer, "oidc-issuer", "", "public URL of the server, the OpenID Connect issuer")
+	fs.DurationVar(&flagValues.BanExpiryInterval.Duration, "ban-expiry-interval", 0, "how often expired bans are lifted")
+	fs.BoolVar(&flagValues.TrustProxy, "trust-proxy", false, "take the client IP from the proxy's X-Forwarded-For entry")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configPath != "" {
+		data, err := ioutil.ReadFile(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", *configPath, err)
+		}
+	}
+	if err := cfg.applyEnv(getenv); err != nil {
+		return nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dev":
+			cfg.Dev = flagValues.Dev
+		case "listen":
+			cfg.ListenAddr = flagValues.ListenAddr
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = flagValues.ShutdownTimeout
+		case "private-key":
+			cfg.PrivateKeyPath = flagValues.PrivateKeyPath
+		case "public-key":
+			cfg.PublicKeyPath = flagValues.PublicKeyPath
+		case "keys-dir":
+			cfg.KeyRotation.Dir = flagValues.KeyRotation.Dir
+		case "key-rotation":
+			cfg.KeyRotation.Interval = flagValues.KeyRotation.Interval
+		case "storage":
+			cfg.Storage = flagValues.Storage
+		case "database":
+			cfg.DatabasePath = flagValues.DatabasePath
+		case "roles":
+			cfg.RolesPath = flagValues.RolesPath
+		case "access-token-ttl":
+			cfg.AccessTokenTTL = flagValues.AccessTokenTTL
+		case "refresh-token-ttl":
+			cfg.RefreshTokenTTL = flagValues.RefreshTokenTTL
+		case "admin-email":
+			cfg.Superadmin.Email = flagValues.Superadmin.Email
+		case "admin-cake":
+			cfg.Superadmin.FavoriteCake = flagValues.Superadmin.FavoriteCake
+		case "mail-outbox":
+			cfg.MailOutbox = flagValues.MailOutbox
+		case "require-verified-email":
+			cfg.Verification.Required = flagValues.Verification.Required
+		case "require-staff-2fa":
+			cfg.TwoFactor.RequiredForStaff = flagValues.TwoFactor.RequiredForStaff
+		case "oidc-issuer":
+			cfg.OIDC.Issuer = flagValues.OIDC.Issuer
+		case "ban-expiry-interval":
+			cfg.BanExpiryInterval = flagValues.BanExpiryInterval
+		case "trust-proxy":
+			cfg.TrustProxy = flagValues.TrustProxy
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// applyEnv overrides the settings whose CAKE_* variable is set. The
+// superadmin password can only come from here or the config file, so it
+// doesn't show up in the process list.
+func (c *Config) applyEnv(getenv func(string) string) error {
+	texts := map[string]*string{
+		"CAKE_LISTEN_ADDR":    &c.ListenAddr,
+		"CAKE_PRIVATE_KEY":    &c.PrivateKeyPath,
+		"CAKE_PUBLIC_KEY":     &c.PublicKeyPath,
+		"CAKE_KEYS_DIR":       &c.KeyRotation.Dir,
+		"CAKE_STORAGE":        &c.Storage,
+		"CAKE_DATABASE":       &c.DatabasePath,
+		"CAKE_ROLES":          &c.RolesPath,
+		"CAKE_AUDIT_KEY":      &c.Audit.Key,
+		"CAKE_AUDIT_HEAD":     &c.Audit.HeadPath,
+		"CAKE_ADMIN_EMAIL":    &c.Superadmin.Email,
+		"CAKE_ADMIN_PASSWORD": &c.Superadmin.Password,
+		"CAKE_ADMIN_CAKE":     &c.Superadmin.FavoriteCake,
+		"CAKE_MAIL_OUTBOX":    &c.MailOutbox,
+		"CAKE_VERIFY_URL":     &c.Verification.URL,
+		"CAKE_RESET_URL":      &c.PasswordReset.URL,
+		"CAKE_2FA_ISSUER":     &c.TwoFactor.Issuer,
+		"CAKE_OIDC_ISSUER":    &c.OIDC.Issuer,
+		"CAKE_OIDC_LOGIN_URL": &c.OIDC.LoginURL,
+	}
+	for name, field := range texts {
+		if v := getenv(name); v != "" {
+			*field = v
+		}
+	}
+	durations := map[string]*Duration{
+		"CAKE_SHUTDOWN_TIMEOUT":  &c.ShutdownTimeout,
+		"CAKE_ACCESS_TOKEN_TTL":  &c.AccessTokenTTL,
+		"CAKE_REFRESH_TOKEN_TTL": &c.RefreshTokenTTL,
+		"CAKE_IMPERSONATION_TTL": &c.ImpersonationTTL,
+		"CAKE_BAN_EXPIRY":        &c.BanExpiryInterval,
+		"CAKE_VERIFY_TTL":        &c.Verification.TTL,
+		"CAKE_RESET_TTL":         &c.PasswordReset.TTL,
+		"CAKE_2FA_CHALLENGE_TTL": &c.TwoFactor.ChallengeTTL,
+		"CAKE_KEY_ROTATION":      &c.KeyRotation.Interval,
+		"CAKE_KEY_OVERLAP":       &c.KeyRotation.Overlap,
+		"CAKE_OIDC_CODE_TTL":     &c.OIDC.CodeTTL,
+	}
+	for name, field := range durations {
+		if v := getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			field.Duration = d
+		}
+	}
+	bools := map[string]*bool{
+		"CAKE_DEV":                    &c.Dev,
+		"CAKE_REQUIRE_VERIFIED_EMAIL": &c.Verification.Required,
+		"CAKE_REQUIRE_STAFF_2FA":      &c.TwoFactor.RequiredForStaff,
+		"CAKE_TRUST_PROXY":            &c.TrustProxy,
+	}
+	for name, field := range bools {
+		if v := getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			*field = b
+		}
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	problems := []string{}
+	if c.ListenAddr == "" {
+		problems = append(problems, "listen address is empty")
+	}
+	if c.PrivateKeyPath == "" || c.PublicKeyPath == "" {
+		problems = append(problems, "key paths are empty")
+	}
+	problems = append(problems, c.KeyRotation.validate(c)...)
+	switch c.Storage {
+	case StorageSQLite:
+		if c.DatabasePath == "" {
+			problems = append(problems, "database path is empty")
+		}
+		if c.Audit.HeadPath == "" {
+			problems = append(problems, "audit head path is empty")
+		}
+	case StorageMemory:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown storage %q", c.Storage))
+	}
+	if c.AccessTokenTTL.Duration <= 0 || c.RefreshTokenTTL.Duration <= 0 {
+		problems = append(problems, "token lifetimes must be positive")
+	} else if c.RefreshTokenTTL.Duration < c.AccessTokenTTL.Duration {
+		problems = append(problems, "refresh tokens must live longer than access tokens")
+	}
+	if c.ImpersonationTTL.Duration <= 0 {
+		problems = append(problems, "impersonation token lifetime must be positive")
+	}
+	for route, p := range c.RateLimits {
+		if err := p.validate(); err != nil {
+			problems = append(problems, route+": "+err.Error())
+		}
+	}
+	if c.MailOutbox == "" {
+		problems = append(problems, "mail outbox is empty")
+	}
+	if c.Verification.TTL.Duration <= 0 {
+		problems = append(problems, "verification token lifetime must be positive")
+	}
+	if c.Verification.URL == "" {
+		problems = append(problems, "verification url is empty")
+	}
+	if c.PasswordReset.TTL.Duration <= 0 {
+		problems = append(problems, "password reset token lifetime must be positive")
+	}
+	if c.PasswordReset.URL == "" {
+		problems = append(problems, "password reset url is empty")
+	}
+	if c.TwoFactor.Issuer == "" {
+		problems = append(problems, "two-factor issuer is empty")
+	}
+	if c.TwoFactor.ChallengeTTL.Duration <= 0 {
+		problems = append(problems, "two-factor challenge lifetime must be positive")
+	}
+	if u, err := url.Parse(c.OIDC.Issuer); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.RawQuery != "" || u.Fragment != "" {
+		problems = append(problems, "oidc issuer must be an http(s) URL without query")
+	}
+	if c.OIDC.CodeTTL.Duration <= 0 {
+		problems = append(problems, "authorization code lifetime must be positive")
+	}
+	if c.BanExpiryInterval.Duration <= 0 {
+		problems = append(problems, "ban expiry interval must be positive")
+	}
+	if c.ShutdownTimeout.Duration < 0 {
+		problems = append(problems, "shutdown timeout is negative")
+	}
+	if c.Superadmin.Email != "" && !emailRegex.MatchString(c.Superadmin.Email) {
+		problems = append(problems, "superadmin email is invalid")
+	}
+	if !c.Dev {
+		problems = append(problems, c.insecureSettings()...)
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (k KeyRotationConfig) validate(c *Config) []string {
+	if k.Interval.Duration < 0 {
+		return []string{"key rotation interval is negative"}
+	}
+	if k.Interval.Duration == 0 {
+		return nil
+	}
+	problems := []string{}
+	if k.Dir == "" {
+		problems = append(problems, "keys directory is empty")
+	}
+	if k.Interval.Duration <= keyPublishLead {
+		problems = append(problems, "key rotation interval is shorter than the key publication lead")
+	}
+	// every signed token has to verify until it expires
+	for _, ttl := range []time.Duration{c.AccessTokenTTL.Duration, c.Verification.TTL.Duration,
+		c.TwoFactor.ChallengeTTL.Duration, c.ImpersonationTTL.Duration} {
+		if k.Overlap.Duration < ttl {
+			problems = append(problems, "key overlap is shorter than the lifetime of the tokens")
+			break
+		}
+	}
+	return problems
+}
+
+// insecureSettings lists what is fine on a laptop but not in production.
+func (c *Config) insecureSettings() []string {
+	insecure := []string{}
+	if c.Superadmin.Email != "" && len(c.Superadmin.Password) < 12 {
+		insecure = append(insecure, "superadmin password is shorter than 12 characters")
+	}
+	if c.PrivateKeyPath == bundledPrivateKey || c.PublicKeyPath == bundledPublicKey {
+		insecure = append(insecure, "the key pair from the repository is used")
+	}
+	if c.Storage == StorageMemory {
+		insecure = append(insecure, "memory storage loses every user on restart")
+	}
+	if c.Audit.Key == "" {
+		insecure = append(insecure, "audit key is empty")
+	}
+	for i := range insecure {
+		insecure[i] += " (set dev mode to allow)"
+	}
+	return insecure
+}
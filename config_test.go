@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func envFrom(vars map[string]string) func(string) string {
+	return func(name string) string {
+		return vars[name]
+	}
+}
+
+func TestConfig(t *testing.T) {
+	t.Run("insecure defaults are refused", func(t *testing.T) {
+		_, err := LoadConfig(nil, envFrom(nil))
+		if err == nil {
+			t.Fatal("expected the defaults to be refused")
+		}
+		for _, problem := range []string{"superadmin password", "key pair", "audit key"} {
+			if !strings.Contains(err.Error(), problem) {
+				t.Errorf("%q doesn't mention %q", err, problem)
+			}
+		}
+	})
+
+	t.Run("dev mode allows defaults", func(t *testing.T) {
+		cfg, err := LoadConfig([]string{"-dev"}, envFrom(nil))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.ListenAddr != ":8080" || cfg.ShutdownTimeout.Duration != 5*time.Second {
+			t.Errorf("Unexpected defaults: %+v", cfg)
+		}
+	})
+
+	t.Run("file, env and flags precedence", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		ioutil.WriteFile(path, []byte(`{
+			"dev": true,
+			"listen_addr": ":9000",
+			"storage": "memory",
+			"database_path": "file.db",
+			"access_token_ttl": "5m"
+		}`), 0600)
+		cfg, err := LoadConfig([]string{"-listen", ":9200"}, envFrom(map[string]string{
+			"CAKE_CONFIG":      path,
+			"CAKE_LISTEN_ADDR": ":9100",
+			"CAKE_DATABASE":    "env.db",
+		}))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.ListenAddr != ":9200" {
+			t.Errorf("flags should win, got %s", cfg.ListenAddr)
+		}
+		if cfg.DatabasePath != "env.db" {
+			t.Errorf("env should override the file, got %s", cfg.DatabasePath)
+		}
+		if cfg.Storage != StorageMemory || cfg.AccessTokenTTL.Duration != 5*time.Minute {
+			t.Errorf("file values should override the defaults: %+v", cfg)
+		}
+	})
+
+	t.Run("secure config", func(t *testing.T) {
+		_, err := LoadConfig([]string{"-private-key", "keys/private.pem", "-public-key", "keys/public.pem"},
+			envFrom(map[string]string{"CAKE_ADMIN_PASSWORD": "a long enough password", "CAKE_AUDIT_KEY": "an audit key"}))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		cases := map[string][]string{
+			"unknown storage":   {"-dev", "-storage", "redis"},
+			"refresh tokens":    {"-dev", "-access-token-ttl", "1h", "-refresh-token-ttl", "1m"},
+			"must be positive":  {"-dev", "-access-token-ttl", "0s"},
+			"email is invalid":  {"-dev", "-admin-email", "admin"},
+			"outbox is empty":   {"-dev", "-mail-outbox", ""},
+			"key overlap":       {"-dev", "-access-token-ttl", "72h", "-refresh-token-ttl", "720h"},
+			"keys directory":    {"-dev", "-keys-dir", ""},
+			"publication lead":  {"-dev", "-key-rotation", "5m"},
+			"oidc issuer":       {"-dev", "-oidc-issuer", "localhost:8080"},
+			"flag provided but": {"-unknown"},
+		}
+		for problem, args := range cases {
+			_, err := LoadConfig(args, envFrom(nil))
+			if err == nil || !strings.Contains(err.Error(), problem) {
+				t.Errorf("%v: expected an error about %q, got %v", args, problem, err)
+			}
+		}
+	})
+
+	t.Run("trust proxy", func(t *testing.T) {
+		cfg, err := LoadConfig([]string{"-dev"}, envFrom(map[string]string{"CAKE_TRUST_PROXY": "true"}))
+		if err != nil || !cfg.TrustProxy {
+			t.Errorf("CAKE_TRUST_PROXY should trust the proxy: %v", err)
+		}
+		cfg, err = LoadConfig([]string{"-dev", "-trust-proxy=false"}, envFrom(map[string]string{"CAKE_TRUST_PROXY": "true"}))
+		if err != nil || cfg.TrustProxy {
+			t.Errorf("-trust-proxy should win over the env: %v", err)
+		}
+	})
+
+	t.Run("bad env duration", func(t *testing.T) {
+		_, err := LoadConfig([]string{"-dev"}, envFrom(map[string]string{"CAKE_ACCESS_TOKEN_TTL": "soon"}))
+		if err == nil || !strings.Contains(err.Error(), "CAKE_ACCESS_TOKEN_TTL") {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
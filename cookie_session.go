@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// In the cookie session mode, asked with "session": "cookie" on login, the
+// tokens are set in HttpOnly cookies instead of the body, out of reach of
+// scripts. Requests authenticated by the cookie must then repeat the
+// readable CSRF cookie in the X-CSRF-Token header on unsafe methods, which
+// another site can't do.
+const (
+	sessionModeCookie = "cookie"
+
+	sessionCookie = "cake_session"
+	refreshCookie = "cake_refresh"
+	csrfCookie    = "cake_csrf"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+var errInvalidCSRFToken = newForbiddenError("invalid_csrf_token", "Missing or invalid CSRF token")
+
+type CookieSession struct {
+	TokenType string `json:"token_type"`
+	ExpiresIn int64  `json:"expires_in"`
+	// CSRFToken is the value of the CSRF cookie, for clients which can't
+	// read it.
+	CSRFToken string `json:"csrf_token"`
+}
+
+func sessionCookieOf(name, value, path string, ttl time.Duration, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   int(ttl / time.Second),
+		HttpOnly: httpOnly,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// writeSessionCookies sets the tokens in cookies along with a new CSRF
+// token. The refresh token is only sent to the refresh route. The session
+// cookie is Lax so that apps of other sites can send their users to
+// /oauth/authorize, unsafe methods still need the CSRF token.
+func writeSessionCookies(w http.ResponseWriter, j *JWTService, tokens TokenPair) {
+	csrf, err := randomToken(32)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	session := sessionCookieOf(sessionCookie, tokens.AccessToken, "/", j.AccessTTL, true)
+	session.SameSite = http.SameSiteLaxMode
+	http.SetCookie(w, session)
+	http.SetCookie(w, sessionCookieOf(refreshCookie, tokens.RefreshToken, "/user/jwt/refresh", j.RefreshTTL, true))
+	http.SetCookie(w, sessionCookieOf(csrfCookie, csrf, "/", j.RefreshTTL, false))
+	writeJSON(w, http.StatusOK, CookieSession{
+		TokenType: "Cookie",
+		ExpiresIn: tokens.ExpiresIn,
+		CSRFToken: csrf,
+	})
+}
+
+// clearSessionCookies makes the browser forget the cookies of the session.
+func clearSessionCookies(w http.ResponseWriter) {
+	http.SetCookie(w, sessionCookieOf(sessionCookie, "", "/", -time.Second, true))
+	http.SetCookie(w, sessionCookieOf(refreshCookie, "", "/user/jwt/refresh", -time.Second, true))
+	http.SetCookie(w, sessionCookieOf(csrfCookie, "", "/", -time.Second, false))
+}
+
+// bearerToken returns the token of the Authorization header, or else the
+// one of the session cookie, and whether it came from the cookie.
+func bearerToken(r *http.Request) (string, bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		return strings.TrimPrefix(header, "Bearer "), false
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		return c.Value, true
+	}
+	return "", false
+}
+
+// checkCSRF is the double-submit check of the requests authenticated by a
+// cookie.
+func checkCSRF(r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return errInvalidCSRFToken
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.Header.Get(csrfHeader))) != 1 {
+		return errInvalidCSRFToken
+	}
+	return nil
+}
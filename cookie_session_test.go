@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCookieSession(t *testing.T) {
+	doRequest := createRequester(t)
+	useLockoutPolicy(t, defaultLockoutPolicy())
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	u := newTestUserService()
+	digest, _ := hashPassword("somepass")
+	u.repository.Add("test@mail.com", User{"test@mail.com", digest, "cake", RoleUser, false, BanHistory{}, "", ""})
+	me := httptest.NewServer(j.jwtAuthorize(u.repository, getMyData))
+	defer me.Close()
+	cake := httptest.NewServer(j.jwtAuthorize(u.repository, changeCakeHandler))
+	defer cake.Close()
+
+	login := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/user/jwt", prepareParams(t, map[string]interface{}{
+		"email": "test@mail.com", "password": "somepass", "session": "cookie"}))
+	wrapJwt(j, u.JWT)(login, req)
+	assertStatus(t, 200, parsedResponse{login.Code, login.Body.Bytes()})
+	session := CookieSession{}
+	json.Unmarshal(login.Body.Bytes(), &session)
+	if session.TokenType != "Cookie" || session.CSRFToken == "" || strings.Contains(login.Body.String(), "access_token") {
+		t.Fatalf("Unexpected body: %s", login.Body)
+	}
+	cookies := map[string]*http.Cookie{}
+	for _, c := range login.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	for _, name := range []string{sessionCookie, refreshCookie, csrfCookie} {
+		c := cookies[name]
+		sameSite := http.SameSiteStrictMode
+		if name == sessionCookie {
+			sameSite = http.SameSiteLaxMode
+		}
+		if c == nil || !c.Secure || c.SameSite != sameSite || c.HttpOnly != (name != csrfCookie) {
+			t.Fatalf("Unexpected cookie %s: %+v", name, c)
+		}
+	}
+	if cookies[refreshCookie].Path != "/user/jwt/refresh" || cookies[csrfCookie].Value != session.CSRFToken {
+		t.Fatalf("Unexpected cookies: %+v", cookies)
+	}
+
+	send := func(method, url, csrf string) parsedResponse {
+		req, _ := http.NewRequest(method, url, prepareParams(t, map[string]interface{}{
+			"email": "test@mail.com", "favorite_cake": "pie"}))
+		req.AddCookie(cookies[sessionCookie])
+		req.AddCookie(cookies[csrfCookie])
+		if csrf != "" {
+			req.Header.Set(csrfHeader, csrf)
+		}
+		return doRequest(req, nil)
+	}
+
+	t.Run("safe methods don't need the CSRF token", func(t *testing.T) {
+		assertStatus(t, 200, send(http.MethodGet, me.URL, ""))
+	})
+
+	t.Run("unsafe methods need the CSRF token", func(t *testing.T) {
+		assertError(t, 403, "invalid_csrf_token", "Missing or invalid CSRF token", send(http.MethodPut, cake.URL, ""))
+		assertError(t, 403, "invalid_csrf_token", "Missing or invalid CSRF token", send(http.MethodPut, cake.URL, "forged"))
+		assertStatus(t, 201, send(http.MethodPut, cake.URL, session.CSRFToken))
+	})
+
+	t.Run("bearer tokens don't need the CSRF token", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPut, cake.URL, prepareParams(t, map[string]interface{}{
+			"email": "test@mail.com", "favorite_cake": "tart"}))
+		req.Header.Add("Authorization", "Bearer "+cookies[sessionCookie].Value)
+		assertStatus(t, 201, doRequest(req, nil))
+	})
+
+	t.Run("refresh from the cookie", func(t *testing.T) {
+		refresh := func(csrf string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/user/jwt/refresh", nil)
+			req.AddCookie(cookies[refreshCookie])
+			req.AddCookie(cookies[csrfCookie])
+			req.Header.Set(csrfHeader, csrf)
+			wrapJwt(j, u.Refresh)(rec, req)
+			return rec
+		}
+		rec := refresh("")
+		assertError(t, 403, "invalid_csrf_token", "Missing or invalid CSRF token", parsedResponse{rec.Code, rec.Body.Bytes()})
+		rec = refresh(session.CSRFToken)
+		assertStatus(t, 200, parsedResponse{rec.Code, rec.Body.Bytes()})
+		renewed := 0
+		for _, c := range rec.Result().Cookies() {
+			if c.Value != cookies[c.Name].Value {
+				renewed++
+			}
+		}
+		if renewed != 3 {
+			t.Errorf("Unexpected cookies: %+v", rec.Result().Cookies())
+		}
+	})
+}
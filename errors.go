@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// APIError is the error every handler reports to clients. Code is stable and
+// meant for programs, Message is meant for humans and may change.
+type APIError struct {
+	Status  int          `json:"-"`
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type errorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func newBadRequestError(code, message string) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: code, Message: message}
+}
+
+func newUnauthorizedError(code, message string) *APIError {
+	return &APIError{Status: http.StatusUnauthorized, Code: code, Message: message}
+}
+
+func newForbiddenError(code, message string) *APIError {
+	return &APIError{Status: http.StatusForbidden, Code: code, Message: message}
+}
+
+func newNotFoundError(code, message string) *APIError {
+	return &APIError{Status: http.StatusNotFound, Code: code, Message: message}
+}
+
+func newConflictError(code, message string) *APIError {
+	return &APIError{Status: http.StatusConflict, Code: code, Message: message}
+}
+
+func newValidationError(field, message string) *APIError {
+	return &APIError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    "validation_failed",
+		Message: message,
+		Fields:  []FieldError{{Field: field, Message: message}},
+	}
+}
+
+var (
+	ErrInvalidParams   = newBadRequestError("invalid_params", "could not read params")
+	ErrUserNotFound    = newNotFoundError("user_not_found", "This user doesn't exist")
+	ErrUserExists      = newConflictError("user_already_exists", "This user is already registered")
+	ErrUserChanged     = newConflictError("user_changed", "This user has been changed meanwhile, try again")
+	ErrUnauthorized    = newUnauthorizedError("unauthorized", "unauthorized")
+	ErrPermission      = newForbiddenError("permission_denied", "You don't have permission to access this page")
+	ErrNotAccountOwner = newForbiddenError("not_account_owner", "Your are not logged in")
+)
+
+// handleError writes err as a JSON error response. Errors which are not an
+// APIError are internal, their text is logged but not shown to the client.
+func handleError(err error, w http.ResponseWriter) {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		log.Println("Internal error:", err)
+		apiErr = &APIError{Status: http.StatusInternalServerError, Code: "internal_error", Message: "internal error"}
+	}
+	writeJSON(w, apiErr.Status, errorResponse{Error: apiErr})
+}
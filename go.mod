@@ -1,8 +1,11 @@
 module golang-api
 
-go 1.13
+go 1.16
 
 require (
+	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/gorilla/mux v1.8.0
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/openware/rango v0.0.0-20210909144821-b2239c24555b
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 )
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Superadmins can sign in as a user to see what the user sees. The
+// impersonation token is a short-lived access token of the user, without a
+// refresh token or a session, whose sub is the user and whose act claim
+// (RFC 8693) is the superadmin. It can't be used on the routes which need
+// permissions nor on the account settings, and the requests made with it
+// are logged with the superadmin.
+const defaultImpersonationTTL = 10 * time.Minute
+
+var errImpersonationForbidden = newForbiddenError("impersonation_forbidden", "This can't be done while impersonating a user")
+
+// TokenActor is the act claim of impersonation tokens.
+type TokenActor struct {
+	Subject string `json:"sub"`
+}
+
+type impersonatorContextKey struct{}
+
+func withImpersonator(r *http.Request, email string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), impersonatorContextKey{}, email))
+}
+
+// impersonatorFrom returns the superadmin behind the impersonation token r
+// was authenticated with, "" for other requests.
+func impersonatorFrom(r *http.Request) string {
+	email, _ := r.Context().Value(impersonatorContextKey{}).(string)
+	return email
+}
+
+// generateImpersonationToken signs an access token of target acting as
+// actor.
+func (j *JWTService) generateImpersonationToken(actor, target User) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	return j.forgeToken(target, jwt.MapClaims{
+		"jti": jti,
+		"exp": time.Now().UTC().Add(j.ImpersonationTTL).Unix(),
+		"sub": target.Email,
+		"act": TokenActor{Subject: actor.Email},
+	})
+}
+
+// checkImpersonator ends the impersonations of superadmins who lost their
+// role or whose tokens were revoked since.
+func checkImpersonator(email string, issuedAt time.Time, users UserRepository) error {
+	revoked, err := isRevoked(email, "", issuedAt)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return errors.New("impersonator tokens have been revoked")
+	}
+	actor, err := users.Get(email)
+	if err != nil {
+		return err
+	}
+	if actor.Role != RoleSuperadmin || actor.Banned {
+		return errors.New("impersonator is no longer a superadmin")
+	}
+	return nil
+}
+
+type ImpersonateParams struct {
+	Email  string `json:"email"`
+	Reason string `json:"reason"`
+}
+
+type ImpersonationToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Subject     string `json:"subject"`
+	Actor       string `json:"actor"`
+}
+
+// impersonateHandler needs PermUsersImpersonate, and the superadmin role
+// whatever the roles file grants. The reason ends up in the audit log.
+func (j *JWTService) impersonateHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	if apiKeyFrom(r) != nil {
+		handleError(errAPIKeyNotAllowed, w)
+		return
+	}
+	if u.Role != RoleSuperadmin {
+		handleError(newForbiddenError("permission_denied", "Only superadmin can impersonate users!"), w)
+		return
+	}
+	params := &ImpersonateParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(ErrInvalidParams, w)
+		return
+	}
+	if strings.TrimSpace(params.Reason) == "" {
+		handleError(newValidationError("reason", "Tell why you impersonate this user"), w)
+		return
+	}
+	target, err := us.Get(params.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	if target.Email == u.Email || isStaff(target.Role) {
+		handleError(newForbiddenError("permission_denied", "Staff accounts can't be impersonated"), w)
+		return
+	}
+	token, err := j.generateImpersonationToken(u, target)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	writeJSON(w, http.StatusCreated, ImpersonationToken{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(j.ImpersonationTTL / time.Second),
+		Subject:     target.Email,
+		Actor:       u.Email,
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImpersonation(t *testing.T) {
+	doRequest := createRequester(t)
+	logs := captureAccessLog(t)
+	store := NewInMemoryAuditStore()
+	useAuditStore(t, store)
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	u := newTestUserService()
+	boss := User{"boss@mail.com", "", "cake", RoleSuperadmin, false, BanHistory{}, "", ""}
+	admin := User{"admin@mail.com", "", "cake", RoleAdmin, false, BanHistory{}, "", ""}
+	u.repository.Add(boss.Email, boss)
+	u.repository.Add(admin.Email, admin)
+	u.repository.Add("test@mail.com", User{"test@mail.com", "", "cheesecake", RoleUser, false, BanHistory{}, "", ""})
+	bossToken, _ := j.GenearateJWT(boss)
+	adminToken, _ := j.GenearateJWT(admin)
+
+	impersonate := httptest.NewServer(logRequest(audited("user.impersonate",
+		j.jwtAuthorize(u.repository, j.impersonateHandler, PermUsersImpersonate))))
+	defer impersonate.Close()
+	me := httptest.NewServer(logRequest(j.jwtAuthorize(u.repository, getMyData)))
+	defer me.Close()
+	ban := httptest.NewServer(logRequest(audited("user.ban", j.jwtAuthorize(u.repository, banHandler, PermUsersBan))))
+	defer ban.Close()
+	changePass := httptest.NewServer(j.jwtAuthorize(u.repository, sessionOnly(changePassHandler)))
+	defer changePass.Close()
+	changeEmail := httptest.NewServer(j.jwtAuthorize(u.repository, sessionOnly(changeEmailHandler)))
+	defer changeEmail.Close()
+
+	send := func(method, url, token string, params map[string]interface{}) parsedResponse {
+		req, _ := http.NewRequest(method, url, prepareParams(t, params))
+		req.Header.Add("Authorization", "Bearer "+token)
+		return doRequest(req, nil)
+	}
+	impersonateAs := func(token, email string) ImpersonationToken {
+		t.Helper()
+		resp := send(http.MethodPost, impersonate.URL, token, map[string]interface{}{
+			"email": email, "reason": "ticket 42"})
+		assertStatus(t, 201, resp)
+		imp := ImpersonationToken{}
+		json.Unmarshal(resp.body, &imp)
+		return imp
+	}
+
+	t.Run("sees what the user sees", func(t *testing.T) {
+		imp := impersonateAs(bossToken, "test@mail.com")
+		if imp.Subject != "test@mail.com" || imp.Actor != boss.Email || imp.ExpiresIn != int64(defaultImpersonationTTL.Seconds()) {
+			t.Errorf("Unexpected token: %+v", imp)
+		}
+		claims, err := j.ParseJWT(imp.AccessToken)
+		if err != nil || claims.Actor == nil || claims.Actor.Subject != boss.Email ||
+			claims.Subject != "test@mail.com" || claims.Email != "test@mail.com" || claims.Session != "" ||
+			claims.ExpiresAt-claims.IssuedAt != int64(defaultImpersonationTTL.Seconds()) {
+			t.Fatalf("Unexpected claims: %+v, %v", claims, err)
+		}
+
+		logs.Reset()
+		resp := send(http.MethodGet, me.URL, imp.AccessToken, nil)
+		assertStatus(t, 200, resp)
+		assertBody(t, `{"email":"test@mail.com","favorite_cake":"cheesecake"}`+"\n", resp)
+		entry := accessLogEntry{}
+		json.Unmarshal(logs.Bytes(), &entry)
+		if entry.User != "test@mail.com" || entry.ImpersonatedBy != boss.Email {
+			t.Errorf("Unexpected log entry: %s", logs)
+		}
+
+		logs.Reset()
+		assertStatus(t, 200, send(http.MethodGet, me.URL, bossToken, nil))
+		if strings.Contains(logs.String(), "impersonated_by") {
+			t.Errorf("Unexpected log entry: %s", logs)
+		}
+
+		entries, _ := store.Query(AuditQuery{Action: "user.impersonate"})
+		if len(entries) != 1 || entries[0].Actor != boss.Email || entries[0].Target != "test@mail.com" ||
+			!strings.Contains(string(entries[0].Params), "ticket 42") {
+			t.Errorf("Unexpected audit entries: %+v", entries)
+		}
+	})
+
+	t.Run("admin routes and account settings are blocked", func(t *testing.T) {
+		imp := impersonateAs(bossToken, "test@mail.com")
+		forbidden := func(resp parsedResponse) {
+			t.Helper()
+			assertError(t, 403, "impersonation_forbidden", "This can't be done while impersonating a user", resp)
+		}
+		forbidden(send(http.MethodPost, ban.URL, imp.AccessToken, map[string]interface{}{
+			"email": "admin@mail.com", "reason": "spam"}))
+		forbidden(send(http.MethodPut, changePass.URL, imp.AccessToken, map[string]interface{}{
+			"email": "test@mail.com", "password": "x", "new_password": "y"}))
+		forbidden(send(http.MethodPut, changeEmail.URL, imp.AccessToken, map[string]interface{}{
+			"email": "test@mail.com", "new_email": "evil@mail.com"}))
+		forbidden(send(http.MethodPost, impersonate.URL, imp.AccessToken, map[string]interface{}{
+			"email": "test@mail.com", "reason": "again"}))
+
+		entries, _ := store.Query(AuditQuery{Action: "user.ban"})
+		if len(entries) != 1 || entries[0].Actor != boss.Email || entries[0].Result != AuditDenied {
+			t.Errorf("Unexpected audit entries: %+v", entries)
+		}
+	})
+
+	t.Run("superadmin only", func(t *testing.T) {
+		assertStatus(t, 403, send(http.MethodPost, impersonate.URL, adminToken, map[string]interface{}{
+			"email": "test@mail.com", "reason": "ticket 42"}))
+		old := roles
+		roles = Roles{RoleAdmin: {PermUsersImpersonate}, RoleSuperadmin: {PermAll}}
+		defer func() { roles = old }()
+		assertError(t, 403, "permission_denied", "Only superadmin can impersonate users!",
+			send(http.MethodPost, impersonate.URL, adminToken, map[string]interface{}{
+				"email": "test@mail.com", "reason": "ticket 42"}))
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		assertStatus(t, 422, send(http.MethodPost, impersonate.URL, bossToken, map[string]interface{}{
+			"email": "test@mail.com", "reason": " "}))
+		assertStatus(t, 404, send(http.MethodPost, impersonate.URL, bossToken, map[string]interface{}{
+			"email": "nobody@mail.com", "reason": "ticket 42"}))
+		for _, email := range []string{admin.Email, boss.Email} {
+			assertError(t, 403, "permission_denied", "Staff accounts can't be impersonated",
+				send(http.MethodPost, impersonate.URL, bossToken, map[string]interface{}{
+					"email": email, "reason": "ticket 42"}))
+		}
+	})
+
+	t.Run("ends when the superadmin is demoted", func(t *testing.T) {
+		imp := impersonateAs(bossToken, "test@mail.com")
+		demoted := boss
+		demoted.Role = RoleAdmin
+		u.repository.Update(boss.Email, demoted)
+		defer u.repository.Update(boss.Email, boss)
+		assertStatus(t, 401, send(http.MethodGet, me.URL, imp.AccessToken, nil))
+	})
+}
@@ -1,155 +1,498 @@
 package main
 
 import (
-	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/openware/rango/pkg/auth"
 )
 
+const (
+	defaultAccessTTL  = 15 * time.Minute
+	defaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+// accessTokenType is the token_type of the access tokens of the API, the key
+// ring signs other tokens too.
+const accessTokenType = "access"
+
+// accessAudiences are the audiences of the access tokens of the API.
+var accessAudiences = []string{"peatio", "barong"}
+
 type JWTService struct {
-	keys *auth.KeyStore
+	keys *KeyRing
+
+	AccessTTL        time.Duration
+	RefreshTTL       time.Duration
+	ImpersonationTTL time.Duration
+	RefreshTokens    RefreshTokenStore
 }
 
+// NewJWTService starts the key ring with the key pair of the given files,
+// generated if they don't exist.
 func NewJWTService(privKeyPath, pubKeyPath string) (*JWTService, error) {
-	keys, err := auth.LoadOrGenerateKeys(privKeyPath, pubKeyPath)
+	pair, err := auth.LoadOrGenerateKeys(privKeyPath, pubKeyPath)
 	if err != nil {
 		return nil, err
 	}
-	return &JWTService{keys: keys}, nil
+	info, err := os.Stat(privKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &JWTService{
+		keys:             NewKeyRing(newSigningKey(pair.PrivateKey, info.ModTime(), "")),
+		AccessTTL:        defaultAccessTTL,
+		RefreshTTL:       defaultRefreshTTL,
+		ImpersonationTTL: defaultImpersonationTTL,
+		RefreshTokens:    NewInMemoryRefreshTokenStore(),
+	}, nil
 }
 func (j *JWTService) GenearateJWT(u User) (string, error) {
-	return auth.ForgeToken("empty", u.Email, "empty", 0, j.keys.
-		PrivateKey, nil)
+	return j.generateAccessToken(u, "")
+}
+
+// generateAccessToken signs an access token of u belonging to session, if
+// any.
+func (j *JWTService) generateAccessToken(u User, session string) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	claims := jwt.MapClaims{"jti": jti}
+	if session != "" {
+		claims["sid"] = session
+	}
+	return j.forgeToken(u, claims)
+}
+
+// forgeToken signs the claims auth.ForgeToken sets for u, overridden by
+// extra, with the current key of the ring.
+func (j *JWTService) forgeToken(u User, extra jwt.MapClaims) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iat":         now.Unix(),
+		"iat_ns":      now.UnixNano(),
+		"exp":         now.UTC().Add(j.AccessTTL).Unix(),
+		"sub":         "session",
+		"iss":         "barong",
+		"aud":         accessAudiences,
+		"token_type":  accessTokenType,
+		"uid":         "empty",
+		"email":       u.Email,
+		"role":        u.Role,
+		"level":       0,
+		"state":       "active",
+		"referral_id": nil,
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	return j.keys.sign(claims)
+}
+
+// AccessClaims are the claims of access tokens. Session is empty for tokens
+// issued outside of a session, Actor is only set on impersonation tokens.
+// IssuedAtNano is the precise iat, compared with the revocations.
+type AccessClaims struct {
+	auth.Auth
+	TokenType    string      `json:"token_type"`
+	Session      string      `json:"sid,omitempty"`
+	Actor        *TokenActor `json:"act,omitempty"`
+	IssuedAtNano int64       `json:"iat_ns,omitempty"`
+}
+
+// forAPI reports whether the claims are those of an access token of the API.
+func (c AccessClaims) forAPI() bool {
+	if c.TokenType != accessTokenType {
+		return false
+	}
+	for _, aud := range c.Audience {
+		for _, expected := range accessAudiences {
+			if aud == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c AccessClaims) issued() time.Time {
+	return issuedAt(c.IssuedAt, c.IssuedAtNano)
+}
+
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// IssueTokens creates an access token and a refresh token of session, whose
+// ID is the family of the refresh token.
+func (j *JWTService) IssueTokens(u User, session string) (TokenPair, error) {
+	access, err := j.generateAccessToken(u, session)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	refresh, err := randomToken(32)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	now := time.Now()
+	err = j.RefreshTokens.Save(RefreshToken{
+		Hash:      hashToken(refresh),
+		Family:    session,
+		Email:     u.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(j.RefreshTTL),
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(j.AccessTTL / time.Second),
+	}, nil
 }
-func (j *JWTService) ParseJWT(jwt string) (auth.Auth, error) {
-	return auth.ParseAndValidate(jwt, j.keys.PublicKey)
+
+// ParseJWT returns the claims of a valid access token, other tokens signed
+// by the key ring are refused.
+func (j *JWTService) ParseJWT(token string) (AccessClaims, error) {
+	claims := AccessClaims{}
+	if _, err := jwt.ParseWithClaims(token, &claims, j.keys.keyFunc); err != nil {
+		return claims, err
+	}
+	if !claims.forAPI() {
+		return claims, errors.New("token is not an access token")
+	}
+	return claims, nil
+}
+
+// signScopedToken signs a token for something else than authenticating
+// requests, like verifying an email. The audience tells it apart from access
+// tokens, which are signed with the same key.
+func signScopedToken(keys *KeyRing, audience, subject, id string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := jwt.StandardClaims{
+		Subject:   subject,
+		Audience:  audience,
+		Id:        id,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+	return keys.sign(claims)
 }
 
+// parseScopedToken returns the claims of a valid token of signScopedToken
+// for audience.
+func parseScopedToken(keys *KeyRing, token, audience string) (*jwt.StandardClaims, error) {
+	claims := &jwt.StandardClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, keys.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyAudience(audience, true) {
+		return nil, errors.New("token is meant for another audience")
+	}
+	return claims, nil
+}
+
+var errInvalidCredentials = newUnauthorizedError("invalid_credentials", "invalid login params")
+
 type JWTParams struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// Session is "cookie" to get the tokens in cookies.
+	Session string `json:"session"`
+	// Device labels the session, like "work laptop".
+	Device string `json:"device"`
 }
 
 func (u *UserService) JWT(w http.ResponseWriter, r *http.Request, jwtService *JWTService) {
 	params := &JWTParams{}
 	err := json.NewDecoder(r.Body).Decode(params)
 	if err != nil {
-		handleError(errors.New("could not read params"), w)
+		handleError(ErrInvalidParams, w)
 		return
 	}
-	passwordDigest := md5.New().Sum([]byte(params.Password))
-	user, err := u.repository.Get(params.Email)
+	now := time.Now()
+	attempt, err := beginLoginAttempt(w, loginAttemptKeys(r, params.Email), now)
 	if err != nil {
+		logins.Inc("throttled")
 		handleError(err, w)
 		return
 	}
-
-	if string(passwordDigest) != user.PasswordDigest && user.Email != os.Getenv("CAKE_ADMIN_EMAIL") {
-		handleError(errors.New("invalid login params"), w)
+	defer attempt.end()
+	user, err := u.repository.Get(params.Email)
+	if err != nil && err != ErrUserNotFound {
+		handleError(err, w)
 		return
 	}
 
-	if user.Banned == true {
-		w.WriteHeader(401)
-		w.Write([]byte("Your are banned because : "))
-		for key, _ := range user.BanHistory.history {
-			if user.BanHistory.history[key].WhoUnbanned == "" {
-				w.Write([]byte(user.BanHistory.history[key].Why))
-			}
+	// an unknown email fails like a wrong password, in the same time
+	var ok, rehash bool
+	if err == ErrUserNotFound {
+		checkNoPassword(params.Password)
+	} else {
+		ok, rehash = checkPassword(params.Password, user.PasswordDigest)
+	}
+	if !ok {
+		logins.Inc("failure")
+		attempt.fail(user)
+		handleError(errInvalidCredentials, w)
+		return
+	}
+	tf, err := twoFactors.Get(user.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	// with two-factor authentication the failures are forgotten after the
+	// second step, or the password would allow to try codes endlessly
+	if !tf.Enabled {
+		if err := recordLoginSuccess(user.Email); err != nil {
+			handleError(err, w)
+			return
+		}
+	}
+	if rehash {
+		if digest, err := hashPassword(params.Password); err == nil {
+			user.PasswordDigest = digest
+			u.repository.Update(user.Email, user)
 		}
+	}
+	user, err = u.checkCanLogin(user)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	if tf.Enabled {
+		writeTwoFactorChallenge(w, jwtService, user.Email)
 		return
 	}
 
-	token, err := jwtService.GenearateJWT(user)
+	tokens, err := jwtService.StartSession(r, user, params.Device)
 	if err != nil {
 		handleError(err, w)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(token))
+	logins.Inc("success")
+	writeTokens(w, jwtService, tokens, params.Session)
 }
 
-type ProtectedHandler func(rw http.ResponseWriter, r *http.Request, u User, us UserRepository)
+// checkCanLogin refuses banned users and, when required, those who haven't
+// verified their email.
+func (u *UserService) checkCanLogin(user User) (User, error) {
+	// the scheduler may not have lifted a ban which just ended yet
+	user, _, err := liftExpiredBan(u.repository, user, time.Now())
+	if err != nil {
+		return user, err
+	}
+	if user.Banned == true {
+		message := "Your are banned because : "
+		if ban := user.BanHistory.active(); ban != nil {
+			message += ban.Why + banEndText(ban.Until)
+		}
+		logins.Inc("failure")
+		return user, newForbiddenError("user_banned", message)
+	}
+	if emailVerification != nil && emailVerification.Required && !user.Verified() {
+		logins.Inc("failure")
+		return user, errEmailNotVerified
+	}
+	return user, nil
+}
 
-func (j *JWTService) jwtAuth(
-	users UserRepository,
-	h ProtectedHandler,
-) http.HandlerFunc {
-	return func(rw http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		auth, err := j.ParseJWT(token)
-		if err != nil {
-			rw.WriteHeader(401)
-			rw.Write([]byte("unauthorized"))
+type RefreshParams struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Refresh rotates a refresh token: the presented token is spent and a new
+// pair from the same family is issued. Presenting a spent token means it
+// leaked, so the whole family gets revoked. Sessions in cookies are
+// refreshed from the refresh cookie, without a body.
+func (u *UserService) Refresh(w http.ResponseWriter, r *http.Request, jwtService *JWTService) {
+	params := &RefreshParams{}
+	mode := ""
+	if c, err := r.Cookie(refreshCookie); err == nil {
+		if err := checkCSRF(r); err != nil {
+			handleError(err, w)
 			return
 		}
-		user, err := users.Get(auth.Email)
-		if err != nil {
-			rw.WriteHeader(401)
-			rw.Write([]byte("unauthorized"))
+		params.RefreshToken, mode = c.Value, sessionModeCookie
+	} else if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(ErrInvalidParams, w)
+		return
+	}
+	hash := hashToken(params.RefreshToken)
+	token, err := jwtService.RefreshTokens.Get(hash)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	if token.Revoked {
+		handleError(errRefreshTokenRevoked, w)
+		return
+	}
+	if err := jwtService.RefreshTokens.MarkUsed(hash); err != nil {
+		if err == errRefreshTokenUsed {
+			jwtService.RefreshTokens.RevokeFamily(token.Family)
+			handleError(newUnauthorizedError("refresh_token_reused", "refresh token reuse detected"), w)
 			return
 		}
-		h(rw, r, user, users)
+		handleError(err, w)
+		return
+	}
+	if time.Now().After(token.ExpiresAt) {
+		handleError(newUnauthorizedError("refresh_token_expired", "refresh token has expired"), w)
+		return
+	}
+	revoked, err := isRevoked(token.Email, "", token.CreatedAt)
+	if err != nil || revoked {
+		jwtService.RefreshTokens.RevokeFamily(token.Family)
+		handleError(errRefreshTokenRevoked, w)
+		return
 	}
+	user, err := u.repository.Get(token.Email)
+	if err != nil || user.Banned {
+		jwtService.RefreshTokens.RevokeFamily(token.Family)
+		handleError(ErrUnauthorized, w)
+		return
+	}
+	if emailVerification != nil && emailVerification.Required && !user.Verified() {
+		handleError(errEmailNotVerified, w)
+		return
+	}
+	now := time.Now()
+	session, err := activeSession(token.Family, user.Email, now)
+	if err != nil {
+		jwtService.RefreshTokens.RevokeFamily(token.Family)
+		handleError(errSessionEnded, w)
+		return
+	}
+	session.LastSeen, session.IP, session.ExpiresAt = now, clientIP(r), now.Add(jwtService.RefreshTTL)
+	if err := sessions.Save(session); err != nil {
+		handleError(err, w)
+		return
+	}
+	tokens, err := jwtService.IssueTokens(user, token.Family)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	writeTokens(w, jwtService, tokens, mode)
 }
 
-func (j *JWTService) jwtAuthAdmin(
-	users UserRepository,
-	h ProtectedHandler,
-) http.HandlerFunc {
-	return func(rw http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		auth, err := j.ParseJWT(token)
+// writeTokens replies with tokens, in cookies for the cookie session mode.
+func writeTokens(w http.ResponseWriter, jwtService *JWTService, tokens TokenPair, mode string) {
+	if mode == sessionModeCookie {
+		writeSessionCookies(w, jwtService, tokens)
+		return
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+type ProtectedHandler func(rw http.ResponseWriter, r *http.Request, u User, us UserRepository)
+
+// authenticate resolves the user behind the bearer token or the session
+// cookie of r, which is a JWT or an API key. The returned request carries
+// the API key, the session or the impersonator it was authenticated with.
+// Tokens which are expired, revoked, of an ended session, belong to a
+// deleted user, carry an outdated role or were made by a former superadmin
+// are refused.
+func (j *JWTService) authenticate(r *http.Request, users UserRepository) (User, *http.Request, error) {
+	token, _ := bearerToken(r)
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		user, key, err := authenticateAPIKey(token, users)
 		if err != nil {
-			rw.WriteHeader(401)
-			rw.Write([]byte("unauthorized"))
-			return
+			return User{}, r, err
 		}
-		user, err := users.Get(auth.Email)
+		return user, withAPIKey(r, key), nil
+	}
+	auth, err := j.ParseJWT(token)
+	if err != nil {
+		return User{}, r, err
+	}
+	revoked, err := isRevoked(auth.Email, auth.Id, auth.issued())
+	if err != nil {
+		return User{}, r, err
+	}
+	if revoked {
+		return User{}, r, errors.New("token has been revoked")
+	}
+	user, err := users.Get(auth.Email)
+	if err != nil {
+		return User{}, r, err
+	}
+	if user.Role != auth.Role {
+		return User{}, r, errors.New("token role is outdated")
+	}
+	if auth.Session != "" {
+		now := time.Now()
+		session, err := activeSession(auth.Session, auth.Email, now)
 		if err != nil {
-			rw.WriteHeader(401)
-			rw.Write([]byte("unauthorized"))
-			return
+			return User{}, r, err
 		}
-		if user.Role != "superadmin" && user.Role != "admin" {
-			rw.WriteHeader(401)
-			rw.Write([]byte("You should be admin to access this page"))
-			return
+		touchSession(session, r, now)
+		r = withSession(r, session.ID)
+	}
+	if auth.Actor != nil {
+		if err := checkImpersonator(auth.Actor.Subject, auth.issued(), users); err != nil {
+			return User{}, r, err
 		}
-		h(rw, r, user, users)
+		r = withImpersonator(r, auth.Actor.Subject)
 	}
+	return user, r, nil
 }
 
-func (j *JWTService) jwtAuthSuperadmin(
+// jwtAuthorize lets the request through if the token is valid and its role,
+// and the scopes of an API key, grant all of permissions. Without
+// permissions any signed in user passes, with permissions the two-factor
+// policy applies too. Requests authenticated by the session cookie need the
+// CSRF token on unsafe methods. Impersonation tokens never pass when
+// permissions are needed.
+func (j *JWTService) jwtAuthorize(
 	users UserRepository,
 	h ProtectedHandler,
+	permissions ...Permission,
 ) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		auth, err := j.ParseJWT(token)
+		user, r, err := j.authenticate(r, users)
 		if err != nil {
-			rw.WriteHeader(401)
-			rw.Write([]byte("unauthorized"))
+			handleError(ErrUnauthorized, rw)
 			return
 		}
-		user, err := users.Get(auth.Email)
-		if err != nil {
-			rw.WriteHeader(401)
-			rw.Write([]byte("unauthorized"))
+		info := requestInfoFrom(r)
+		info.User = user.Email
+		info.Impersonator = impersonatorFrom(r)
+		if info.Impersonator != "" && len(permissions) > 0 {
+			handleError(errImpersonationForbidden, rw)
 			return
 		}
-		if user.Role != "superadmin" {
-			rw.WriteHeader(401)
-			rw.Write([]byte("You should be a superadmin to access this page"))
-			return
+		if _, fromCookie := bearerToken(r); fromCookie {
+			if err := checkCSRF(r); err != nil {
+				handleError(err, rw)
+				return
+			}
+		}
+		for _, p := range permissions {
+			if !allowed(r, user, p) {
+				handleError(ErrPermission, rw)
+				return
+			}
+		}
+		if len(permissions) > 0 {
+			if err := checkStaffTwoFactor(user); err != nil {
+				handleError(err, rw)
+				return
+			}
 		}
 		h(rw, r, user, users)
 	}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	defaultKeyRotationInterval = 30 * 24 * time.Hour
+	defaultKeyOverlap          = 48 * time.Hour
+	// keyRotationCheck is how often the ring is reloaded and checked, so
+	// instances sharing a directory pick up each other's keys.
+	keyRotationCheck = time.Minute
+	rotatedKeyBits   = 2048
+	// jwksMaxAge is how long other services may cache the JWKS.
+	jwksMaxAge = 5 * time.Minute
+	// keyPublishLead is how long a rotated key is published before it
+	// signs, so that every cached JWKS has it by then. It is longer than
+	// jwksMaxAge for the instances whose clocks or checks lag.
+	keyPublishLead = 2 * jwksMaxAge
+)
+
+var errUnknownKey = errors.New("token is signed by an unknown or retired key")
+
+// SigningKey is a key of the ring. Its ID, the kid header of the tokens it
+// signs, is the RFC 7638 thumbprint of its public key.
+type SigningKey struct {
+	ID      string
+	Private *rsa.PrivateKey
+	// ActiveAt is when the key starts signing.
+	ActiveAt time.Time
+	// path is the file of a rotated key, empty for the configured key.
+	path string
+}
+
+func newSigningKey(priv *rsa.PrivateKey, activeAt time.Time, path string) SigningKey {
+	return SigningKey{ID: keyThumbprint(&priv.PublicKey), Private: priv, ActiveAt: activeAt, path: path}
+}
+
+func keyThumbprint(pub *rsa.PublicKey) string {
+	// the members in lexicographic order, as the RFC requires
+	canonical := `{"e":"` + jwkInt(big.NewInt(int64(pub.E))) + `","kty":"RSA","n":"` + jwkInt(pub.N) + `"}`
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func jwkInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// KeyRing signs tokens with its newest active key. A rotated key is
+// published keyPublishLead before it signs, a replaced key keeps verifying
+// for Overlap, which must outlive the tokens it signed.
+type KeyRing struct {
+	lock sync.RWMutex
+	// keys are newest first, the first ones may not be active yet.
+	keys []SigningKey
+	// legacy is the ID of the configured key, which also verifies the
+	// tokens signed before keys had IDs.
+	legacy  string
+	Overlap time.Duration
+	// Dir keeps the rotated keys, they only live in memory without it.
+	Dir string
+}
+
+func NewKeyRing(initial SigningKey) *KeyRing {
+	return &KeyRing{keys: []SigningKey{initial}, legacy: initial.ID, Overlap: defaultKeyOverlap}
+}
+
+// signing returns the newest key active at now.
+func (k *KeyRing) signing(now time.Time) SigningKey {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	for _, key := range k.keys {
+		if !key.ActiveAt.After(now) {
+			return key
+		}
+	}
+	return k.keys[len(k.keys)-1]
+}
+
+// newest returns the last rotated key, active or not.
+func (k *KeyRing) newest() SigningKey {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.keys[0]
+}
+
+// verifying returns the keys which still or already verify tokens at now.
+func (k *KeyRing) verifying(now time.Time) []SigningKey {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	keys := []SigningKey{k.keys[0]}
+	for i := 1; i < len(k.keys); i++ {
+		// a key retires when the next one replaces it
+		if now.Before(k.keys[i-1].ActiveAt.Add(k.Overlap)) {
+			keys = append(keys, k.keys[i])
+		}
+	}
+	return keys
+}
+
+func (k *KeyRing) sign(claims jwt.Claims) (string, error) {
+	key := k.signing(time.Now())
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	t.Header["kid"] = key.ID
+	return t.SignedString(key.Private)
+}
+
+// keyFunc gives jwt the public key of the kid of t.
+func (k *KeyRing) keyFunc(t *jwt.Token) (interface{}, error) {
+	if t.Method != jwt.SigningMethodRS256 {
+		return nil, errors.New("unexpected signing method")
+	}
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		kid = k.legacy
+	}
+	for _, key := range k.verifying(time.Now()) {
+		if key.ID == kid {
+			return &key.Private.PublicKey, nil
+		}
+	}
+	return nil, errUnknownKey
+}
+
+// Load adds the keys rotated in dir, which becomes the Dir of the ring.
+func (k *KeyRing) Load(dir string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.Dir = dir
+	return k.reload()
+}
+
+func (k *KeyRing) reload() error {
+	files, err := filepath.Glob(filepath.Join(k.Dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, key := range k.keys {
+		known[key.path] = true
+	}
+	for _, path := range files {
+		if known[path] {
+			continue
+		}
+		key, err := readRotatedKey(path)
+		if err != nil {
+			return err
+		}
+		k.keys = append(k.keys, key)
+	}
+	sort.SliceStable(k.keys, func(a, b int) bool { return k.keys[a].ActiveAt.After(k.keys[b].ActiveAt) })
+	return nil
+}
+
+// readRotatedKey reads a key saved by Rotate, named after the time it
+// becomes active.
+func readRotatedKey(path string) (SigningKey, error) {
+	active, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), ".pem"), 10, 64)
+	if err != nil {
+		return SigningKey{}, errors.New(path + ": not a rotated key")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, errors.New(path + ": no PEM data")
+	}
+	priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	return newSigningKey(priv, time.Unix(active, 0), path), nil
+}
+
+// Rotate publishes a new key, which becomes the signing one keyPublishLead
+// after now. The keys retired for longer than Overlap are forgotten, their
+// files deleted.
+func (k *KeyRing) Rotate(now time.Time) (SigningKey, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, rotatedKeyBits)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	activeAt := now.Add(keyPublishLead)
+	path := ""
+	if k.Dir != "" {
+		if err := os.MkdirAll(k.Dir, 0700); err != nil {
+			return SigningKey{}, err
+		}
+		path = filepath.Join(k.Dir, strconv.FormatInt(activeAt.Unix(), 10)+".pem")
+		data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return SigningKey{}, err
+		}
+	}
+	key := newSigningKey(priv, activeAt, path)
+	k.keys = append([]SigningKey{key}, k.keys...)
+	kept := k.keys[:1]
+	for i := 1; i < len(k.keys); i++ {
+		if now.Before(k.keys[i-1].ActiveAt.Add(k.Overlap)) {
+			kept = append(kept, k.keys[i])
+			continue
+		}
+		if k.keys[i].path != "" {
+			if err := os.Remove(k.keys[i].path); err != nil && !os.IsNotExist(err) {
+				log.Println("Could not delete retired key", k.keys[i].path, err)
+			}
+		}
+	}
+	k.keys = kept
+	return key, nil
+}
+
+// rotateIfDue rotates so that the next key becomes active interval after
+// the newest one.
+func (k *KeyRing) rotateIfDue(interval time.Duration, now time.Time) (bool, error) {
+	if k.Dir != "" {
+		k.lock.Lock()
+		err := k.reload()
+		k.lock.Unlock()
+		if err != nil {
+			return false, err
+		}
+	}
+	if now.Before(k.newest().ActiveAt.Add(interval - keyPublishLead)) {
+		return false, nil
+	}
+	_, err := k.Rotate(now)
+	return err == nil, err
+}
+
+// runKeyRotation rotates the keys every interval until ctx is done.
+func runKeyRotation(ctx context.Context, k *KeyRing, interval time.Duration) {
+	rotate := func(now time.Time) {
+		rotated, err := k.rotateIfDue(interval, now)
+		if err != nil {
+			log.Println("Could not rotate signing keys:", err)
+		}
+		if rotated {
+			next := k.newest()
+			log.Println("Published signing key", next.ID, "which signs from", next.ActiveAt)
+		}
+	}
+	rotate(time.Now())
+	ticker := time.NewTicker(keyRotationCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			rotate(now)
+		}
+	}
+}
+
+// JWK is the public part of a key in the format of RFC 7517.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (k *KeyRing) JWKS(now time.Time) JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range k.verifying(now) {
+		pub := key.Private.PublicKey
+		set.Keys = append(set.Keys, JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: jwt.SigningMethodRS256.Alg(),
+			Kid: key.ID,
+			N:   jwkInt(pub.N),
+			E:   jwkInt(big.NewInt(int64(pub.E))),
+		})
+	}
+	return set
+}
+
+// jwksHandler publishes the keys verifying the tokens, for other services,
+// along with the next key before it signs.
+func jwksHandler(j *JWTService) http.HandlerFunc {
+	maxAge := "public, max-age=" + strconv.Itoa(int(jwksMaxAge/time.Second))
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", maxAge)
+		writeJSON(w, http.StatusOK, j.keys.JWKS(time.Now()))
+	}
+}
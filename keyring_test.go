@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// jwksKey finds kid in the JWKS of j, the way another service would.
+func jwksKey(t *testing.T, j *JWTService, kid string) *rsa.PublicKey {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	jwksHandler(j)(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	set := JWKSet{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range set.Keys {
+		if k.Kid != kid {
+			continue
+		}
+		n, _ := base64.RawURLEncoding.DecodeString(k.N)
+		e, _ := base64.RawURLEncoding.DecodeString(k.E)
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return nil
+}
+
+func tokenKid(t *testing.T, token string) string {
+	t.Helper()
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func TestKeyRing(t *testing.T) {
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	old, _ := j.GenearateJWT(User{Email: "test@mail.com"})
+
+	t.Run("tokens verify with the JWKS", func(t *testing.T) {
+		kid := tokenKid(t, old)
+		if kid == "" || kid != j.keys.signing(time.Now()).ID {
+			t.Fatalf("Unexpected kid %q", kid)
+		}
+		pub := jwksKey(t, j, kid)
+		if pub == nil {
+			t.Fatal("the signing key isn't published")
+		}
+		_, err := jwt.Parse(old, func(*jwt.Token) (interface{}, error) { return pub, nil })
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("tokens without kid verify with the configured key", func(t *testing.T) {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"email": "test@mail.com", "aud": accessAudiences, "token_type": accessTokenType,
+			"exp": time.Now().Add(time.Minute).Unix()}).SignedString(j.keys.signing(time.Now()).Private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth, err := j.ParseJWT(token); err != nil || auth.Email != "test@mail.com" {
+			t.Errorf("Unexpected claims: %+v, %v", auth, err)
+		}
+	})
+
+	t.Run("other tokens of the ring aren't access tokens", func(t *testing.T) {
+		for _, claims := range []jwt.MapClaims{
+			{"aud": accessAudiences},
+			{"aud": []string{"bakery"}, "token_type": accessTokenType},
+		} {
+			claims["email"], claims["exp"] = "test@mail.com", time.Now().Add(time.Minute).Unix()
+			token, err := j.keys.sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := j.ParseJWT(token); err == nil {
+				t.Errorf("%v should be refused", claims)
+			}
+		}
+	})
+
+	t.Run("the next key is published before it signs", func(t *testing.T) {
+		j, _ := NewJWTService("privkey.rsa", "pubkey.rsa")
+		current := j.keys.signing(time.Now())
+		key, err := j.keys.Rotate(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jwksKey(t, j, key.ID) == nil {
+			t.Fatal("the next key should be published right away")
+		}
+		token, _ := j.GenearateJWT(User{Email: "test@mail.com"})
+		if tokenKid(t, token) != current.ID {
+			t.Errorf("the next key shouldn't sign yet")
+		}
+		if key.ActiveAt.Before(time.Now().Add(jwksMaxAge)) {
+			t.Errorf("the next key should sign after the cached JWKS expire, at %v", key.ActiveAt)
+		}
+		if j.keys.signing(key.ActiveAt.Add(-time.Second)).ID != current.ID || j.keys.signing(key.ActiveAt).ID != key.ID {
+			t.Errorf("the next key should sign from %v", key.ActiveAt)
+		}
+	})
+
+	t.Run("rotation keeps the old key for the overlap", func(t *testing.T) {
+		j, _ := NewJWTService("privkey.rsa", "pubkey.rsa")
+		old, _ := j.GenearateJWT(User{Email: "test@mail.com"})
+		key, err := j.keys.Rotate(time.Now().Add(-keyPublishLead))
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, _ := j.GenearateJWT(User{Email: "test@mail.com"})
+		if tokenKid(t, token) != key.ID || jwksKey(t, j, key.ID) == nil {
+			t.Fatalf("the new key should sign and be published")
+		}
+		if _, err := j.ParseJWT(old); err != nil || jwksKey(t, j, tokenKid(t, old)) == nil {
+			t.Errorf("the old key should verify during the overlap: %v", err)
+		}
+		j.keys.Overlap = 0
+		if _, err := j.ParseJWT(old); err == nil || jwksKey(t, j, tokenKid(t, old)) != nil {
+			t.Errorf("the old key should be retired after the overlap")
+		}
+		if _, err := j.ParseJWT(token); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("rotated keys are kept in the directory", func(t *testing.T) {
+		dir := t.TempDir()
+		now := time.Now()
+		j, _ := NewJWTService("privkey.rsa", "pubkey.rsa")
+		j.keys.Overlap = time.Hour
+		// the age of the configured key comes from the file, a fresh checkout
+		// would make it new
+		j.keys.keys[0].ActiveAt = now.Add(-4 * time.Hour)
+		j.keys.Load(dir)
+		if rotated, err := j.keys.rotateIfDue(time.Hour, now.Add(-3*time.Hour)); err != nil || !rotated {
+			t.Fatalf("the configured key should be due: %v", err)
+		}
+		first := j.keys.newest()
+		if rotated, _ := j.keys.rotateIfDue(time.Hour, now.Add(-150*time.Minute)); rotated {
+			t.Fatal("the key isn't due yet")
+		}
+		j.keys.Rotate(now.Add(-2 * time.Hour))
+		last, _ := j.keys.Rotate(now)
+		if _, err := os.Stat(first.path); !os.IsNotExist(err) {
+			t.Errorf("the retired key should be deleted: %v", err)
+		}
+
+		restarted, _ := NewJWTService("privkey.rsa", "pubkey.rsa")
+		restarted.keys.Overlap = time.Hour
+		if err := restarted.keys.Load(dir); err != nil {
+			t.Fatal(err)
+		}
+		if restarted.keys.signing(now).ID == last.ID || restarted.keys.signing(last.ActiveAt).ID != last.ID {
+			t.Errorf("the newest key should sign once active after a restart")
+		}
+		if files, _ := filepath.Glob(filepath.Join(dir, "*.pem")); len(files) != 2 {
+			t.Errorf("Unexpected keys: %v", files)
+		}
+	})
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Login attempts are tracked per account and per client IP.
+const (
+	AttemptsAccount = "account"
+	AttemptsIP      = "ip"
+)
+
+type AttemptKey struct {
+	Kind    string
+	Subject string
+}
+
+// LoginAttempts are the recent failed logins of an account or an IP.
+type LoginAttempts struct {
+	Key         AttemptKey
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+	// Staff tells that an admin account failed to log in, as or from Key.
+	// Only those who manage admins see these.
+	Staff bool
+}
+
+func (a LoginAttempts) locked(now time.Time) bool {
+	return a.LockedUntil.After(now)
+}
+
+// LoginAttemptStore keeps the failed login attempts. Its methods are
+// enough for a store shared by several instances.
+type LoginAttemptStore interface {
+	Get(AttemptKey) (LoginAttempts, error)
+	// Attempt counts an attempt at the given time as a failure and locks k
+	// for delay(failures), unless k is locked already, which ok false
+	// reports. Checking and counting at once keeps concurrent attempts
+	// from all getting past the lock. The count starts over when the
+	// previous failure is older than window.
+	Attempt(k AttemptKey, at time.Time, window time.Duration, delay func(failures int) time.Duration) (a LoginAttempts, ok bool, err error)
+	// Forgive takes back the attempt a, which didn't fail, with the lock
+	// it set.
+	Forgive(k AttemptKey, a LoginAttempts) error
+	MarkStaff(AttemptKey) error
+	Reset(AttemptKey) error
+	List() ([]LoginAttempts, error)
+}
+
+// LockoutRule is how many failures are let through before each further one
+// delays the next attempt, doubling every time, and how many lock the login
+// for LockoutPolicy.LockoutDuration.
+type LockoutRule struct {
+	FreeFailures    int
+	LockoutFailures int
+}
+
+type LockoutPolicy struct {
+	Account LockoutRule
+	IP      LockoutRule
+	// BaseDelay is the first delay, delays never exceed LockoutDuration.
+	BaseDelay       time.Duration
+	LockoutDuration time.Duration
+	// Window is how long failures are remembered.
+	Window time.Duration
+}
+
+func defaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		Account:         LockoutRule{FreeFailures: 3, LockoutFailures: 10},
+		IP:              LockoutRule{FreeFailures: 10, LockoutFailures: 50},
+		BaseDelay:       time.Second,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	}
+}
+
+var (
+	lockoutPolicy                   = defaultLockoutPolicy()
+	loginAttempts LoginAttemptStore = NewInMemoryLoginAttemptStore()
+)
+
+func (p LockoutPolicy) rule(kind string) LockoutRule {
+	if kind == AttemptsIP {
+		return p.IP
+	}
+	return p.Account
+}
+
+// delay is how long to wait before the next attempt after failures.
+func (p LockoutPolicy) delay(rule LockoutRule, failures int) time.Duration {
+	if failures >= rule.LockoutFailures {
+		return p.LockoutDuration
+	}
+	if failures <= rule.FreeFailures {
+		return 0
+	}
+	d := float64(p.BaseDelay) * math.Pow(2, float64(failures-rule.FreeFailures-1))
+	if d > float64(p.LockoutDuration) {
+		return p.LockoutDuration
+	}
+	return time.Duration(d)
+}
+
+func loginAttemptKeys(r *http.Request, email string) []AttemptKey {
+	return []AttemptKey{{AttemptsAccount, email}, {AttemptsIP, clientIP(r)}}
+}
+
+// loginAttempt is a login counted as failed from the start, so that
+// concurrent guesses can't all get past the lockout. end takes it back
+// unless fail was called.
+type loginAttempt struct {
+	keys    []AttemptKey
+	counted []LoginAttempts
+	failed  bool
+}
+
+// beginLoginAttempt fails with a 429 when any of keys is locked and sets
+// Retry-After accordingly.
+func beginLoginAttempt(w http.ResponseWriter, keys []AttemptKey, now time.Time) (*loginAttempt, error) {
+	attempt := &loginAttempt{}
+	var until time.Time
+	for _, k := range keys {
+		rule := lockoutPolicy.rule(k.Kind)
+		a, ok, err := loginAttempts.Attempt(k, now, lockoutPolicy.Window, func(failures int) time.Duration {
+			return lockoutPolicy.delay(rule, failures)
+		})
+		if err != nil {
+			attempt.end()
+			return nil, err
+		}
+		if !ok {
+			if a.LockedUntil.After(until) {
+				until = a.LockedUntil
+			}
+			continue
+		}
+		attempt.keys = append(attempt.keys, k)
+		attempt.counted = append(attempt.counted, a)
+	}
+	if until.IsZero() {
+		return attempt, nil
+	}
+	attempt.end()
+	retry := int(math.Ceil(until.Sub(now).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	return nil, &APIError{
+		Status:  http.StatusTooManyRequests,
+		Code:    "too_many_attempts",
+		Message: "Too many failed logins, retry in " + strconv.Itoa(retry) + " seconds",
+	}
+}
+
+// fail keeps the attempt counted. The failures of admin accounts mark the
+// keys as staff ones.
+func (a *loginAttempt) fail(u User) {
+	a.failed = true
+	if !isStaff(u.Role) {
+		return
+	}
+	for _, k := range a.keys {
+		if err := loginAttempts.MarkStaff(k); err != nil {
+			log.Println("Could not mark login attempts of", k.Kind, k.Subject, err)
+		}
+	}
+}
+
+func (a *loginAttempt) end() {
+	if a.failed {
+		return
+	}
+	for i, k := range a.keys {
+		if err := loginAttempts.Forgive(k, a.counted[i]); err != nil {
+			log.Println("Could not forgive login attempt of", k.Kind, k.Subject, err)
+		}
+	}
+}
+
+// recordLoginSuccess forgets the failures of the account. Those of the IP
+// stay, or logging into one's own account would reset them.
+func recordLoginSuccess(email string) error {
+	return loginAttempts.Reset(AttemptKey{AttemptsAccount, email})
+}
+
+type InMemoryLoginAttemptStore struct {
+	lock     sync.Mutex
+	attempts map[AttemptKey]LoginAttempts
+	failures int
+}
+
+func NewInMemoryLoginAttemptStore() *InMemoryLoginAttemptStore {
+	return &InMemoryLoginAttemptStore{attempts: make(map[AttemptKey]LoginAttempts)}
+}
+
+func (s *InMemoryLoginAttemptStore) Get(k AttemptKey) (LoginAttempts, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	a, ok := s.attempts[k]
+	if !ok {
+		return LoginAttempts{Key: k}, nil
+	}
+	return a, nil
+}
+
+func (s *InMemoryLoginAttemptStore) Attempt(k AttemptKey, at time.Time, window time.Duration, delay func(int) time.Duration) (LoginAttempts, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	a, ok := s.attempts[k]
+	if ok && a.locked(at) {
+		return a, false, nil
+	}
+	s.failures++
+	if s.failures%1000 == 0 {
+		s.prune(at, window)
+	}
+	if !ok || at.Sub(a.LastFailure) > window {
+		a = LoginAttempts{Key: k, LockedUntil: a.LockedUntil}
+	}
+	a.Failures++
+	a.LastFailure = at
+	if d := delay(a.Failures); d > 0 {
+		a.LockedUntil = at.Add(d)
+	}
+	s.attempts[k] = a
+	return a, true, nil
+}
+
+// prune drops what Fail would forget anyway, so that the IPs of a spray
+// don't pile up.
+func (s *InMemoryLoginAttemptStore) prune(now time.Time, window time.Duration) {
+	for k, a := range s.attempts {
+		if now.Sub(a.LastFailure) > window && !a.locked(now) {
+			delete(s.attempts, k)
+		}
+	}
+}
+
+func (s *InMemoryLoginAttemptStore) Forgive(k AttemptKey, attempt LoginAttempts) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	a, ok := s.attempts[k]
+	if !ok {
+		return nil
+	}
+	if a.Failures > 0 {
+		a.Failures--
+	}
+	// a later attempt may have locked it for longer
+	if a.LockedUntil.Equal(attempt.LockedUntil) {
+		a.LockedUntil = time.Time{}
+	}
+	s.attempts[k] = a
+	return nil
+}
+
+func (s *InMemoryLoginAttemptStore) MarkStaff(k AttemptKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if a, ok := s.attempts[k]; ok {
+		a.Staff = true
+		s.attempts[k] = a
+	}
+	return nil
+}
+
+func (s *InMemoryLoginAttemptStore) Reset(k AttemptKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.attempts, k)
+	return nil
+}
+
+func (s *InMemoryLoginAttemptStore) List() ([]LoginAttempts, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	attempts := make([]LoginAttempts, 0, len(s.attempts))
+	for _, a := range s.attempts {
+		attempts = append(attempts, a)
+	}
+	return attempts, nil
+}
+
+type LockoutRecord struct {
+	Kind        string     `json:"kind"`
+	Subject     string     `json:"subject"`
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+type LockoutsResponse struct {
+	Lockouts []LockoutRecord `json:"lockouts"`
+}
+
+// lockoutsHandler lists the accounts and IPs with recent failed logins,
+// locked ones first. Those of staff are left out unless u manages admins.
+func lockoutsHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	manager := allowed(r, u, PermAdminsManage)
+	attempts, err := loginAttempts.List()
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	now := time.Now()
+	sort.Slice(attempts, func(i, j int) bool {
+		a, b := attempts[i], attempts[j]
+		if a.locked(now) != b.locked(now) {
+			return a.locked(now)
+		}
+		if a.Key.Kind != b.Key.Kind {
+			return a.Key.Kind < b.Key.Kind
+		}
+		return a.Key.Subject < b.Key.Subject
+	})
+	resp := LockoutsResponse{Lockouts: []LockoutRecord{}}
+	for _, a := range attempts {
+		if now.Sub(a.LastFailure) > lockoutPolicy.Window && !a.locked(now) || a.Staff && !manager {
+			continue
+		}
+		record := LockoutRecord{Kind: a.Key.Kind, Subject: a.Key.Subject, Failures: a.Failures, LastFailure: a.LastFailure}
+		if a.locked(now) {
+			record.LockedUntil = optionalTime(a.LockedUntil)
+		}
+		resp.Lockouts = append(resp.Lockouts, record)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type ClearLockoutParams struct {
+	Email string `json:"email"`
+	IP    string `json:"ip"`
+}
+
+func clearLockoutHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	params := &ClearLockoutParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil || (params.Email == "") == (params.IP == "") {
+		handleError(newBadRequestError("invalid_params", "give either an email or an ip"), w)
+		return
+	}
+	k := AttemptKey{AttemptsAccount, params.Email}
+	if params.IP != "" {
+		k = AttemptKey{AttemptsIP, params.IP}
+	}
+	a, err := loginAttempts.Get(k)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	if a.Staff && !allowed(r, u, PermAdminsManage) {
+		handleError(newForbiddenError("permission_denied", "Only superadmin can clear the lockout of admin!"), w)
+		return
+	}
+	if err := loginAttempts.Reset(k); err != nil {
+		handleError(err, w)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("The lockout have been cleared"))
+}
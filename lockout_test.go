@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useLockoutPolicy gives the test its own attempt store and policy.
+func useLockoutPolicy(t *testing.T, p LockoutPolicy) {
+	oldPolicy, oldStore := lockoutPolicy, loginAttempts
+	lockoutPolicy, loginAttempts = p, NewInMemoryLoginAttemptStore()
+	t.Cleanup(func() { lockoutPolicy, loginAttempts = oldPolicy, oldStore })
+}
+
+func TestLockoutPolicy(t *testing.T) {
+	p := defaultLockoutPolicy()
+	cases := map[int]time.Duration{
+		3:  0,
+		4:  time.Second,
+		5:  2 * time.Second,
+		9:  32 * time.Second,
+		10: 15 * time.Minute,
+		40: 15 * time.Minute,
+	}
+	for failures, want := range cases {
+		if got := p.delay(p.Account, failures); got != want {
+			t.Errorf("%d failures: got %v, want %v", failures, got, want)
+		}
+	}
+}
+
+func TestLoginAttemptStore(t *testing.T) {
+	s := NewInMemoryLoginAttemptStore()
+	k := AttemptKey{AttemptsAccount, "test@mail.com"}
+	now := time.Now()
+	noDelay := func(int) time.Duration { return 0 }
+	s.Attempt(k, now, time.Minute, noDelay)
+	a, _, _ := s.Attempt(k, now.Add(time.Second), time.Minute, noDelay)
+	if a.Failures != 2 {
+		t.Errorf("Unexpected attempts: %+v", a)
+	}
+	a, _, _ = s.Attempt(k, now.Add(2*time.Minute), time.Minute, noDelay)
+	if a.Failures != 1 {
+		t.Errorf("old failures should be forgotten: %+v", a)
+	}
+
+	t.Run("locked keys refuse attempts", func(t *testing.T) {
+		k := AttemptKey{AttemptsIP, "10.0.0.1"}
+		lock := func(failures int) time.Duration { return time.Duration(failures) * time.Minute }
+		first, ok, _ := s.Attempt(k, now, time.Hour, lock)
+		if !ok || !first.locked(now) {
+			t.Fatalf("Unexpected attempts: %+v", first)
+		}
+		if a, ok, _ := s.Attempt(k, now.Add(time.Second), time.Hour, lock); ok || a.Failures != 1 {
+			t.Errorf("a locked key should refuse without counting: %+v", a)
+		}
+		s.Forgive(k, first)
+		if a, _ := s.Get(k); a.Failures != 0 || a.locked(now) {
+			t.Errorf("a forgiven attempt should lift its lock: %+v", a)
+		}
+	})
+}
+
+func TestUsers_LoginThrottling(t *testing.T) {
+	doRequest := createRequester(t)
+	policy := defaultLockoutPolicy()
+	policy.Account = LockoutRule{FreeFailures: 2, LockoutFailures: 4}
+	policy.BaseDelay = time.Minute
+	useLockoutPolicy(t, policy)
+
+	u := newTestUserService()
+	digest, _ := hashPassword("somepass")
+	u.repository.Add("test@mail.com", User{"test@mail.com", digest, "cake", RoleUser, false, BanHistory{}, "", ""})
+	admin := User{"admin@mail.com", "", "cake", RoleAdmin, false, BanHistory{}, "", ""}
+	u.repository.Add(admin.Email, admin)
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	login := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+	defer login.Close()
+	lockouts := httptest.NewServer(j.jwtAuthorize(u.repository, lockoutsHandler, PermUsersInspect))
+	defer lockouts.Close()
+	clear := httptest.NewServer(j.jwtAuthorize(u.repository, clearLockoutHandler, PermUsersUnban))
+	defer clear.Close()
+	token, _ := j.GenearateJWT(admin)
+	try := func(password string) *http.Response {
+		params := map[string]interface{}{"email": "test@mail.com", "password": password}
+		resp, err := http.Post(login.URL, contentTypeJSON, prepareParams(t, params))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp := try("wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: unexpected status %d", i+1, resp.StatusCode)
+		}
+	}
+	resp := try("somepass")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "60" {
+		t.Fatalf("Unexpected response: %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	t.Run("admin sees the lockout", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, lockouts.URL, nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		r := doRequest(req, nil)
+		assertStatus(t, 200, r)
+		list := LockoutsResponse{}
+		json.Unmarshal(r.body, &list)
+		first := list.Lockouts[0]
+		if first.Kind != AttemptsAccount || first.Subject != "test@mail.com" || first.Failures != 3 || first.LockedUntil == nil {
+			t.Errorf("Unexpected lockouts: %s", r.body)
+		}
+	})
+
+	t.Run("admin clears the lockout", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, clear.URL, prepareParams(t, map[string]interface{}{"email": "test@mail.com"}))
+		req.Header.Add("Authorization", "Bearer "+token)
+		assertStatus(t, 201, doRequest(req, nil))
+		if resp := try("somepass"); resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected status after clearing: %d", resp.StatusCode)
+		}
+		if a, _ := loginAttempts.Get(AttemptKey{AttemptsAccount, "test@mail.com"}); a.Failures != 0 {
+			t.Errorf("a successful login should reset the account failures: %+v", a)
+		}
+	})
+
+	t.Run("concurrent guesses can't get past the lock", func(t *testing.T) {
+		params := map[string]interface{}{"email": "racer@mail.com", "password": "wrong"}
+		statuses := make(chan int, 20)
+		var wg sync.WaitGroup
+		for i := 0; i < cap(statuses); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if resp, err := http.Post(login.URL, contentTypeJSON, prepareParams(t, params)); err == nil {
+					resp.Body.Close()
+					statuses <- resp.StatusCode
+				}
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+		guesses := 0
+		for status := range statuses {
+			if status == http.StatusUnauthorized {
+				guesses++
+			}
+		}
+		// the free failures and the one which locks
+		if guesses != policy.Account.FreeFailures+1 {
+			t.Errorf("Unexpected number of guesses checked: %d", guesses)
+		}
+	})
+
+	t.Run("staff lockouts are for superadmins", func(t *testing.T) {
+		digest, _ := hashPassword("adminpass")
+		u.repository.Add("other-admin@mail.com", User{"other-admin@mail.com", digest, "cake", RoleAdmin, false, BanHistory{}, "", ""})
+		boss := User{"boss@mail.com", "", "cake", RoleSuperadmin, false, BanHistory{}, "", ""}
+		u.repository.Add(boss.Email, boss)
+		bossToken, _ := j.GenearateJWT(boss)
+		params := map[string]interface{}{"email": "other-admin@mail.com", "password": "wrong"}
+		if resp, err := http.Post(login.URL, contentTypeJSON, prepareParams(t, params)); err == nil {
+			resp.Body.Close()
+		}
+		listed := func(token string) string {
+			req, _ := http.NewRequest(http.MethodGet, lockouts.URL, nil)
+			req.Header.Add("Authorization", "Bearer "+token)
+			r := doRequest(req, nil)
+			assertStatus(t, 200, r)
+			return string(r.body)
+		}
+		if body := listed(token); strings.Contains(body, "other-admin@mail.com") || strings.Contains(body, `"ip"`) {
+			t.Errorf("an admin should not see the lockouts of staff: %s", body)
+		}
+		if body := listed(bossToken); !strings.Contains(body, "other-admin@mail.com") {
+			t.Errorf("a superadmin should see the lockouts of staff: %s", body)
+		}
+		req, _ := http.NewRequest(http.MethodPost, clear.URL, prepareParams(t, map[string]interface{}{"email": "other-admin@mail.com"}))
+		req.Header.Add("Authorization", "Bearer "+token)
+		assertStatus(t, 403, doRequest(req, nil))
+	})
+
+	t.Run("unknown accounts are throttled too", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			params := map[string]interface{}{"email": "nobody@mail.com", "password": "wrong"}
+			if resp, err := http.Post(login.URL, contentTypeJSON, prepareParams(t, params)); err == nil {
+				resp.Body.Close()
+			}
+		}
+		if a, _ := loginAttempts.Get(AttemptKey{AttemptsAccount, "nobody@mail.com"}); !a.locked(time.Now()) {
+			t.Errorf("Unexpected attempts: %+v", a)
+		}
+	})
+}
@@ -2,16 +2,92 @@ package main
 
 import (
 	"bytes"
-	"errors"
+	"context"
+	"encoding/json"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// LogPolicy controls what ends up in the access log.
+type LogPolicy struct {
+	// RedactFields are JSON keys, at any depth of a request or response
+	// body, whose values are replaced. Matching ignores case.
+	RedactFields []string
+	// RedactHeaders are request headers whose values are replaced.
+	RedactHeaders []string
+	// MaxBodySize is the largest body that is logged, bigger bodies are
+	// only reported by size.
+	MaxBodySize int
+}
+
+const redacted = "[REDACTED]"
+
+func defaultLogPolicy() LogPolicy {
+	return LogPolicy{
+		RedactFields: []string{"password", "new_password", "token", "access_token", "refresh_token", "secret", "code", "key",
+			"client_secret", "id_token", "otpauth_uri", "recovery_codes", "challenge"},
+		RedactHeaders: []string{"Authorization", "Cookie", "X-Api-Key"},
+		MaxBodySize:   4096,
+	}
+}
+
+var logPolicy = defaultLogPolicy()
+
+var accessLog = log.New(os.Stdout, "", 0)
+
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMs float64   `json:"duration_ms"`
+	ClientIP   string    `json:"client_ip"`
+	User       string    `json:"user,omitempty"`
+	// ImpersonatedBy is the superadmin behind an impersonation token.
+	ImpersonatedBy string            `json:"impersonated_by,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Request        interface{}       `json:"request,omitempty"`
+	Response       interface{}       `json:"response,omitempty"`
+}
+
+// requestInfo travels in the request context so that inner middlewares can
+// report what they learned about the request back to logRequest.
+type requestInfo struct {
+	ID           string
+	User         string
+	Impersonator string
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFrom(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	if info == nil {
+		return &requestInfo{}
+	}
+	return info
+}
+
+func withRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+}
+
+// requestID returns the ID logRequest assigned to r.
+func requestID(r *http.Request) string {
+	return requestInfoFrom(r).ID
+}
+
 type logWriter struct {
 	http.ResponseWriter
 	statusCode int
+	size       int
 	response   bytes.Buffer
 }
 
@@ -20,25 +96,163 @@ func (w *logWriter) WriteHeader(status int) {
 	w.statusCode = status
 }
 func (w *logWriter) Write(p []byte) (int, error) {
-	w.response.Write(p)
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	w.size += len(p)
+	if w.response.Len() <= logPolicy.MaxBodySize {
+		w.response.Write(p)
+	}
 	return w.ResponseWriter.Write(p)
 }
+
 func logRequest(h http.HandlerFunc) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		writer := &logWriter{
 			ResponseWriter: rw,
 		}
+		info := &requestInfo{ID: incomingRequestID(r)}
+		if info.ID == "" {
+			info.ID, _ = randomToken(12)
+		}
+		rw.Header().Set("X-Request-ID", info.ID)
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			log.Println("Could not read request body", err)
-			handleError(errors.New("could not read request"), rw)
+			handleError(newBadRequestError("invalid_request", "could not read request"), rw)
 			return
 		}
 		r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		r = withRequestInfo(r, info)
 		started := time.Now()
 		h(writer, r)
 		done := time.Since(started)
-		log.Printf("PATH: %s -> %d. Finished in %v.\n\tParams: %s\n\tResponse: %s",
-			r.URL.Path, writer.statusCode, done, string(body), writer.response.String())
+		if writer.statusCode == 0 {
+			writer.statusCode = http.StatusOK
+		}
+		route := routeTemplate(r)
+		httpRequests.Inc(route, r.Method, strconv.Itoa(writer.statusCode))
+		httpDuration.Observe(done.Seconds(), route, r.Method)
+
+		entry := accessLogEntry{
+			Time:           started.UTC(),
+			RequestID:      info.ID,
+			Method:         r.Method,
+			Path:           r.URL.Path,
+			Status:         writer.statusCode,
+			DurationMs:     float64(done) / float64(time.Millisecond),
+			ClientIP:       clientIP(r),
+			User:           info.User,
+			ImpersonatedBy: info.Impersonator,
+			Headers:        redactHeaders(r.Header),
+			Request:        redactBody(body, len(body), false),
+			Response:       redactBody(writer.response.Bytes(), writer.size, true),
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			log.Println("Could not encode access log entry", err)
+			return
+		}
+		accessLog.Println(string(line))
+	}
+}
+
+// incomingRequestID accepts an ID set by a proxy in front of us as long as
+// it can't be used to forge log lines.
+func incomingRequestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if len(id) > 64 {
+		return ""
+	}
+	for _, c := range id {
+		if !(c == '-' || c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return ""
+		}
+	}
+	return id
+}
+
+// trustProxy makes the client IP the last X-Forwarded-For entry, the one
+// added by the proxy in front of the server. The others come from the
+// client, who can write anything there. The access log, the rate limits and
+// the lockouts all go by this IP.
+var trustProxy bool
+
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			if hop := strings.TrimSpace(hops[len(hops)-1]); hop != "" {
+				return hop
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func redactHeaders(h http.Header) map[string]string {
+	headers := make(map[string]string, len(h))
+	for name, values := range h {
+		headers[name] = strings.Join(values, ", ")
+	}
+	for _, name := range logPolicy.RedactHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if _, ok := headers[name]; ok {
+			headers[name] = redacted
+		}
+	}
+	return headers
+}
+
+// redactBody prepares a body for the log. JSON gets its sensitive fields
+// replaced. Other bodies are logged as is only if raw is set. Bodies which
+// are too big are only reported by size, because a truncated body can't be
+// redacted reliably.
+func redactBody(body []byte, size int, raw bool) interface{} {
+	if size == 0 {
+		return nil
+	}
+	omitted := "[" + strconv.Itoa(size) + " bytes omitted]"
+	if size > logPolicy.MaxBodySize {
+		return omitted
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		if raw {
+			return string(body)
+		}
+		return omitted
+	}
+	return redactValue(v)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, inner := range value {
+			if isRedactedField(key) {
+				value[key] = redacted
+			} else {
+				value[key] = redactValue(inner)
+			}
+		}
+	case []interface{}:
+		for i, inner := range value {
+			value[i] = redactValue(inner)
+		}
+	}
+	return v
+}
+
+func isRedactedField(key string) bool {
+	for _, field := range logPolicy.RedactFields {
+		if strings.EqualFold(key, field) {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func captureAccessLog(t *testing.T) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	old := accessLog
+	accessLog = log.New(buf, "", 0)
+	t.Cleanup(func() { accessLog = old })
+	return buf
+}
+
+func TestLogRequest(t *testing.T) {
+	doRequest := createRequester(t)
+	t.Run("redacts secrets", func(t *testing.T) {
+		buf := captureAccessLog(t)
+		h := logRequest(func(w http.ResponseWriter, r *http.Request) {
+			requestInfoFrom(r).User = "test@mail.com"
+			writeJSON(w, http.StatusOK, TokenPair{AccessToken: "access-secret", RefreshToken: "refresh-secret"})
+		})
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+		params := map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/user/jwt", prepareParams(t, params))
+		req.Header.Add("Authorization", "Bearer header-secret")
+		req.Header.Add("X-Request-ID", "abc-123")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res.Body.Close()
+		if res.Header.Get("X-Request-ID") != "abc-123" {
+			t.Errorf("request id was not echoed")
+		}
+
+		line := buf.String()
+		for _, secret := range []string{"somepass", "access-secret", "refresh-secret", "header-secret"} {
+			if strings.Contains(line, secret) {
+				t.Errorf("log line contains %q: %s", secret, line)
+			}
+		}
+		entry := accessLogEntry{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %v", err)
+		}
+		if entry.RequestID != "abc-123" || entry.User != "test@mail.com" || entry.Status != 200 || entry.Path != "/user/jwt" {
+			t.Errorf("Unexpected entry: %+v", entry)
+		}
+		if entry.ClientIP != "127.0.0.1" {
+			t.Errorf("Unexpected client ip: %s", entry.ClientIP)
+		}
+	})
+
+	t.Run("redacts two-factor secrets", func(t *testing.T) {
+		buf := captureAccessLog(t)
+		ts := httptest.NewServer(logRequest(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/user/2fa/enroll":
+				writeJSON(w, http.StatusCreated, TwoFactorEnrollment{Secret: "totp-secret", URI: "otpauth://totp/cake:test?secret=uri-secret"})
+			case "/user/2fa/recovery-codes":
+				writeJSON(w, http.StatusCreated, RecoveryCodes{Codes: []string{"recovery-one", "recovery-two"}})
+			default:
+				writeJSON(w, http.StatusOK, TwoFactorChallenge{Challenge: "challenge-secret"})
+			}
+		}))
+		defer ts.Close()
+		for _, path := range []string{"/user/2fa/enroll", "/user/2fa/recovery-codes", "/user/jwt"} {
+			res, err := http.Post(ts.URL+path, "application/json", strings.NewReader("{}"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			res.Body.Close()
+		}
+		doRequest(http.NewRequest(http.MethodPost, ts.URL+"/user/jwt/2fa",
+			prepareParams(t, map[string]interface{}{"challenge": "challenge-secret", "code": "123456"})))
+
+		lines := buf.String()
+		for _, secret := range []string{"totp-secret", "uri-secret", "recovery-one", "recovery-two", "challenge-secret", "123456"} {
+			if strings.Contains(lines, secret) {
+				t.Errorf("log contains %q: %s", secret, lines)
+			}
+		}
+	})
+
+	t.Run("client ip is the hop added by the proxy", func(t *testing.T) {
+		defer func(old bool) { trustProxy = old }(trustProxy)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "10.0.0.2:4321"
+		r.Header.Add("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+		r.Header.Add("X-Forwarded-For", "9.9.9.9")
+		if ip := clientIP(r); ip != "10.0.0.2" {
+			t.Errorf("Unexpected client ip without a trusted proxy: %s", ip)
+		}
+		trustProxy = true
+		if ip := clientIP(r); ip != "9.9.9.9" {
+			t.Errorf("Unexpected client ip: %s", ip)
+		}
+	})
+
+	t.Run("omits big bodies", func(t *testing.T) {
+		buf := captureAccessLog(t)
+		h := logRequest(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strings.Repeat("a", logPolicy.MaxBodySize+1)))
+		})
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+		doRequest(http.NewRequest(http.MethodGet, ts.URL, nil))
+		entry := accessLogEntry{}
+		json.Unmarshal(buf.Bytes(), &entry)
+		if entry.Response != "[4097 bytes omitted]" {
+			t.Errorf("Unexpected response: %v", entry.Response)
+		}
+		if entry.RequestID == "" {
+			t.Errorf("request id was not generated")
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers mails. The outboxes below only keep them, which is
+// enough for local development and tests.
+type Mailer interface {
+	Send(Mail) error
+}
+
+type InMemoryOutbox struct {
+	lock  sync.Mutex
+	mails []Mail
+}
+
+func NewInMemoryOutbox() *InMemoryOutbox {
+	return &InMemoryOutbox{}
+}
+
+func (o *InMemoryOutbox) Send(m Mail) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.mails = append(o.mails, m)
+	return nil
+}
+
+// Mails returns the mails sent to, oldest first.
+func (o *InMemoryOutbox) Mails(to string) []Mail {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	mails := []Mail{}
+	for _, m := range o.mails {
+		if m.To == to {
+			mails = append(mails, m)
+		}
+	}
+	return mails
+}
+
+// FileOutbox writes every mail to its own file of Dir, named after the time
+// it was sent and its recipient.
+type FileOutbox struct {
+	Dir string
+	now func() time.Time
+}
+
+func NewFileOutbox(dir string) (*FileOutbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileOutbox{Dir: dir, now: time.Now}, nil
+}
+
+func (o *FileOutbox) Send(m Mail) error {
+	name := o.now().UTC().Format("20060102T150405.000000000") + "-" + m.To + ".eml"
+	content := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s\r\n", m.To, m.Subject, m.Body)
+	return ioutil.WriteFile(filepath.Join(o.Dir, filepath.Base(name)), []byte(content), 0600)
+}
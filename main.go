@@ -6,15 +6,24 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"time"
 
 	"github.com/gorilla/mux"
 )
 
+type UserProfile struct {
+	Email        string `json:"email"`
+	FavoriteCake string `json:"favorite_cake"`
+}
+
 func getMyData(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
-	w.Write([]byte(u.Email))
-	w.Write([]byte("\n"))
-	w.Write([]byte(u.FavoriteCake))
+	if negotiate(r, contentTypeJSON, contentTypePlain) == contentTypePlain {
+		w.Header().Set("Content-Type", contentTypePlain)
+		w.Write([]byte(u.Email))
+		w.Write([]byte("\n"))
+		w.Write([]byte(u.FavoriteCake))
+		return
+	}
+	writeJSON(w, http.StatusOK, UserProfile{Email: u.Email, FavoriteCake: u.FavoriteCake})
 }
 
 func wrapJwt(jwt *JWTService, f func(http.ResponseWriter, *http.Request, *JWTService)) http.HandlerFunc {
@@ -23,54 +32,219 @@ func wrapJwt(jwt *JWTService, f func(http.ResponseWriter, *http.Request, *JWTSer
 	}
 }
 
+// openStorage creates the user repository and wires the token stores of
+// jwtService, the revocations, the sessions, the audit log, the password
+// resets, the two-factor setups, the API keys and the OAuth clients and
+// codes to the same backend.
+func openStorage(cfg *Config, jwtService *JWTService) (UserRepository, func() error, error) {
+	if cfg.Storage == StorageMemory {
+		jwtService.RefreshTokens = NewInMemoryRefreshTokenStore()
+		revocations = NewInMemoryRevocationStore()
+		sessions = NewInMemorySessionStore()
+		auditLog = NewInMemoryAuditStore()
+		passwordResets = NewInMemoryPasswordResetStore()
+		twoFactors = NewInMemoryTwoFactorStore()
+		apiKeys = NewInMemoryAPIKeyStore()
+		oauthClients = NewInMemoryOAuthClientStore()
+		authorizationCodes = NewInMemoryAuthorizationCodeStore()
+		return NewInMemoryUserStorage(), func() error { return nil }, nil
+	}
+	users, err := NewSQLiteUserStorage(cfg.DatabasePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	jwtService.RefreshTokens, err = NewSQLiteRefreshTokenStore(users.db)
+	if err != nil {
+		users.Close()
+		return nil, nil, err
+	}
+	revocations, err = NewSQLiteRevocationStore(users.db)
+	if err != nil {
+		users.Close()
+		return nil, nil, err
+	}
+	sessions, err = NewSQLiteSessionStore(users.db)
+	if err != nil {
+		users.Close()
+		return nil, nil, err
+	}
+	auditLog, err = NewSQLiteAuditStore(users.db, cfg.Audit.HeadPath)
+	if err != nil {
+		users.Close()
+		return nil, nil, err
+	}
+	passwordResets, err = NewSQLitePasswordResetStore(users.db)
+	if err != nil {
+		users.Close()
+		return nil, nil, err
+	}
+	twoFactors, err = NewSQLiteTwoFactorStore(users.db)
+	if err != nil {
+		users.Close()
+		return nil, nil, err
+	}
+	apiKeys, err = NewSQLiteAPIKeyStore(users.db)
+	if err != nil {
+		users.Close()
+		return nil, nil, err
+	}
+	oauthClients, err = NewSQLiteOAuthClientStore(users.db)
+	if err != nil {
+		users.Close()
+		return nil, nil, err
+	}
+	authorizationCodes, err = NewSQLiteAuthorizationCodeStore(users.db)
+	if err != nil {
+		users.Close()
+		return nil, nil, err
+	}
+	return users, users.Close, nil
+}
+
 func main() {
-	os.Setenv("CAKE_ADMIN_EMAIL", "admin@gmail.com")
-	os.Setenv("CAKE_ADMIN_PASSWORD", "pass")
-	os.Setenv("CAKE_ADMIN_CAKE", "cake")
+	cfg, err := LoadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Dev {
+		log.Println("Running in dev mode, insecure settings are allowed")
+	}
+	logPolicy.MaxBodySize = cfg.LogMaxBodySize
+	trustProxy = cfg.TrustProxy
+	auditKey = []byte(cfg.Audit.Key)
 	r := mux.NewRouter()
-	users := NewInMemoryUserStorage()
+	roles, err = LoadRoles(cfg.RolesPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jwtService, err := NewJWTService(cfg.PrivateKeyPath, cfg.PublicKeyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jwtService.AccessTTL = cfg.AccessTokenTTL.Duration
+	jwtService.RefreshTTL = cfg.RefreshTokenTTL.Duration
+	jwtService.ImpersonationTTL = cfg.ImpersonationTTL.Duration
+	jwtService.keys.Overlap = cfg.KeyRotation.Overlap.Duration
+	if cfg.KeyRotation.Interval.Duration > 0 {
+		if err := jwtService.keys.Load(cfg.KeyRotation.Dir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	users, closeStorage, err := openStorage(cfg, jwtService)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeStorage()
 	userService := UserService{repository: users}
-	Superadmin := User{os.Getenv("CAKE_ADMIN_EMAIL"), os.Getenv("CAKE_ADMIN_PASSWORD"),
-		os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}}
-	users.Add(Superadmin.Email, Superadmin)
-	jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+	outbox, err := NewFileOutbox(cfg.MailOutbox)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-	r.HandleFunc("/user/me", logRequest(jwtService.jwtAuth(users, getMyData))).Methods(http.MethodGet)
-	r.HandleFunc("/user/favorite_cake", logRequest(jwtService.jwtAuth(users, changeCakeHandler))).Methods(http.MethodPut)
-	r.HandleFunc("/user/email", logRequest(jwtService.jwtAuth(users, changeEmailHandler))).Methods(http.MethodPut)
-	r.HandleFunc("/user/password", logRequest(jwtService.jwtAuth(users, changePassHandler))).Methods(http.MethodPut)
-	r.HandleFunc("/user/register", logRequest(userService.Register)).Methods(http.MethodPost)
-	r.HandleFunc("/user/jwt", logRequest(wrapJwt(jwtService, userService.JWT))).Methods(http.MethodPost)
+	emailVerification = NewEmailVerifier(jwtService, outbox)
+	emailVerification.TTL = cfg.Verification.TTL.Duration
+	emailVerification.URL = cfg.Verification.URL
+	emailVerification.Required = cfg.Verification.Required
+	passwordReset = NewPasswordResetter(outbox)
+	passwordReset.TTL = cfg.PasswordReset.TTL.Duration
+	passwordReset.URL = cfg.PasswordReset.URL
+	twoFactorPolicy.Issuer = cfg.TwoFactor.Issuer
+	twoFactorPolicy.RequiredForStaff = cfg.TwoFactor.RequiredForStaff
+	twoFactorPolicy.ChallengeTTL = cfg.TwoFactor.ChallengeTTL.Duration
+	oidc := NewOIDCProvider(jwtService, users)
+	oidc.Issuer = cfg.OIDC.Issuer
+	oidc.LoginURL = cfg.OIDC.LoginURL
+	oidc.CodeTTL = cfg.OIDC.CodeTTL.Duration
+	limiter := NewRateLimiter(cfg.RateLimits, jwtService.tokenSubject)
+	if cfg.Superadmin.Email != "" {
+		adminDigest, err := hashPassword(cfg.Superadmin.Password)
+		if err != nil {
+			log.Fatal(err)
+		}
+		Superadmin := User{cfg.Superadmin.Email, adminDigest,
+			cfg.Superadmin.FavoriteCake, RoleSuperadmin, false, BanHistory{}, "", ""}
+		if err := users.Add(Superadmin.Email, Superadmin); err != nil && err != ErrUserExists {
+			log.Fatal(err)
+		}
+	}
+	r.HandleFunc("/user/me", logRequest(limiter.Limit(jwtService.jwtAuthorize(users, getMyData)))).Methods(http.MethodGet)
+	r.HandleFunc("/user/favorite_cake", logRequest(limiter.Limit(jwtService.jwtAuthorize(users, changeCakeHandler)))).Methods(http.MethodPut)
+	r.HandleFunc("/user/email", logRequest(limiter.Limit(jwtService.jwtAuthorize(users, sessionOnly(changeEmailHandler))))).Methods(http.MethodPut)
+	r.HandleFunc("/user/password", logRequest(limiter.Limit(jwtService.jwtAuthorize(users, sessionOnly(changePassHandler))))).Methods(http.MethodPut)
+	r.HandleFunc("/user/password/forgot", logRequest(limiter.Limit(userService.ForgotPassword))).Methods(http.MethodPost)
+	r.HandleFunc("/user/password/reset", logRequest(limiter.Limit(userService.ResetPassword))).Methods(http.MethodPost)
+	r.HandleFunc("/.well-known/jwks.json", logRequest(limiter.Limit(jwksHandler(jwtService)))).Methods(http.MethodGet)
+	r.HandleFunc("/user/register", logRequest(limiter.Limit(userService.Register))).Methods(http.MethodPost)
+	r.HandleFunc("/user/jwt", logRequest(limiter.Limit(wrapJwt(jwtService, userService.JWT)))).Methods(http.MethodPost)
+	r.HandleFunc("/user/verify", logRequest(limiter.Limit(userService.Verify))).Methods(http.MethodGet, http.MethodPost)
+	r.HandleFunc("/user/verify/resend", logRequest(limiter.Limit(userService.ResendVerification))).Methods(http.MethodPost)
+	r.HandleFunc("/user/jwt/2fa", logRequest(limiter.Limit(wrapJwt(jwtService, userService.JWTTwoFactor)))).Methods(http.MethodPost)
+	r.HandleFunc("/user/2fa/enroll", logRequest(limiter.Limit(jwtService.jwtAuthorize(users, sessionOnly(enrollTwoFactorHandler))))).Methods(http.MethodPost)
+	r.HandleFunc("/user/2fa/confirm", logRequest(limiter.Limit(jwtService.jwtAuthorize(users, sessionOnly(confirmTwoFactorHandler))))).Methods(http.MethodPost)
+	r.HandleFunc("/user/2fa/recovery_codes", logRequest(limiter.Limit(jwtService.jwtAuthorize(users, sessionOnly(recoveryCodesHandler))))).Methods(http.MethodPost)
+	r.HandleFunc("/user/2fa/disable", logRequest(limiter.Limit(jwtService.jwtAuthorize(users, sessionOnly(disableTwoFactorHandler))))).Methods(http.MethodPost)
+	r.HandleFunc("/user/sessions", logRequest(limiter.Limit(jwtService.jwtAuthorize(users, listSessionsHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/user/logout", logRequest(limiter.Limit(jwtService.jwtAuthorize(users, logoutHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/user/sessions/logout_others", logRequest(limiter.Limit(jwtService.jwtAuthorize(users, logoutOthersHandler)))).Methods(http.MethodPost)
+	r.HandleFunc("/user/api_keys", logRequest(limiter.Limit(jwtService.jwtAuthorize(users, sessionOnly(createAPIKeyHandler))))).Methods(http.MethodPost)
+	r.HandleFunc("/user/api_keys", logRequest(limiter.Limit(jwtService.jwtAuthorize(users, listAPIKeysHandler)))).Methods(http.MethodGet)
+	r.HandleFunc("/user/api_keys/{id}", logRequest(limiter.Limit(jwtService.jwtAuthorize(users, sessionOnly(revokeAPIKeyHandler))))).Methods(http.MethodDelete)
+	r.HandleFunc("/user/jwt/refresh", logRequest(limiter.Limit(wrapJwt(jwtService, userService.Refresh)))).Methods(http.MethodPost)
+
+	r.HandleFunc("/admin/ban", logRequest(limiter.Limit(audited("user.ban", jwtService.jwtAuthorize(users, banHandler, PermUsersBan))))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/unban", logRequest(limiter.Limit(audited("user.unban", jwtService.jwtAuthorize(users, unbanHandler, PermUsersUnban))))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/users", logRequest(limiter.Limit(audited("users.list", jwtService.jwtAuthorize(users, listUsersHandler, PermUsersInspect))))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/users/{email}/bans", logRequest(limiter.Limit(audited("user.bans", jwtService.jwtAuthorize(users, banEventsHandler, PermUsersInspect))))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/users/{email}/bans/appeal", logRequest(limiter.Limit(audited("user.appeal", jwtService.jwtAuthorize(users, appealHandler, PermUsersUnban))))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/impersonate", logRequest(limiter.Limit(audited("user.impersonate", jwtService.jwtAuthorize(users, jwtService.impersonateHandler, PermUsersImpersonate))))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/inspect", logRequest(limiter.Limit(audited("user.inspect", jwtService.jwtAuthorize(users, inspectHandler, PermUsersInspect))))).Methods(http.MethodGet)
+
+	r.HandleFunc("/admin/lockouts", logRequest(limiter.Limit(audited("lockouts.list", jwtService.jwtAuthorize(users, lockoutsHandler, PermUsersInspect))))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/lockouts/clear", logRequest(limiter.Limit(audited("lockouts.clear", jwtService.jwtAuthorize(users, clearLockoutHandler, PermUsersUnban))))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/audit", logRequest(limiter.Limit(audited("audit.query", jwtService.jwtAuthorize(users, auditQueryHandler, PermAuditRead))))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/audit/verify", logRequest(limiter.Limit(audited("audit.verify", jwtService.jwtAuthorize(users, auditVerifyHandler, PermAuditRead))))).Methods(http.MethodGet)
 
-	r.HandleFunc("/admin/ban", logRequest(jwtService.jwtAuthAdmin(users, banHandler))).Methods(http.MethodPost)
-	r.HandleFunc("/admin/unban", logRequest(jwtService.jwtAuthAdmin(users, unbanHandler))).Methods(http.MethodPost)
-	r.HandleFunc("/admin/inspect", logRequest(jwtService.jwtAuthAdmin(users, inspectHandler))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/fire", logRequest(limiter.Limit(audited("admin.fire", jwtService.jwtAuthorize(users, fireHandler, PermAdminsFire))))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/promote", logRequest(limiter.Limit(audited("admin.promote", jwtService.jwtAuthorize(users, promoteHandler, PermAdminsPromote))))).Methods(http.MethodPost)
 
-	r.HandleFunc("/admin/fire", logRequest(jwtService.jwtAuthSuperadmin(users, fireHandler))).Methods(http.MethodPost)
-	r.HandleFunc("/admin/promote", logRequest(jwtService.jwtAuthSuperadmin(users, promoteHandler))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/oauth/clients", logRequest(limiter.Limit(audited("oauth_client.create", jwtService.jwtAuthorize(users, createOAuthClientHandler, PermClientsManage))))).Methods(http.MethodPost)
+	r.HandleFunc("/admin/oauth/clients", logRequest(limiter.Limit(audited("oauth_clients.list", jwtService.jwtAuthorize(users, listOAuthClientsHandler, PermClientsManage))))).Methods(http.MethodGet)
+	r.HandleFunc("/admin/oauth/clients/{id}", logRequest(limiter.Limit(audited("oauth_client.delete", jwtService.jwtAuthorize(users, deleteOAuthClientHandler, PermClientsManage))))).Methods(http.MethodDelete)
+
+	r.HandleFunc("/.well-known/openid-configuration", logRequest(limiter.Limit(oidc.Discovery))).Methods(http.MethodGet)
+	r.HandleFunc("/oauth/authorize", logRequest(limiter.Limit(oidc.Authorize))).Methods(http.MethodGet)
+	r.HandleFunc("/oauth/token", logRequest(limiter.Limit(oidc.Token))).Methods(http.MethodPost)
+	r.HandleFunc("/oauth/userinfo", logRequest(limiter.Limit(oidc.UserInfo))).Methods(http.MethodGet, http.MethodPost)
+
+	r.HandleFunc("/metrics", jwtService.jwtAuthorize(users, metricsHandler, PermMetricsRead)).Methods(http.MethodGet)
 
 	srv := http.Server{
-		Addr:    ":8080",
+		Addr:    cfg.ListenAddr,
 		Handler: r,
 	}
 
+	scheduler, stopScheduler := context.WithCancel(context.Background())
+	defer stopScheduler()
+	go runBanExpiry(scheduler, users, cfg.BanExpiryInterval.Duration)
+	if cfg.KeyRotation.Interval.Duration > 0 {
+		go runKeyRotation(scheduler, jwtService.keys, cfg.KeyRotation.Interval.Duration)
+	}
+
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 
 	go func() {
 		<-interrupt
+		stopScheduler()
 		ctx, cancel := context.WithTimeout(context.Background(),
-			5*time.Second)
+			cfg.ShutdownTimeout.Duration)
 		defer cancel()
 		srv.Shutdown(ctx)
 	}()
 
 	log.Println("Server started, hit Ctrl+C to stop")
 	err = srv.ListenAndServe()
-	if err != nil {
-		log.Println("Server exited with error:", srv.ListenAndServe())
+	if err != nil && err != http.ErrServerClosed {
+		log.Println("Server exited with error:", err)
 	}
 	log.Println("Good bye :)")
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// This is a small implementation of the Prometheus text exposition format,
+// enough for counters, histograms and gauges computed at scrape time.
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[strings.Join(labelValues, "\x00")]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	values map[string]*histogram
+}
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	key := strings.Join(labelValues, "\x00")
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatFloat(bound)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), hist.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLabels(names []string, key string, extraName, extraValue string) string {
+	pairs := []string{}
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, names[i]+"="+strconv.Quote(value))
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+strconv.Quote(extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	httpRequests = newCounterVec("http_requests_total",
+		"Number of HTTP requests by route, method and status.", "route", "method", "status")
+	httpDuration = newHistogramVec("http_request_duration_seconds",
+		"HTTP request latency by route and method.", defaultBuckets, "route", "method")
+
+	registrations = newCounterVec("cake_registrations_total", "Number of registered users.")
+	logins        = newCounterVec("cake_logins_total", "Number of login attempts by result.", "result")
+	bans          = newCounterVec("cake_bans_total", "Number of bans.")
+	unbans        = newCounterVec("cake_unbans_total", "Number of unbans.")
+	promotions    = newCounterVec("cake_promotions_total", "Number of users promoted to admin.")
+	fires         = newCounterVec("cake_fires_total", "Number of admins fired.")
+)
+
+// UserStats are the user gauges, repositories able to compute them
+// implement UserStatsProvider.
+type UserStats struct {
+	Total  int
+	Banned int
+	Admins int
+}
+
+type UserStatsProvider interface {
+	Stats() (UserStats, error)
+}
+
+// routeTemplate names the mux route which matched r, raw paths would give
+// every user email its own time series.
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "unknown"
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return "unknown"
+	}
+	return template
+}
+
+// metricsHandler serves the metrics to holders of PermMetricsRead, the user
+// gauges are not for everyone to see.
+func metricsHandler(w http.ResponseWriter, r *http.Request, u User, users UserRepository) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	httpRequests.write(w)
+	httpDuration.write(w)
+	for _, c := range []*counterVec{registrations, logins, bans, unbans, promotions, fires} {
+		c.write(w)
+	}
+	provider, ok := users.(UserStatsProvider)
+	if !ok {
+		return
+	}
+	stats, err := provider.Stats()
+	if err != nil {
+		return
+	}
+	writeGauge(w, "cake_users", "Number of users.", float64(stats.Total))
+	writeGauge(w, "cake_users_banned", "Number of banned users.", float64(stats.Banned))
+	writeGauge(w, "cake_users_admins", "Number of admins and superadmins.", float64(stats.Admins))
+}
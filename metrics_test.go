@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMetrics(t *testing.T) {
+	doRequest := createRequester(t)
+	captureAccessLog(t)
+	u := newTestUserService()
+	u.repository.Add("admin@mail.com", User{Email: "admin@mail.com", Role: RoleSuperadmin})
+	u.repository.Add("banned@mail.com", User{Email: "banned@mail.com", Banned: true})
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/user/register", logRequest(u.Register)).Methods(http.MethodPost)
+	r.HandleFunc("/metrics", j.jwtAuthorize(u.repository, metricsHandler, PermMetricsRead)).Methods(http.MethodGet)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	params := map[string]interface{}{
+		"email":         "metrics@mail.com",
+		"password":      "somepass",
+		"favorite_cake": "cake",
+	}
+	doRequest(http.NewRequest(http.MethodPost, ts.URL+"/user/register", prepareParams(t, params)))
+
+	resp := doRequest(http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil))
+	assertStatus(t, 401, resp)
+
+	user, _ := u.repository.Get("metrics@mail.com")
+	token, _ := j.GenearateJWT(user)
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp = doRequest(req, err)
+	assertStatus(t, 403, resp)
+
+	admin, _ := u.repository.Get("admin@mail.com")
+	token, _ = j.GenearateJWT(admin)
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp = doRequest(req, err)
+	assertStatus(t, 200, resp)
+	body := string(resp.body)
+	for _, expected := range []string{
+		`http_requests_total{route="/user/register",method="POST",status="201"}`,
+		`http_request_duration_seconds_bucket{route="/user/register",method="POST",le="+Inf"}`,
+		"# TYPE cake_registrations_total counter",
+		"cake_users 3\n",
+		"cake_users_banned 1\n",
+		"cake_users_admins 1\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("metrics do not contain %q:\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// OAuthClient is an app signing its users in with their cake account.
+// Public clients, like single page apps, have no secret. Only the hash of
+// the secret is stored.
+type OAuthClient struct {
+	ID           string
+	SecretHash   string
+	Name         string
+	RedirectURIs []string
+	CreatedAt    time.Time
+}
+
+func (c OAuthClient) public() bool {
+	return c.SecretHash == ""
+}
+
+// allowsRedirect only accepts the exact registered URIs.
+func (c OAuthClient) allowsRedirect(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if uri == registered {
+			return true
+		}
+	}
+	return false
+}
+
+func (c OAuthClient) checkSecret(secret string) bool {
+	if c.public() {
+		return secret == ""
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(c.SecretHash)) == 1
+}
+
+type OAuthClientStore interface {
+	Save(OAuthClient) error
+	Get(id string) (OAuthClient, error)
+	// List returns the clients, oldest first.
+	List() ([]OAuthClient, error)
+	Delete(id string) error
+}
+
+var oauthClients OAuthClientStore = NewInMemoryOAuthClientStore()
+
+var errOAuthClientNotFound = newNotFoundError("oauth_client_not_found", "This client doesn't exist")
+
+type CreateOAuthClientParams struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	// Public clients can't keep a secret, PKCE alone protects their codes.
+	Public bool `json:"public"`
+}
+
+type OAuthClientRecord struct {
+	ID           string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"created_at"`
+	// Secret is only given once, on creation.
+	Secret string `json:"client_secret,omitempty"`
+}
+
+func newOAuthClientRecord(c OAuthClient) OAuthClientRecord {
+	return OAuthClientRecord{ID: c.ID, Name: c.Name, RedirectURIs: c.RedirectURIs, Public: c.public(), CreatedAt: c.CreatedAt}
+}
+
+type OAuthClientsResponse struct {
+	Clients []OAuthClientRecord `json:"clients"`
+}
+
+// validateRedirectURI accepts https URIs, and http ones on the loopback for
+// apps running locally.
+func validateRedirectURI(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+		return newValidationError("redirect_uris", "Invalid redirect URI "+raw)
+	}
+	host := u.Hostname()
+	loopback := host == "localhost" || net.ParseIP(host) != nil && net.ParseIP(host).IsLoopback()
+	if u.Scheme != "https" && !(u.Scheme == "http" && loopback) {
+		return newValidationError("redirect_uris", "Redirect URIs must use https, or http on localhost")
+	}
+	return nil
+}
+
+func validateOAuthClientParams(p *CreateOAuthClientParams) error {
+	if strings.TrimSpace(p.Name) == "" || len(p.Name) > 64 {
+		return newValidationError("name", "Name the client in 1 to 64 characters")
+	}
+	if len(p.RedirectURIs) == 0 {
+		return newValidationError("redirect_uris", "Register at least one redirect URI")
+	}
+	for _, uri := range p.RedirectURIs {
+		if err := validateRedirectURI(uri); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createOAuthClientHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	params := &CreateOAuthClientParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(ErrInvalidParams, w)
+		return
+	}
+	if err := validateOAuthClientParams(params); err != nil {
+		handleError(err, w)
+		return
+	}
+	id, err := randomToken(16)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	client := OAuthClient{
+		ID:           id,
+		Name:         params.Name,
+		RedirectURIs: append([]string{}, params.RedirectURIs...),
+		CreatedAt:    time.Now(),
+	}
+	secret := ""
+	if !params.Public {
+		secret, err = randomToken(32)
+		if err != nil {
+			handleError(err, w)
+			return
+		}
+		client.SecretHash = hashToken(secret)
+	}
+	if err := oauthClients.Save(client); err != nil {
+		handleError(err, w)
+		return
+	}
+	record := newOAuthClientRecord(client)
+	record.Secret = secret
+	writeJSON(w, http.StatusCreated, record)
+}
+
+func listOAuthClientsHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	clients, err := oauthClients.List()
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	resp := OAuthClientsResponse{Clients: []OAuthClientRecord{}}
+	for _, c := range clients {
+		resp.Clients = append(resp.Clients, newOAuthClientRecord(c))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	if err := oauthClients.Delete(mux.Vars(r)["id"]); err != nil {
+		handleError(err, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("The client have been deleted"))
+}
+
+type InMemoryOAuthClientStore struct {
+	lock    sync.Mutex
+	clients map[string]OAuthClient
+}
+
+func NewInMemoryOAuthClientStore() *InMemoryOAuthClientStore {
+	return &InMemoryOAuthClientStore{clients: make(map[string]OAuthClient)}
+}
+
+func (i *InMemoryOAuthClientStore) Save(c OAuthClient) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.clients[c.ID] = c
+	return nil
+}
+
+func (i *InMemoryOAuthClientStore) Get(id string) (OAuthClient, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	c, ok := i.clients[id]
+	if !ok {
+		return OAuthClient{}, errOAuthClientNotFound
+	}
+	return c, nil
+}
+
+func (i *InMemoryOAuthClientStore) List() ([]OAuthClient, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	clients := []OAuthClient{}
+	for _, c := range i.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(a, b int) bool { return clients[a].CreatedAt.Before(clients[b].CreatedAt) })
+	return clients, nil
+}
+
+func (i *InMemoryOAuthClientStore) Delete(id string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if _, ok := i.clients[id]; !ok {
+		return errOAuthClientNotFound
+	}
+	delete(i.clients, id)
+	return nil
+}
+
+const oauthClientsSchema = `
+CREATE TABLE IF NOT EXISTS oauth_clients (
+	id            TEXT PRIMARY KEY,
+	secret_hash   TEXT NOT NULL DEFAULT '',
+	name          TEXT NOT NULL,
+	redirect_uris TEXT NOT NULL DEFAULT '[]',
+	created_at    DATETIME NOT NULL
+);
+`
+
+type SQLiteOAuthClientStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteOAuthClientStore(db *sql.DB) (*SQLiteOAuthClientStore, error) {
+	if _, err := db.Exec(oauthClientsSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteOAuthClientStore{db: db}, nil
+}
+
+func (s *SQLiteOAuthClientStore) Save(c OAuthClient) error {
+	uris, err := json.Marshal(append([]string{}, c.RedirectURIs...))
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO oauth_clients (id, secret_hash, name, redirect_uris, created_at)
+		VALUES (?, ?, ?, ?, ?)`, c.ID, c.SecretHash, c.Name, string(uris), c.CreatedAt)
+	return err
+}
+
+func scanOAuthClient(row rowScanner) (OAuthClient, error) {
+	c := OAuthClient{}
+	var uris string
+	if err := row.Scan(&c.ID, &c.SecretHash, &c.Name, &uris, &c.CreatedAt); err != nil {
+		return OAuthClient{}, err
+	}
+	if err := json.Unmarshal([]byte(uris), &c.RedirectURIs); err != nil {
+		return OAuthClient{}, err
+	}
+	return c, nil
+}
+
+func (s *SQLiteOAuthClientStore) Get(id string) (OAuthClient, error) {
+	c, err := scanOAuthClient(s.db.QueryRow(`SELECT id, secret_hash, name, redirect_uris, created_at
+		FROM oauth_clients WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return OAuthClient{}, errOAuthClientNotFound
+	}
+	return c, err
+}
+
+func (s *SQLiteOAuthClientStore) List() ([]OAuthClient, error) {
+	rows, err := s.db.Query(`SELECT id, secret_hash, name, redirect_uris, created_at
+		FROM oauth_clients ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	clients := []OAuthClient{}
+	for rows.Next() {
+		c, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+func (s *SQLiteOAuthClientStore) Delete(id string) error {
+	res, err := s.db.Exec(`DELETE FROM oauth_clients WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errOAuthClientNotFound
+	}
+	return nil
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// The OpenID Connect provider lets other apps sign their users in with
+// their cake account. It only implements the authorization code flow with
+// PKCE: the app sends the browser to /oauth/authorize, which answers with a
+// single-use code for the signed in user, and exchanges the code for an ID
+// token and an access token of /oauth/userinfo at /oauth/token. The clients
+// are first-party apps registered by the admins, so there is no consent
+// screen.
+const (
+	defaultOIDCIssuer           = "http://localhost:8080"
+	defaultAuthorizationCodeTTL = time.Minute
+	oauthAccessAudience         = "oauth_userinfo"
+
+	scopeOpenID = "openid"
+	scopeEmail  = "email"
+	scopeCake   = "cake"
+)
+
+var supportedScopes = []string{scopeOpenID, scopeEmail, scopeCake}
+
+// pkceValue matches both S256 challenges and verifiers, which are 43 to 128
+// unreserved characters.
+var pkceValue = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+// AuthorizationCode is what /oauth/authorize granted, waiting to be
+// exchanged. Only the hash of the code is stored.
+type AuthorizationCode struct {
+	Hash        string
+	ClientID    string
+	Email       string
+	RedirectURI string
+	Scope       string
+	Nonce       string
+	Challenge   string
+	ExpiresAt   time.Time
+	Used        bool
+}
+
+type AuthorizationCodeStore interface {
+	Save(AuthorizationCode) error
+	Get(hash string) (AuthorizationCode, error)
+	// Use flags the code as used and returns it. A code used before is
+	// returned along with errAuthorizationCodeUsed, so the tokens it gave
+	// can be revoked.
+	Use(hash string) (AuthorizationCode, error)
+}
+
+var authorizationCodes AuthorizationCodeStore = NewInMemoryAuthorizationCodeStore()
+
+var (
+	errAuthorizationCodeNotFound = errors.New("authorization code not found")
+	errAuthorizationCodeUsed     = errors.New("authorization code has already been used")
+)
+
+type OIDCProvider struct {
+	jwt   *JWTService
+	users UserRepository
+
+	// Issuer is the public URL of the server, the base of the endpoints of
+	// the discovery document.
+	Issuer string
+	// LoginURL is where signed out users are sent, with the authorization
+	// URL to come back to in return_to. Without it they get a 401.
+	LoginURL string
+	CodeTTL  time.Duration
+}
+
+func NewOIDCProvider(j *JWTService, users UserRepository) *OIDCProvider {
+	return &OIDCProvider{
+		jwt:     j,
+		users:   users,
+		Issuer:  defaultOIDCIssuer,
+		CodeTTL: defaultAuthorizationCodeTTL,
+	}
+}
+
+func (p *OIDCProvider) endpoint(path string) string {
+	return strings.TrimSuffix(p.Issuer, "/") + path
+}
+
+// OAuthError is the error body of RFC 6749, which OAuth clients expect
+// instead of the APIError of the other routes.
+type OAuthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, OAuthError{Error: code, Description: description})
+}
+
+// redirect sends the browser to u without the HTML body of http.Redirect,
+// which would put the code in the access log.
+func redirect(w http.ResponseWriter, u string) {
+	w.Header().Set("Location", u)
+	w.WriteHeader(http.StatusFound)
+}
+
+// redirectOAuthError hands the error of an authorization request back to
+// the client, which is only done once the redirect URI is trusted.
+func redirectOAuthError(w http.ResponseWriter, redirectURI, state, code, description string) {
+	u, _ := url.Parse(redirectURI)
+	q := u.Query()
+	q.Set("error", code)
+	q.Set("error_description", description)
+	if state != "" {
+		q.Set("state", state)
+	}
+	u.RawQuery = q.Encode()
+	redirect(w, u.String())
+}
+
+type OIDCDiscovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+func (p *OIDCProvider) Discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, OIDCDiscovery{
+		Issuer:                            strings.TrimSuffix(p.Issuer, "/"),
+		AuthorizationEndpoint:             p.endpoint("/oauth/authorize"),
+		TokenEndpoint:                     p.endpoint("/oauth/token"),
+		UserinfoEndpoint:                  p.endpoint("/oauth/userinfo"),
+		JWKSURI:                           p.endpoint("/.well-known/jwks.json"),
+		ScopesSupported:                   supportedScopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported: []string{"iss", "sub", "aud", "exp", "iat", "nonce",
+			"email", "email_verified", "favorite_cake"},
+	})
+}
+
+// parseScope returns the requested scopes in a canonical order, it fails
+// on unknown scopes and without openid.
+func parseScope(raw string) (string, bool) {
+	requested := map[string]bool{}
+	for _, s := range strings.Fields(raw) {
+		requested[s] = true
+	}
+	scopes := []string{}
+	for _, s := range supportedScopes {
+		if requested[s] {
+			scopes = append(scopes, s)
+			delete(requested, s)
+		}
+	}
+	if len(requested) > 0 || len(scopes) == 0 || scopes[0] != scopeOpenID {
+		return "", false
+	}
+	return strings.Join(scopes, " "), true
+}
+
+func hasScope(scope, s string) bool {
+	for _, granted := range strings.Fields(scope) {
+		if granted == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize gives a code to the user signed in with the session cookie, or
+// a bearer token. Errors are only redirected to the client once the client
+// and its redirect URI are known, so the endpoint can't be used as an open
+// redirect.
+func (p *OIDCProvider) Authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	client, err := oauthClients.Get(q.Get("client_id"))
+	if err == errOAuthClientNotFound {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Unknown client")
+		return
+	}
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	redirectURI := q.Get("redirect_uri")
+	if !client.allowsRedirect(redirectURI) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "The redirect URI isn't registered for this client")
+		return
+	}
+	state := q.Get("state")
+	fail := func(code, description string) {
+		redirectOAuthError(w, redirectURI, state, code, description)
+	}
+	if q.Get("response_type") != "code" {
+		fail("unsupported_response_type", "Only the code response type is supported")
+		return
+	}
+	scope, ok := parseScope(q.Get("scope"))
+	if !ok {
+		fail("invalid_scope", "The scope must include openid and only "+strings.Join(supportedScopes, ", "))
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || len(q.Get("code_challenge")) != 43 ||
+		!pkceValue.MatchString(q.Get("code_challenge")) {
+		fail("invalid_request", "A S256 PKCE code challenge is required")
+		return
+	}
+	if len(q.Get("nonce")) > 256 {
+		fail("invalid_request", "The nonce is longer than 256 characters")
+		return
+	}
+
+	user, authed, err := p.jwt.authenticate(r, p.users)
+	if err != nil || apiKeyFrom(authed) != nil {
+		switch {
+		case hasScope(q.Get("prompt"), "none"):
+			fail("login_required", "The user isn't signed in")
+		case p.LoginURL != "":
+			login, _ := url.Parse(p.LoginURL)
+			lq := login.Query()
+			lq.Set("return_to", p.endpoint(r.URL.RequestURI()))
+			login.RawQuery = lq.Encode()
+			redirect(w, login.String())
+		default:
+			writeOAuthError(w, http.StatusUnauthorized, "login_required", "Sign in with a session cookie first")
+		}
+		return
+	}
+	requestInfoFrom(r).User = user.Email
+	if impersonatorFrom(authed) != "" {
+		fail("access_denied", "Impersonation tokens can't sign in to apps")
+		return
+	}
+	if user.Banned || emailVerification != nil && emailVerification.Required && !user.Verified() {
+		fail("access_denied", "This account can't sign in")
+		return
+	}
+
+	code, err := randomToken(32)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	err = authorizationCodes.Save(AuthorizationCode{
+		Hash:        hashToken(code),
+		ClientID:    client.ID,
+		Email:       user.Email,
+		RedirectURI: redirectURI,
+		Scope:       scope,
+		Nonce:       q.Get("nonce"),
+		Challenge:   q.Get("code_challenge"),
+		ExpiresAt:   time.Now().Add(p.CodeTTL),
+	})
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	u, _ := url.Parse(redirectURI)
+	rq := u.Query()
+	rq.Set("code", code)
+	if state != "" {
+		rq.Set("state", state)
+	}
+	u.RawQuery = rq.Encode()
+	redirect(w, u.String())
+}
+
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// OAuthAccessClaims are the claims of the access tokens given to clients.
+// They only grant /oauth/userinfo, their string audience keeps them from
+// being taken as the access tokens of the API.
+type OAuthAccessClaims struct {
+	jwt.StandardClaims
+	Scope        string `json:"scope"`
+	ClientID     string `json:"client_id"`
+	IssuedAtNano int64  `json:"iat_ns"`
+}
+
+type IDTokenClaims struct {
+	jwt.StandardClaims
+	Nonce         string `json:"nonce,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	FavoriteCake  string `json:"favorite_cake,omitempty"`
+}
+
+type UserInfo struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	FavoriteCake  string `json:"favorite_cake,omitempty"`
+}
+
+// userInfoOf returns the claims of u that scope grants. Whether the email
+// is verified is only claimed when verification is enabled.
+func userInfoOf(u User, scope string) UserInfo {
+	// the subject stays when the email changes
+	info := UserInfo{Subject: u.ID}
+	if hasScope(scope, scopeEmail) {
+		info.Email = u.Email
+		if emailVerification != nil {
+			verified := u.Verified()
+			info.EmailVerified = &verified
+		}
+	}
+	if hasScope(scope, scopeCake) {
+		info.FavoriteCake = u.FavoriteCake
+	}
+	return info
+}
+
+// authenticateClient accepts the credentials from the Basic header or the
+// form. Public clients only send their client_id.
+func authenticateClient(r *http.Request) (OAuthClient, bool) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client, err := oauthClients.Get(id)
+	if err != nil || !client.checkSecret(secret) {
+		return OAuthClient{}, false
+	}
+	return client, true
+}
+
+func checkCodeVerifier(verifier, challenge string) bool {
+	if !pkceValue.MatchString(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// Token exchanges a code for the tokens. A code exchanged twice was
+// probably stolen, so the access token it first gave is revoked too.
+func (p *OIDCProvider) Token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "The body must be form encoded")
+		return
+	}
+	client, ok := authenticateClient(r)
+	if !ok {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Unknown client or wrong secret")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only the authorization_code grant is supported")
+		return
+	}
+	invalidGrant := func() {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid, expired or already used code")
+	}
+	// only the client holding the verifier may spend the code, or anyone
+	// seeing it could void it and the tokens it gave
+	hash := hashToken(r.PostForm.Get("code"))
+	code, err := authorizationCodes.Get(hash)
+	if err == errAuthorizationCodeNotFound {
+		invalidGrant()
+		return
+	}
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	if code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") ||
+		time.Now().After(code.ExpiresAt) || !checkCodeVerifier(r.PostForm.Get("code_verifier"), code.Challenge) {
+		invalidGrant()
+		return
+	}
+	code, err = authorizationCodes.Use(hash)
+	if err == errAuthorizationCodeUsed {
+		revocations.RevokeToken(hash, time.Now().Add(p.jwt.AccessTTL))
+		invalidGrant()
+		return
+	}
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	user, err := p.users.Get(code.Email)
+	if err != nil || user.Banned {
+		invalidGrant()
+		return
+	}
+	requestInfoFrom(r).User = user.Email
+
+	now := time.Now()
+	access, err := p.jwt.keys.sign(OAuthAccessClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    strings.TrimSuffix(p.Issuer, "/"),
+			Subject:   user.ID,
+			Audience:  oauthAccessAudience,
+			Id:        hash,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(p.jwt.AccessTTL).Unix(),
+		},
+		Scope:        code.Scope,
+		ClientID:     client.ID,
+		IssuedAtNano: now.UnixNano(),
+	})
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	info := userInfoOf(user, code.Scope)
+	id, err := p.jwt.keys.sign(IDTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    strings.TrimSuffix(p.Issuer, "/"),
+			Subject:   info.Subject,
+			Audience:  client.ID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(p.jwt.AccessTTL).Unix(),
+		},
+		Nonce:         code.Nonce,
+		Email:         info.Email,
+		EmailVerified: info.EmailVerified,
+		FavoriteCake:  info.FavoriteCake,
+	})
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	writeJSON(w, http.StatusOK, OAuthTokenResponse{
+		AccessToken: access,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(p.jwt.AccessTTL / time.Second),
+		IDToken:     id,
+		Scope:       code.Scope,
+	})
+}
+
+// parseOAuthAccessToken returns the claims of a valid access token given by
+// Token, and its user.
+func (p *OIDCProvider) parseOAuthAccessToken(token string) (*OAuthAccessClaims, User, error) {
+	claims := &OAuthAccessClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, p.jwt.keys.keyFunc); err != nil {
+		return nil, User{}, err
+	}
+	if !claims.VerifyAudience(oauthAccessAudience, true) {
+		return nil, User{}, errors.New("token is meant for another audience")
+	}
+	user, err := p.users.GetByID(claims.Subject)
+	if err != nil {
+		return nil, User{}, err
+	}
+	revoked, err := isRevoked(user.Email, claims.Id, issuedAt(claims.IssuedAt, claims.IssuedAtNano))
+	if err != nil || revoked {
+		return nil, User{}, errors.New("token has been revoked")
+	}
+	return claims, user, nil
+}
+
+// UserInfo returns the claims granted to the access token of the
+// Authorization header.
+func (p *OIDCProvider) UserInfo(w http.ResponseWriter, r *http.Request) {
+	invalidToken := func() {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "Invalid or expired access token")
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		invalidToken()
+		return
+	}
+	claims, user, err := p.parseOAuthAccessToken(strings.TrimPrefix(header, "Bearer "))
+	if err != nil || user.Banned {
+		invalidToken()
+		return
+	}
+	requestInfoFrom(r).User = user.Email
+	writeJSON(w, http.StatusOK, userInfoOf(user, claims.Scope))
+}
+
+type InMemoryAuthorizationCodeStore struct {
+	lock  sync.Mutex
+	codes map[string]AuthorizationCode
+}
+
+func NewInMemoryAuthorizationCodeStore() *InMemoryAuthorizationCodeStore {
+	return &InMemoryAuthorizationCodeStore{codes: make(map[string]AuthorizationCode)}
+}
+
+func (i *InMemoryAuthorizationCodeStore) Save(c AuthorizationCode) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	now := time.Now()
+	for hash, old := range i.codes {
+		if old.ExpiresAt.Before(now) {
+			delete(i.codes, hash)
+		}
+	}
+	i.codes[c.Hash] = c
+	return nil
+}
+
+func (i *InMemoryAuthorizationCodeStore) Get(hash string) (AuthorizationCode, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	c, ok := i.codes[hash]
+	if !ok {
+		return AuthorizationCode{}, errAuthorizationCodeNotFound
+	}
+	return c, nil
+}
+
+func (i *InMemoryAuthorizationCodeStore) Use(hash string) (AuthorizationCode, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	c, ok := i.codes[hash]
+	if !ok {
+		return AuthorizationCode{}, errAuthorizationCodeNotFound
+	}
+	if c.Used {
+		return c, errAuthorizationCodeUsed
+	}
+	c.Used = true
+	i.codes[hash] = c
+	return c, nil
+}
+
+const authorizationCodesSchema = `
+CREATE TABLE IF NOT EXISTS authorization_codes (
+	hash         TEXT PRIMARY KEY,
+	client_id    TEXT NOT NULL,
+	email        TEXT NOT NULL,
+	redirect_uri TEXT NOT NULL,
+	scope        TEXT NOT NULL,
+	nonce        TEXT NOT NULL DEFAULT '',
+	challenge    TEXT NOT NULL,
+	expires_at   DATETIME NOT NULL,
+	used         INTEGER NOT NULL DEFAULT 0
+);
+`
+
+type SQLiteAuthorizationCodeStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteAuthorizationCodeStore(db *sql.DB) (*SQLiteAuthorizationCodeStore, error) {
+	if _, err := db.Exec(authorizationCodesSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteAuthorizationCodeStore{db: db}, nil
+}
+
+func (s *SQLiteAuthorizationCodeStore) Save(c AuthorizationCode) error {
+	if _, err := s.db.Exec(`DELETE FROM authorization_codes WHERE expires_at < ?`, time.Now()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`INSERT INTO authorization_codes
+		(hash, client_id, email, redirect_uri, scope, nonce, challenge, expires_at, used)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		c.Hash, c.ClientID, c.Email, c.RedirectURI, c.Scope, c.Nonce, c.Challenge, c.ExpiresAt, c.Used)
+	return err
+}
+
+func (s *SQLiteAuthorizationCodeStore) Get(hash string) (AuthorizationCode, error) {
+	c := AuthorizationCode{}
+	err := s.db.QueryRow(`SELECT hash, client_id, email, redirect_uri, scope, nonce, challenge, expires_at, used
+		FROM authorization_codes WHERE hash = ?`, hash).
+		Scan(&c.Hash, &c.ClientID, &c.Email, &c.RedirectURI, &c.Scope, &c.Nonce, &c.Challenge, &c.ExpiresAt, &c.Used)
+	if err == sql.ErrNoRows {
+		return AuthorizationCode{}, errAuthorizationCodeNotFound
+	}
+	return c, err
+}
+
+func (s *SQLiteAuthorizationCodeStore) Use(hash string) (AuthorizationCode, error) {
+	res, err := s.db.Exec(`UPDATE authorization_codes SET used = 1 WHERE hash = ? AND used = 0`, hash)
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+	c, err := s.Get(hash)
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c, errAuthorizationCodeUsed
+	}
+	return c, nil
+}
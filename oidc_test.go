@@ -0,0 +1,478 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+)
+
+// useOAuth gives the test its own clients and authorization codes.
+func useOAuth(t *testing.T) {
+	oldClients, oldCodes := oauthClients, authorizationCodes
+	oauthClients = NewInMemoryOAuthClientStore()
+	authorizationCodes = NewInMemoryAuthorizationCodeStore()
+	t.Cleanup(func() { oauthClients, authorizationCodes = oldClients, oldCodes })
+}
+
+func assertOAuthError(t *testing.T, status int, code string, r parsedResponse) {
+	t.Helper()
+	assertStatus(t, status, r)
+	res := OAuthError{}
+	if err := json.Unmarshal(r.body, &res); err != nil || res.Error != code {
+		t.Errorf("Expected the %s error, got %s", code, string(r.body))
+	}
+}
+
+func pkcePair(t *testing.T) (string, string) {
+	verifier, err := randomToken(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestOIDCProvider(t *testing.T) {
+	doRequest := createRequester(t)
+	useOAuth(t)
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	u := newTestUserService()
+	u.repository.Add("test@mail.com", User{"test@mail.com", "", "cheesecake", RoleUser, false, BanHistory{}, "", ""})
+	user, _ := u.repository.Get("test@mail.com")
+	superadmin := User{"super@mail.com", "", "cake", RoleSuperadmin, false, BanHistory{}, "", ""}
+	u.repository.Add(superadmin.Email, superadmin)
+	admin, _ := j.GenearateJWT(superadmin)
+	token, _ := j.GenearateJWT(User{Email: "test@mail.com"})
+
+	provider := NewOIDCProvider(j, u.repository)
+	provider.Issuer = "https://cake.example/"
+	createClient := httptest.NewServer(j.jwtAuthorize(u.repository, createOAuthClientHandler, PermClientsManage))
+	defer createClient.Close()
+	listClients := httptest.NewServer(j.jwtAuthorize(u.repository, listOAuthClientsHandler, PermClientsManage))
+	defer listClients.Close()
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/oauth/clients/{id}", j.jwtAuthorize(u.repository, deleteOAuthClientHandler, PermClientsManage))
+	deleteClient := httptest.NewServer(router)
+	defer deleteClient.Close()
+	authorize := httptest.NewServer(http.HandlerFunc(provider.Authorize))
+	defer authorize.Close()
+	tokenEndpoint := httptest.NewServer(http.HandlerFunc(provider.Token))
+	defer tokenEndpoint.Close()
+	userinfo := httptest.NewServer(http.HandlerFunc(provider.UserInfo))
+	defer userinfo.Close()
+	me := httptest.NewServer(j.jwtAuthorize(u.repository, getMyData))
+	defer me.Close()
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	register := func(params map[string]interface{}) parsedResponse {
+		req, _ := http.NewRequest(http.MethodPost, createClient.URL, prepareParams(t, params))
+		req.Header.Add("Authorization", "Bearer "+admin)
+		return doRequest(req, nil)
+	}
+	newClient := func(public bool, uri string) OAuthClientRecord {
+		t.Helper()
+		resp := register(map[string]interface{}{"name": "Bakery", "redirect_uris": []string{uri}, "public": public})
+		assertStatus(t, 201, resp)
+		client := OAuthClientRecord{}
+		json.Unmarshal(resp.body, &client)
+		return client
+	}
+	// authorizeWith returns the redirect of the authorization request.
+	authorizeWith := func(params url.Values, bearer string) (*url.URL, parsedResponse) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, authorize.URL+"?"+params.Encode(), nil)
+		if bearer != "" {
+			req.Header.Add("Authorization", "Bearer "+bearer)
+		}
+		res, err := noRedirect.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body := make([]byte, 512)
+		n, _ := res.Body.Read(body)
+		location, _ := res.Location()
+		return location, parsedResponse{res.StatusCode, body[:n]}
+	}
+	authorizationParams := func(client OAuthClientRecord, challenge string) url.Values {
+		return url.Values{
+			"response_type":         {"code"},
+			"client_id":             {client.ID},
+			"redirect_uri":          {client.RedirectURIs[0]},
+			"scope":                 {"openid email cake"},
+			"state":                 {"xyz"},
+			"nonce":                 {"n-0S6"},
+			"code_challenge":        {challenge},
+			"code_challenge_method": {"S256"},
+		}
+	}
+	codeFor := func(client OAuthClientRecord, challenge string) string {
+		t.Helper()
+		location, resp := authorizeWith(authorizationParams(client, challenge), token)
+		assertStatus(t, 302, resp)
+		if location == nil || location.Query().Get("state") != "xyz" || location.Query().Get("code") == "" {
+			t.Fatalf("Unexpected redirect: %v", location)
+		}
+		return location.Query().Get("code")
+	}
+	exchange := func(client OAuthClientRecord, code, verifier string) parsedResponse {
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {client.RedirectURIs[0]},
+			"code_verifier": {verifier},
+		}
+		if client.Public {
+			form.Set("client_id", client.ID)
+		}
+		req, _ := http.NewRequest(http.MethodPost, tokenEndpoint.URL, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if !client.Public {
+			req.SetBasicAuth(client.ID, client.Secret)
+		}
+		return doRequest(req, nil)
+	}
+	getUserInfo := func(accessToken string) parsedResponse {
+		req, _ := http.NewRequest(http.MethodGet, userinfo.URL, nil)
+		req.Header.Add("Authorization", "Bearer "+accessToken)
+		return doRequest(req, nil)
+	}
+
+	t.Run("discovery", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		provider.Discovery(rec, httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil))
+		doc := OIDCDiscovery{}
+		json.Unmarshal(rec.Body.Bytes(), &doc)
+		if doc.Issuer != "https://cake.example" || doc.TokenEndpoint != "https://cake.example/oauth/token" ||
+			doc.JWKSURI != "https://cake.example/.well-known/jwks.json" || doc.CodeChallengeMethodsSupported[0] != "S256" {
+			t.Errorf("Unexpected discovery document: %+v", doc)
+		}
+	})
+
+	t.Run("register clients", func(t *testing.T) {
+		client := newClient(false, "https://app.example/callback")
+		if client.ID == "" || client.Secret == "" || client.Public {
+			t.Errorf("Unexpected client: %+v", client)
+		}
+		public := newClient(true, "http://localhost:3000/callback")
+		if public.Secret != "" || !public.Public {
+			t.Errorf("Unexpected client: %+v", public)
+		}
+		assertError(t, 422, "validation_failed", "Redirect URIs must use https, or http on localhost",
+			register(map[string]interface{}{"name": "Bakery", "redirect_uris": []string{"http://app.example/callback"}}))
+		assertStatus(t, 422, register(map[string]interface{}{"name": "Bakery", "redirect_uris": []string{"https://app.example/#cb"}}))
+		assertStatus(t, 422, register(map[string]interface{}{"name": "Bakery"}))
+		assertStatus(t, 422, register(map[string]interface{}{"redirect_uris": []string{"https://app.example/callback"}}))
+
+		req, _ := http.NewRequest(http.MethodGet, listClients.URL, nil)
+		req.Header.Add("Authorization", "Bearer "+admin)
+		resp := doRequest(req, nil)
+		assertStatus(t, 200, resp)
+		if strings.Contains(string(resp.body), "client_secret") || !strings.Contains(string(resp.body), client.ID) {
+			t.Errorf("Unexpected clients: %s", resp.body)
+		}
+
+		req, _ = http.NewRequest(http.MethodPost, createClient.URL, prepareParams(t, map[string]interface{}{
+			"name": "Bakery", "redirect_uris": []string{"https://app.example/callback"}}))
+		req.Header.Add("Authorization", "Bearer "+token)
+		assertStatus(t, 403, doRequest(req, nil))
+
+		req, _ = http.NewRequest(http.MethodDelete, deleteClient.URL+"/admin/oauth/clients/"+public.ID, nil)
+		req.Header.Add("Authorization", "Bearer "+admin)
+		assertBody(t, "The client have been deleted", doRequest(req, nil))
+		req, _ = http.NewRequest(http.MethodDelete, deleteClient.URL+"/admin/oauth/clients/"+public.ID, nil)
+		req.Header.Add("Authorization", "Bearer "+admin)
+		assertError(t, 404, "oauth_client_not_found", "This client doesn't exist", doRequest(req, nil))
+	})
+
+	t.Run("authorization code flow", func(t *testing.T) {
+		client := newClient(false, "https://app.example/callback")
+		verifier, challenge := pkcePair(t)
+		resp := exchange(client, codeFor(client, challenge), verifier)
+		assertStatus(t, 200, resp)
+		tokens := OAuthTokenResponse{}
+		json.Unmarshal(resp.body, &tokens)
+		if tokens.TokenType != "Bearer" || tokens.Scope != "openid email cake" || tokens.ExpiresIn <= 0 {
+			t.Fatalf("Unexpected tokens: %s", resp.body)
+		}
+
+		id := IDTokenClaims{}
+		if _, err := jwt.ParseWithClaims(tokens.IDToken, &id, j.keys.keyFunc); err != nil {
+			t.Fatalf("Invalid ID token: %v", err)
+		}
+		if id.Issuer != "https://cake.example" || id.Audience != client.ID || id.Subject != user.ID ||
+			id.Nonce != "n-0S6" || id.Email != "test@mail.com" || id.FavoriteCake != "cheesecake" || id.EmailVerified != nil {
+			t.Errorf("Unexpected ID token claims: %+v", id)
+		}
+
+		resp = getUserInfo(tokens.AccessToken)
+		assertStatus(t, 200, resp)
+		assertBody(t, `{"sub":"`+user.ID+`","email":"test@mail.com","favorite_cake":"cheesecake"}`+"\n", resp)
+
+		for _, other := range []string{tokens.AccessToken, tokens.IDToken} {
+			req, _ := http.NewRequest(http.MethodGet, me.URL, nil)
+			req.Header.Add("Authorization", "Bearer "+other)
+			assertStatus(t, 401, doRequest(req, nil))
+		}
+		req, _ := http.NewRequest(http.MethodGet, userinfo.URL, nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		assertOAuthError(t, 401, "invalid_token", doRequest(req, nil))
+		assertOAuthError(t, 401, "invalid_token", getUserInfo(tokens.IDToken))
+	})
+
+	t.Run("scope limits the claims", func(t *testing.T) {
+		client := newClient(false, "https://app.example/callback")
+		verifier, challenge := pkcePair(t)
+		params := authorizationParams(client, challenge)
+		params.Set("scope", "openid")
+		location, _ := authorizeWith(params, token)
+		resp := exchange(client, location.Query().Get("code"), verifier)
+		tokens := OAuthTokenResponse{}
+		json.Unmarshal(resp.body, &tokens)
+		assertBody(t, `{"sub":"`+user.ID+`"}`+"\n", getUserInfo(tokens.AccessToken))
+	})
+
+	t.Run("public client", func(t *testing.T) {
+		client := newClient(true, "http://localhost:3000/callback")
+		verifier, challenge := pkcePair(t)
+		assertStatus(t, 200, exchange(client, codeFor(client, challenge), verifier))
+
+		client.Public, client.Secret = false, "guessed"
+		assertOAuthError(t, 401, "invalid_client", exchange(client, codeFor(client, challenge), verifier))
+	})
+
+	t.Run("codes can only be used once", func(t *testing.T) {
+		client := newClient(false, "https://app.example/callback")
+		verifier, challenge := pkcePair(t)
+		code := codeFor(client, challenge)
+		resp := exchange(client, code, verifier)
+		tokens := OAuthTokenResponse{}
+		json.Unmarshal(resp.body, &tokens)
+		assertOAuthError(t, 400, "invalid_grant", exchange(client, code, verifier))
+		assertOAuthError(t, 401, "invalid_token", getUserInfo(tokens.AccessToken))
+	})
+
+	t.Run("code exchange checks", func(t *testing.T) {
+		client := newClient(false, "https://app.example/callback")
+		other := newClient(false, "https://app.example/callback")
+		verifier, challenge := pkcePair(t)
+		wrongVerifier, _ := pkcePair(t)
+		assertOAuthError(t, 400, "invalid_grant", exchange(client, codeFor(client, challenge), wrongVerifier))
+		assertOAuthError(t, 400, "invalid_grant", exchange(other, codeFor(client, challenge), verifier))
+		assertOAuthError(t, 400, "invalid_grant", exchange(client, "made-up", verifier))
+
+		// failed exchanges don't spend the code
+		code := codeFor(client, challenge)
+		assertOAuthError(t, 400, "invalid_grant", exchange(client, code, wrongVerifier))
+		assertOAuthError(t, 400, "invalid_grant", exchange(other, code, verifier))
+		assertStatus(t, 200, exchange(client, code, verifier))
+
+		provider.CodeTTL = -time.Second
+		code = codeFor(client, challenge)
+		provider.CodeTTL = defaultAuthorizationCodeTTL
+		assertOAuthError(t, 400, "invalid_grant", exchange(client, code, verifier))
+
+		client.Secret = "wrong"
+		assertOAuthError(t, 401, "invalid_client", exchange(client, codeFor(client, challenge), verifier))
+	})
+
+	t.Run("authorization errors", func(t *testing.T) {
+		client := newClient(false, "https://app.example/callback")
+		_, challenge := pkcePair(t)
+
+		params := authorizationParams(client, challenge)
+		params.Set("client_id", "unknown")
+		_, resp := authorizeWith(params, token)
+		assertOAuthError(t, 400, "invalid_request", resp)
+
+		params = authorizationParams(client, challenge)
+		params.Set("redirect_uri", "https://evil.example/callback")
+		_, resp = authorizeWith(params, token)
+		assertOAuthError(t, 400, "invalid_request", resp)
+
+		redirected := map[string]func(url.Values){
+			"invalid_request":           func(p url.Values) { p.Del("code_challenge") },
+			"unsupported_response_type": func(p url.Values) { p.Set("response_type", "token") },
+			"invalid_scope":             func(p url.Values) { p.Set("scope", "email") },
+		}
+		for code, change := range redirected {
+			params := authorizationParams(client, challenge)
+			change(params)
+			location, resp := authorizeWith(params, token)
+			assertStatus(t, 302, resp)
+			if location.Query().Get("error") != code || location.Query().Get("state") != "xyz" ||
+				!strings.HasPrefix(location.String(), "https://app.example/callback?") {
+				t.Errorf("Expected the %s error, got %v", code, location)
+			}
+		}
+		params = authorizationParams(client, challenge)
+		params.Set("code_challenge_method", "plain")
+		location, _ := authorizeWith(params, token)
+		if location.Query().Get("error") != "invalid_request" {
+			t.Errorf("plain PKCE should be refused: %v", location)
+		}
+	})
+
+	t.Run("signed out users", func(t *testing.T) {
+		client := newClient(false, "https://app.example/callback")
+		_, challenge := pkcePair(t)
+		params := authorizationParams(client, challenge)
+		_, resp := authorizeWith(params, "")
+		assertOAuthError(t, 401, "login_required", resp)
+
+		apiKey := "cake_" + strings.Repeat("x", 20)
+		_, resp = authorizeWith(params, apiKey)
+		assertOAuthError(t, 401, "login_required", resp)
+
+		provider.LoginURL = "https://cake.example/login"
+		defer func() { provider.LoginURL = "" }()
+		location, resp := authorizeWith(params, "")
+		assertStatus(t, 302, resp)
+		returnTo, _ := url.Parse(location.Query().Get("return_to"))
+		if !strings.HasPrefix(location.String(), "https://cake.example/login?") ||
+			returnTo.Path != "/" || returnTo.Query().Get("client_id") != client.ID {
+			t.Errorf("Unexpected login redirect: %v", location)
+		}
+
+		params.Set("prompt", "none")
+		location, _ = authorizeWith(params, "")
+		if location.Query().Get("error") != "login_required" {
+			t.Errorf("Unexpected redirect: %v", location)
+		}
+	})
+
+	t.Run("session cookie", func(t *testing.T) {
+		client := newClient(false, "https://app.example/callback")
+		verifier, challenge := pkcePair(t)
+		req, _ := http.NewRequest(http.MethodGet, authorize.URL+"?"+authorizationParams(client, challenge).Encode(), nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: token})
+		res, err := noRedirect.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		location, _ := res.Location()
+		assertStatus(t, 200, exchange(client, location.Query().Get("code"), verifier))
+	})
+
+	t.Run("banned users", func(t *testing.T) {
+		client := newClient(false, "https://app.example/callback")
+		verifier, challenge := pkcePair(t)
+		code := codeFor(client, challenge)
+		resp := exchange(client, code, verifier)
+		tokens := OAuthTokenResponse{}
+		json.Unmarshal(resp.body, &tokens)
+		code = codeFor(client, challenge)
+
+		banned, _ := u.repository.Get("test@mail.com")
+		banned.Banned = true
+		u.repository.Update(banned.Email, banned)
+		defer func() {
+			banned.Banned = false
+			u.repository.Update(banned.Email, banned)
+		}()
+		assertOAuthError(t, 400, "invalid_grant", exchange(client, code, verifier))
+		assertOAuthError(t, 401, "invalid_token", getUserInfo(tokens.AccessToken))
+	})
+
+	t.Run("subject survives an email change", func(t *testing.T) {
+		client := newClient(false, "https://app.example/callback")
+		verifier, challenge := pkcePair(t)
+		resp := exchange(client, codeFor(client, challenge), verifier)
+		tokens := OAuthTokenResponse{}
+		json.Unmarshal(resp.body, &tokens)
+
+		renamed := user
+		renamed.Email = "renamed@mail.com"
+		if err := u.repository.Rename(user.Email, renamed); err != nil {
+			t.Fatal(err)
+		}
+		defer u.repository.Rename(renamed.Email, user)
+		resp = getUserInfo(tokens.AccessToken)
+		assertStatus(t, 200, resp)
+		assertBody(t, `{"sub":"`+user.ID+`","email":"renamed@mail.com","favorite_cake":"cheesecake"}`+"\n", resp)
+	})
+
+	t.Run("access tokens without iat_ns go by iat", func(t *testing.T) {
+		defer func(old RevocationStore) { revocations = old }(revocations)
+		revocations = NewInMemoryRevocationStore()
+		legacy := func(issued time.Time) string {
+			token, err := j.keys.sign(OAuthAccessClaims{
+				StandardClaims: jwt.StandardClaims{
+					Subject:   user.ID,
+					Audience:  oauthAccessAudience,
+					IssuedAt:  issued.Unix(),
+					ExpiresAt: issued.Add(time.Hour).Unix(),
+				},
+				Scope: "openid",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}
+		watermark := time.Now().Add(-time.Minute)
+		revocations.RevokeUser(user.Email, watermark)
+		assertOAuthError(t, 401, "invalid_token", getUserInfo(legacy(watermark.Add(-time.Second))))
+		assertStatus(t, 200, getUserInfo(legacy(watermark.Add(time.Second))))
+	})
+}
+
+func TestSQLiteOAuthStores(t *testing.T) {
+	users := newTestSQLiteStorage(t)
+	clients, err := NewSQLiteOAuthClientStore(users.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+	clients.Save(OAuthClient{ID: "b", Name: "Second", RedirectURIs: []string{"https://b.example/cb"}, CreatedAt: now.Add(time.Minute)})
+	clients.Save(OAuthClient{ID: "a", SecretHash: hashToken("secret"), Name: "First",
+		RedirectURIs: []string{"https://a.example/cb", "http://localhost/cb"}, CreatedAt: now})
+	client, err := clients.Get("a")
+	if err != nil || !client.checkSecret("secret") || !client.allowsRedirect("http://localhost/cb") || client.public() {
+		t.Fatalf("Unexpected client: %+v, %v", client, err)
+	}
+	if list, err := clients.List(); err != nil || len(list) != 2 || list[0].ID != "a" {
+		t.Fatalf("Unexpected clients: %+v, %v", list, err)
+	}
+	clients.Delete("a")
+	if _, err := clients.Get("a"); err != errOAuthClientNotFound {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := clients.Delete("a"); err != errOAuthClientNotFound {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	codes, err := NewSQLiteAuthorizationCodeStore(users.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes.Save(AuthorizationCode{Hash: "h", ClientID: "b", Email: "test@mail.com", RedirectURI: "https://b.example/cb",
+		Scope: "openid", Challenge: "c", ExpiresAt: now.Add(time.Minute)})
+	if code, err := codes.Get("h"); err != nil || code.Email != "test@mail.com" || code.Used {
+		t.Fatalf("Unexpected code: %+v, %v", code, err)
+	}
+	if code, err := codes.Use("h"); err != nil || code.Email != "test@mail.com" || !code.Used {
+		t.Fatalf("Unexpected code: %+v, %v", code, err)
+	}
+	if code, err := codes.Use("h"); err != errAuthorizationCodeUsed || code.ClientID != "b" {
+		t.Errorf("Unexpected reuse: %+v, %v", code, err)
+	}
+	if _, err := codes.Use("unknown"); err != errAuthorizationCodeNotFound {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher produces self-describing encoded hashes: the algorithm and
+// its parameters are stored next to the digest, so a hash can be verified
+// even after the hasher configuration has changed.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (bool, error)
+	// NeedsRehash reports whether encoded was produced by another
+	// algorithm or with other parameters than the current ones.
+	NeedsRehash(encoded string) bool
+}
+
+// passwordHasher is used for every new digest.
+var passwordHasher PasswordHasher = NewArgon2idHasher()
+
+var errUnknownHash = errors.New("unknown password hash format")
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func NewBcryptHasher() *BcryptHasher {
+	return &BcryptHasher{Cost: bcrypt.DefaultCost}
+}
+
+func (b *BcryptHasher) Hash(password string) (string, error) {
+	digest, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(digest), nil
+}
+
+func (b *BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.Cost
+}
+
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+// NewArgon2idHasher uses the OWASP recommended minimum parameters.
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{
+		Time:    2,
+		Memory:  19 * 1024,
+		Threads: 1,
+		KeyLen:  32,
+		SaltLen: 16,
+	}
+}
+
+func (a *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, a.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a *Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (a *Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Time != a.Time || params.Memory != a.Memory || params.Threads != a.Threads ||
+		uint32(len(salt)) != a.SaltLen || uint32(len(key)) != a.KeyLen
+}
+
+func decodeArgon2id(encoded string) (*Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, errUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, errUnknownHash
+	}
+	params := &Argon2idHasher{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, nil, nil, errUnknownHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, errUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, errUnknownHash
+	}
+	return params, salt, key, nil
+}
+
+// hasherFor picks the hasher able to verify encoded, nil means the digest
+// predates PasswordHasher.
+func hasherFor(encoded string) PasswordHasher {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return &Argon2idHasher{}
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return &BcryptHasher{}
+	}
+	return nil
+}
+
+// legacyDigest is how passwords were stored before PasswordHasher:
+// md5 of nothing appended to the plain password.
+func legacyDigest(password string) string {
+	return string(md5.New().Sum([]byte(password)))
+}
+
+// hashPassword creates a digest with the configured hasher.
+func hashPassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+// checkPassword verifies password against a stored digest of any known
+// format. rehash is set when the password is correct but the digest should
+// be replaced with one produced by the configured hasher.
+func checkPassword(password, digest string) (ok bool, rehash bool) {
+	h := hasherFor(digest)
+	if h == nil {
+		ok = subtle.ConstantTimeCompare([]byte(legacyDigest(password)), []byte(digest)) == 1
+		return ok, ok
+	}
+	ok, err := h.Verify(password, digest)
+	if err != nil || !ok {
+		return false, false
+	}
+	return true, passwordHasher.NeedsRehash(digest)
+}
+
+// dummyDigest is a digest of the configured hasher no password matches.
+var dummyDigest struct {
+	sync.Mutex
+	hasher PasswordHasher
+	digest string
+}
+
+// checkNoPassword takes as long as checkPassword for an account which
+// doesn't exist, so the response time doesn't tell which emails are
+// registered.
+func checkNoPassword(password string) {
+	dummyDigest.Lock()
+	if dummyDigest.hasher != passwordHasher {
+		digest, err := passwordHasher.Hash("no password")
+		if err != nil {
+			dummyDigest.Unlock()
+			return
+		}
+		dummyDigest.hasher, dummyDigest.digest = passwordHasher, digest
+	}
+	digest := dummyDigest.digest
+	dummyDigest.Unlock()
+	checkPassword(password, digest)
+}
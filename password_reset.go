@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPasswordResetTTL = time.Hour
+	defaultPasswordResetURL = "http://localhost:8080/user/password/reset?token="
+)
+
+// PasswordReset is the server side record of a mailed reset token, only the
+// hash of the token is stored.
+type PasswordReset struct {
+	Hash      string
+	Email     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	Used      bool
+}
+
+type PasswordResetStore interface {
+	Save(PasswordReset) error
+	// Use flags the reset as used and returns it. It fails if the reset is
+	// unknown or already used, so a token works once.
+	Use(hash string) (PasswordReset, error)
+	// Forget drops every reset of email.
+	Forget(email string) error
+}
+
+var (
+	errInvalidResetToken = newBadRequestError("invalid_reset_token", "Invalid or expired reset token")
+	errResetTokenUsed    = errors.New("reset token has already been used")
+)
+
+// PasswordResetter mails the reset tokens.
+type PasswordResetter struct {
+	Mailer Mailer
+	TTL    time.Duration
+	// URL is the reset link, the token is appended to it.
+	URL string
+}
+
+func NewPasswordResetter(m Mailer) *PasswordResetter {
+	return &PasswordResetter{Mailer: m, TTL: defaultPasswordResetTTL, URL: defaultPasswordResetURL}
+}
+
+var (
+	passwordReset                     = NewPasswordResetter(NewInMemoryOutbox())
+	passwordResets PasswordResetStore = NewInMemoryPasswordResetStore()
+)
+
+type ForgotPasswordParams struct {
+	Email string `json:"email"`
+}
+
+const forgotPasswordAnswer = "If this account exists, a reset email have been sent"
+
+// ForgotPassword mails a reset token. The answer is the same whether or not
+// the account exists.
+func (u *UserService) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	params := &ForgotPasswordParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(ErrInvalidParams, w)
+		return
+	}
+	user, err := u.repository.Get(params.Email)
+	if err == ErrUserNotFound {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(forgotPasswordAnswer))
+		return
+	}
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	now := time.Now()
+	err = passwordResets.Save(PasswordReset{
+		Hash:      hashToken(token),
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(passwordReset.TTL),
+	})
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	err = passwordReset.Mailer.Send(Mail{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: "Follow this link to choose a new password:\r\n\r\n" + passwordReset.URL + token +
+			"\r\n\r\nIt expires in " + passwordReset.TTL.String() + ". If you didn't ask for it, ignore this email.",
+	})
+	// an error would tell that the account exists, the user can ask again
+	if err != nil {
+		log.Println("Could not send password reset email to", user.Email, err)
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(forgotPasswordAnswer))
+}
+
+type ResetPasswordParams struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ResetPassword sets the password of the account of a reset token. Every
+// token of the user is revoked, reset tokens included.
+func (u *UserService) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	params := &ResetPasswordParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(ErrInvalidParams, w)
+		return
+	}
+	// checked first, so that a typo doesn't spend the token
+	if err := validatePassParams(&ChangePassParams{Password: params.Password}); err != nil {
+		handleError(err, w)
+		return
+	}
+	reset, err := passwordResets.Use(hashToken(params.Token))
+	if err == errResetTokenUsed || (err == nil && time.Now().After(reset.ExpiresAt)) {
+		err = errInvalidResetToken
+	}
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	user, err := u.repository.Get(reset.Email)
+	if err == ErrUserNotFound {
+		err = errInvalidResetToken
+	}
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	digest, err := hashPassword(params.Password)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	user.PasswordDigest = digest
+	// the mail reached its owner, which is what verification checks
+	user.PendingVerification = ""
+	if err := u.repository.Update(user.Email, user); err != nil {
+		handleError(err, w)
+		return
+	}
+	revokeUserTokens(user.Email)
+	if err := passwordResets.Forget(user.Email); err != nil {
+		handleError(err, w)
+		return
+	}
+	// the failed logins were likely the owner's who forgot the password
+	if err := recordLoginSuccess(user.Email); err != nil {
+		handleError(err, w)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("Your password have been reset"))
+}
+
+type InMemoryPasswordResetStore struct {
+	lock   sync.Mutex
+	resets map[string]PasswordReset
+}
+
+func NewInMemoryPasswordResetStore() *InMemoryPasswordResetStore {
+	return &InMemoryPasswordResetStore{resets: make(map[string]PasswordReset)}
+}
+
+func (i *InMemoryPasswordResetStore) Save(p PasswordReset) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	now := time.Now()
+	for hash, old := range i.resets {
+		if old.ExpiresAt.Before(now) {
+			delete(i.resets, hash)
+		}
+	}
+	i.resets[p.Hash] = p
+	return nil
+}
+
+func (i *InMemoryPasswordResetStore) Use(hash string) (PasswordReset, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	p, ok := i.resets[hash]
+	if !ok {
+		return PasswordReset{}, errInvalidResetToken
+	}
+	if p.Used {
+		return PasswordReset{}, errResetTokenUsed
+	}
+	p.Used = true
+	i.resets[hash] = p
+	return p, nil
+}
+
+func (i *InMemoryPasswordResetStore) Forget(email string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for hash, p := range i.resets {
+		if p.Email == email {
+			delete(i.resets, hash)
+		}
+	}
+	return nil
+}
+
+const passwordResetsSchema = `
+CREATE TABLE IF NOT EXISTS password_resets (
+	hash       TEXT PRIMARY KEY,
+	email      TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL,
+	used       INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS password_resets_email ON password_resets(email);
+`
+
+type SQLitePasswordResetStore struct {
+	db *sql.DB
+}
+
+func NewSQLitePasswordResetStore(db *sql.DB) (*SQLitePasswordResetStore, error) {
+	if _, err := db.Exec(passwordResetsSchema); err != nil {
+		return nil, err
+	}
+	return &SQLitePasswordResetStore{db: db}, nil
+}
+
+func (s *SQLitePasswordResetStore) Save(p PasswordReset) error {
+	if _, err := s.db.Exec(`DELETE FROM password_resets WHERE expires_at < ?`, time.Now()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`INSERT INTO password_resets (hash, email, created_at, expires_at, used)
+		VALUES (?, ?, ?, ?, ?)`, p.Hash, p.Email, p.CreatedAt, p.ExpiresAt, p.Used)
+	return err
+}
+
+func (s *SQLitePasswordResetStore) Use(hash string) (PasswordReset, error) {
+	res, err := s.db.Exec(`UPDATE password_resets SET used = 1 WHERE hash = ? AND used = 0`, hash)
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	p := PasswordReset{}
+	err = s.db.QueryRow(`SELECT hash, email, created_at, expires_at, used FROM password_resets WHERE hash = ?`, hash).
+		Scan(&p.Hash, &p.Email, &p.CreatedAt, &p.ExpiresAt, &p.Used)
+	if err == sql.ErrNoRows {
+		return PasswordReset{}, errInvalidResetToken
+	}
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return PasswordReset{}, errResetTokenUsed
+	}
+	return p, nil
+}
+
+func (s *SQLitePasswordResetStore) Forget(email string) error {
+	_, err := s.db.Exec(`DELETE FROM password_resets WHERE email = ?`, email)
+	return err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// usePasswordResets gives the test its own reset store and returns the
+// outbox receiving the reset mails.
+func usePasswordResets(t *testing.T) *InMemoryOutbox {
+	oldReset, oldStore := passwordReset, passwordResets
+	outbox := NewInMemoryOutbox()
+	passwordReset, passwordResets = NewPasswordResetter(outbox), NewInMemoryPasswordResetStore()
+	t.Cleanup(func() { passwordReset, passwordResets = oldReset, oldStore })
+	return outbox
+}
+
+type failingMailer struct{}
+
+func (failingMailer) Send(Mail) error {
+	return errors.New("mail server is down")
+}
+
+func TestPasswordReset(t *testing.T) {
+	doRequest := createRequester(t)
+	useLockoutPolicy(t, defaultLockoutPolicy())
+	outbox := usePasswordResets(t)
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	u := newTestUserService()
+	digest, _ := hashPassword("oldpassword")
+	u.repository.Add("reset@mail.com", User{"reset@mail.com", digest, "cake", RoleUser, false, BanHistory{}, "", ""})
+	forgot := httptest.NewServer(http.HandlerFunc(u.ForgotPassword))
+	defer forgot.Close()
+	reset := httptest.NewServer(http.HandlerFunc(u.ResetPassword))
+	defer reset.Close()
+	login := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+	defer login.Close()
+	me := httptest.NewServer(j.jwtAuthorize(u.repository, getMyData))
+	defer me.Close()
+	post := func(url string, params map[string]interface{}) parsedResponse {
+		return doRequest(http.NewRequest(http.MethodPost, url, prepareParams(t, params)))
+	}
+	session := forgeTokenIssuedAt(t, j, "reset@mail.com", time.Now().Add(-time.Minute))
+
+	t.Run("unknown emails get the same answer", func(t *testing.T) {
+		resp := post(forgot.URL, map[string]interface{}{"email": "nobody@mail.com"})
+		assertStatus(t, 201, resp)
+		assertBody(t, "If this account exists, a reset email have been sent", resp)
+		if mails := outbox.Mails("nobody@mail.com"); len(mails) != 0 {
+			t.Errorf("Unexpected mails: %+v", mails)
+		}
+	})
+
+	t.Run("mail failures get the same answer", func(t *testing.T) {
+		passwordReset.Mailer = failingMailer{}
+		defer func() { passwordReset.Mailer = outbox }()
+		resp := post(forgot.URL, map[string]interface{}{"email": "reset@mail.com"})
+		assertStatus(t, 201, resp)
+		assertBody(t, "If this account exists, a reset email have been sent", resp)
+	})
+
+	resp := post(forgot.URL, map[string]interface{}{"email": "reset@mail.com"})
+	assertStatus(t, 201, resp)
+	assertBody(t, "If this account exists, a reset email have been sent", resp)
+	token := lastMailToken(t, outbox, "reset@mail.com")
+	if _, stored := passwordResets.(*InMemoryPasswordResetStore).resets[token]; stored {
+		t.Error("the token should be stored hashed")
+	}
+
+	t.Run("invalid password keeps the token", func(t *testing.T) {
+		assertError(t, 422, "validation_failed", "Invalid password",
+			post(reset.URL, map[string]interface{}{"token": token, "password": "short"}))
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		assertStatus(t, 201, post(reset.URL, map[string]interface{}{"token": token, "password": "newpassword"}))
+		req, _ := http.NewRequest(http.MethodGet, me.URL, nil)
+		req.Header.Add("Authorization", "Bearer "+session)
+		assertError(t, 401, "unauthorized", "unauthorized", doRequest(req, nil))
+		assertStatus(t, 401, post(login.URL, map[string]interface{}{"email": "reset@mail.com", "password": "oldpassword"}))
+		assertStatus(t, 200, post(login.URL, map[string]interface{}{"email": "reset@mail.com", "password": "newpassword"}))
+	})
+
+	t.Run("tokens work once", func(t *testing.T) {
+		assertError(t, 400, "invalid_reset_token", "Invalid or expired reset token",
+			post(reset.URL, map[string]interface{}{"token": token, "password": "otherpassword"}))
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		passwordReset.TTL = -time.Minute
+		post(forgot.URL, map[string]interface{}{"email": "reset@mail.com"})
+		assertError(t, 400, "invalid_reset_token", "Invalid or expired reset token",
+			post(reset.URL, map[string]interface{}{"token": lastMailToken(t, outbox, "reset@mail.com"), "password": "otherpassword"}))
+	})
+}
+
+func TestSQLitePasswordResetStore(t *testing.T) {
+	users := newTestSQLiteStorage(t)
+	s, err := NewSQLitePasswordResetStore(users.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s.Save(PasswordReset{Hash: "a", Email: "test@mail.com", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	s.Save(PasswordReset{Hash: "b", Email: "test@mail.com", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if p, err := s.Use("a"); err != nil || p.Email != "test@mail.com" {
+		t.Fatalf("Unexpected reset: %+v, %v", p, err)
+	}
+	if _, err := s.Use("a"); err != errResetTokenUsed {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	s.Forget("test@mail.com")
+	if _, err := s.Use("b"); err != errInvalidResetToken {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
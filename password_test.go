@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	hashers := map[string]PasswordHasher{
+		"bcrypt":   &BcryptHasher{Cost: 4},
+		"argon2id": &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16},
+	}
+	for name, h := range hashers {
+		t.Run(name, func(t *testing.T) {
+			digest, err := h.Hash("somepass")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.Contains(digest, "somepass") {
+				t.Errorf("digest contains the plain password: %s", digest)
+			}
+			if ok, _ := hasherFor(digest).Verify("somepass", digest); !ok {
+				t.Errorf("password should match its digest")
+			}
+			if ok, _ := hasherFor(digest).Verify("wrongpass", digest); ok {
+				t.Errorf("wrong password should not match")
+			}
+			if h.NeedsRehash(digest) {
+				t.Errorf("fresh digest should not need a rehash")
+			}
+		})
+	}
+
+	t.Run("argon2id parameters are encoded", func(t *testing.T) {
+		old := &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16}
+		digest, _ := old.Hash("somepass")
+		if !strings.HasPrefix(digest, "$argon2id$v=19$m=1024,t=1,p=1$") {
+			t.Errorf("Unexpected digest: %s", digest)
+		}
+		if !NewArgon2idHasher().NeedsRehash(digest) {
+			t.Errorf("digest with weaker parameters should need a rehash")
+		}
+	})
+
+	t.Run("unknown accounts are checked with the configured hasher", func(t *testing.T) {
+		old := passwordHasher
+		defer func() { passwordHasher = old }()
+		passwordHasher = &BcryptHasher{Cost: 4}
+		checkNoPassword("somepass")
+		if !strings.HasPrefix(dummyDigest.digest, "$2a$04$") {
+			t.Errorf("Unexpected dummy digest: %s", dummyDigest.digest)
+		}
+		if ok, _ := checkPassword("no password", dummyDigest.digest); !ok {
+			t.Errorf("dummy digest should be a real digest")
+		}
+	})
+}
+
+func TestUsers_LegacyDigestRehash(t *testing.T) {
+	doRequest := createRequester(t)
+	u := newTestUserService()
+	u.repository.Add("test@mail.com", User{
+		Email:          "test@mail.com",
+		PasswordDigest: legacyDigest("somepass"),
+		FavoriteCake:   "cake",
+		BanHistory:     *NewBanHistory(),
+	})
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	ts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+	defer ts.Close()
+	params := map[string]interface{}{
+		"email":    "test@mail.com",
+		"password": "somepass",
+	}
+	resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+	assertStatus(t, 200, resp)
+
+	user, _ := u.repository.Get("test@mail.com")
+	if !strings.HasPrefix(user.PasswordDigest, "$argon2id$") {
+		t.Errorf("legacy digest was not upgraded: %q", user.PasswordDigest)
+	}
+	resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+	assertStatus(t, 200, resp)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limits are counted per client IP or per signed in user.
+const (
+	RateLimitByIP   = "ip"
+	RateLimitByUser = "user"
+)
+
+// RateLimitPolicy lets Requests requests through every Per, with bursts of
+// up to Burst requests, Requests when not set. By is RateLimitByIP or
+// RateLimitByUser, requests without a valid token are counted by IP.
+type RateLimitPolicy struct {
+	Requests int      `json:"requests"`
+	Per      Duration `json:"per"`
+	Burst    int      `json:"burst"`
+	By       string   `json:"by"`
+}
+
+func (p RateLimitPolicy) capacity() float64 {
+	if p.Burst > 0 {
+		return float64(p.Burst)
+	}
+	return float64(p.Requests)
+}
+
+// rate is the number of tokens added per second.
+func (p RateLimitPolicy) rate() float64 {
+	return float64(p.Requests) / p.Per.Seconds()
+}
+
+func (p RateLimitPolicy) validate() error {
+	if p.Requests < 0 || p.Burst < 0 {
+		return errors.New("rate limits can't be negative")
+	}
+	if p.Requests > 0 && p.Per.Duration <= 0 {
+		return errors.New("rate limit period must be positive")
+	}
+	if p.By != "" && p.By != RateLimitByIP && p.By != RateLimitByUser {
+		return errors.New("rate limits are either by ip or by user")
+	}
+	return nil
+}
+
+// defaultRateLimits are keyed by route. A key ending with * covers the
+// routes starting with it, "default" covers the others.
+func defaultRateLimits() map[string]RateLimitPolicy {
+	minute := Duration{time.Minute}
+	return map[string]RateLimitPolicy{
+		"default":               {Requests: 120, Per: minute, By: RateLimitByIP},
+		"/user/register":        {Requests: 5, Per: minute, By: RateLimitByIP},
+		"/user/jwt":             {Requests: 20, Per: minute, By: RateLimitByIP},
+		"/user/verify/resend":   {Requests: 3, Per: minute, By: RateLimitByIP},
+		"/user/password/forgot": {Requests: 3, Per: minute, By: RateLimitByIP},
+		"/user/jwt/2fa":         {Requests: 20, Per: minute, By: RateLimitByIP},
+		"/user/2fa/*":           {Requests: 10, Per: minute, By: RateLimitByUser},
+		"/admin/*":              {Requests: 60, Per: minute, By: RateLimitByUser},
+		"/oauth/token":          {Requests: 30, Per: minute, By: RateLimitByIP},
+	}
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter is a token bucket rate limiter with a bucket per route and
+// client.
+type RateLimiter struct {
+	policies map[string]RateLimitPolicy
+	// identify returns the signed in user of a request, if any.
+	identify func(*http.Request) string
+	now      func() time.Time
+
+	lock     sync.Mutex
+	buckets  map[string]*tokenBucket
+	requests int
+}
+
+func NewRateLimiter(policies map[string]RateLimitPolicy, identify func(*http.Request) string) *RateLimiter {
+	return &RateLimiter{
+		policies: policies,
+		identify: identify,
+		now:      time.Now,
+		buckets:  make(map[string]*tokenBucket),
+	}
+}
+
+// policy finds the policy of route: its own, else the one of the longest
+// matching prefix, else the default one.
+func (l *RateLimiter) policy(route string) (RateLimitPolicy, bool) {
+	if p, ok := l.policies[route]; ok {
+		return p, true
+	}
+	best, bestLen := "", -1
+	for key := range l.policies {
+		prefix := strings.TrimSuffix(key, "*")
+		if prefix != key && strings.HasPrefix(route, prefix) && len(prefix) > bestLen {
+			best, bestLen = key, len(prefix)
+		}
+	}
+	if bestLen >= 0 {
+		return l.policies[best], true
+	}
+	p, ok := l.policies["default"]
+	return p, ok
+}
+
+func (l *RateLimiter) client(r *http.Request, p RateLimitPolicy) string {
+	if p.By == RateLimitByUser && l.identify != nil {
+		if user := l.identify(r); user != "" {
+			return "user:" + user
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// take removes a token from the bucket of key. It returns whether there was
+// one, the tokens left, how long until the bucket is full again and, when
+// there was no token, how long until the next one.
+func (l *RateLimiter) take(key string, p RateLimitPolicy) (bool, int, time.Duration, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	l.requests++
+	if l.requests%1000 == 0 {
+		l.prune(now)
+	}
+	capacity, rate := p.capacity(), p.rate()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+	allowed := b.tokens >= 1
+	wait := time.Duration(0)
+	if allowed {
+		b.tokens--
+	} else {
+		wait = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	full := time.Duration((capacity - b.tokens) / rate * float64(time.Second))
+	return allowed, int(b.tokens), full, wait
+}
+
+// prune drops the buckets idle for an hour. With periods up to an hour they
+// are full again, which is the same as having no bucket.
+func (l *RateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) > time.Hour {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Limit applies to h the policy of the mux route it serves. The response
+// carries the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers, and Retry-After when the request is refused.
+func (l *RateLimiter) Limit(h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		p, ok := l.policy(route)
+		if !ok || p.Requests == 0 {
+			h(rw, r)
+			return
+		}
+		allowed, remaining, reset, wait := l.take(route+"|"+l.client(r, p), p)
+		rw.Header().Set("RateLimit-Limit", strconv.Itoa(int(p.capacity())))
+		rw.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		rw.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+		if !allowed {
+			retry := int(math.Ceil(wait.Seconds()))
+			rw.Header().Set("Retry-After", strconv.Itoa(retry))
+			handleError(&APIError{
+				Status:  http.StatusTooManyRequests,
+				Code:    "rate_limited",
+				Message: "Too many requests, retry in " + strconv.Itoa(retry) + " seconds",
+			}, rw)
+			return
+		}
+		h(rw, r)
+	}
+}
+
+// tokenSubject returns the email of a valid bearer token or API key, without
+// checking revocation or the user. It is good enough to tell clients apart.
+func (j *JWTService) tokenSubject(r *http.Request) string {
+	token, _ := bearerToken(r)
+	if token == "" {
+		return ""
+	}
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		key, err := apiKeys.Get(hashToken(token))
+		if err != nil {
+			return ""
+		}
+		return key.Email
+	}
+	auth, err := j.ParseJWT(token)
+	if err != nil {
+		return ""
+	}
+	return auth.Email
+}
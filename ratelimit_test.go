@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRateLimiter_Policy(t *testing.T) {
+	l := NewRateLimiter(defaultRateLimits(), nil)
+	cases := map[string]int{
+		"/user/register":            5,
+		"/user/me":                  120,
+		"/admin/ban":                60,
+		"/admin/users/{email}/bans": 60,
+	}
+	for route, want := range cases {
+		if p, _ := l.policy(route); p.Requests != want {
+			t.Errorf("%s: got %d requests, want %d", route, p.Requests, want)
+		}
+	}
+}
+
+func TestRateLimiter_Limit(t *testing.T) {
+	doRequest := createRequester(t)
+	minute := Duration{time.Minute}
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	l := NewRateLimiter(map[string]RateLimitPolicy{
+		"default":  {Requests: 2, Per: minute, By: RateLimitByIP},
+		"/admin/*": {Requests: 1, Per: minute, By: RateLimitByUser},
+		"/metrics": {},
+	}, j.tokenSubject)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }
+	r := mux.NewRouter()
+	r.HandleFunc("/user/me", l.Limit(ok))
+	r.HandleFunc("/admin/ban", l.Limit(ok))
+	r.HandleFunc("/metrics", l.Limit(ok))
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	get := func(path, token string) parsedResponse {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		if token != "" {
+			req.Header.Add("Authorization", "Bearer "+token)
+		}
+		return doRequest(req, nil)
+	}
+	headers := func(path string) http.Header {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header
+	}
+
+	t.Run("bucket runs out and refills", func(t *testing.T) {
+		h := headers("/user/me")
+		if h.Get("RateLimit-Limit") != "2" || h.Get("RateLimit-Remaining") != "1" || h.Get("RateLimit-Reset") != "30" {
+			t.Errorf("Unexpected headers: %v", h)
+		}
+		assertStatus(t, 200, get("/user/me", ""))
+		h = headers("/user/me")
+		if h.Get("Retry-After") != "30" || h.Get("RateLimit-Remaining") != "0" {
+			t.Errorf("Unexpected headers: %v", h)
+		}
+		assertError(t, 429, "rate_limited", "Too many requests, retry in 30 seconds", get("/user/me", ""))
+		now = now.Add(30 * time.Second)
+		assertStatus(t, 200, get("/user/me", ""))
+	})
+
+	t.Run("by user", func(t *testing.T) {
+		one, _ := j.GenearateJWT(User{Email: "one@mail.com"})
+		two, _ := j.GenearateJWT(User{Email: "two@mail.com"})
+		assertStatus(t, 200, get("/admin/ban", one))
+		assertStatus(t, 429, get("/admin/ban", one))
+		assertStatus(t, 200, get("/admin/ban", two))
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			assertStatus(t, 200, get("/metrics", ""))
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+type Permission string
+
+const (
+	PermUsersBan      Permission = "users:ban"
+	PermUsersUnban    Permission = "users:unban"
+	PermUsersInspect  Permission = "users:inspect"
+	PermAdminsManage  Permission = "admins:manage"
+	PermAdminsPromote Permission = "admins:promote"
+	PermAdminsFire    Permission = "admins:fire"
+	PermAuditRead     Permission = "audit:read"
+	PermClientsManage Permission = "clients:manage"
+	PermMetricsRead   Permission = "metrics:read"
+	// PermUsersImpersonate also needs the superadmin role.
+	PermUsersImpersonate Permission = "users:impersonate"
+
+	// PermAll grants every permission.
+	PermAll Permission = "*"
+)
+
+var knownPermissions = map[Permission]bool{
+	PermUsersBan:         true,
+	PermUsersUnban:       true,
+	PermUsersInspect:     true,
+	PermAdminsManage:     true,
+	PermAdminsPromote:    true,
+	PermAdminsFire:       true,
+	PermAuditRead:        true,
+	PermClientsManage:    true,
+	PermMetricsRead:      true,
+	PermUsersImpersonate: true,
+	PermAll:              true,
+}
+
+const (
+	RoleUser       = ""
+	RoleAdmin      = "admin"
+	RoleSuperadmin = "superadmin"
+)
+
+// Roles maps a role name to the permissions it grants.
+type Roles map[string][]Permission
+
+// roles is consulted by jwtAuthorize and by the admin handlers.
+var roles = defaultRoles()
+
+func defaultRoles() Roles {
+	return Roles{
+		RoleAdmin:      {PermUsersBan, PermUsersUnban, PermUsersInspect},
+		RoleSuperadmin: {PermAll},
+	}
+}
+
+// LoadRoles reads a JSON object of role names to permission lists. A missing
+// file yields the default roles.
+func LoadRoles(path string) (Roles, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return defaultRoles(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := Roles{}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	for role, perms := range r {
+		for _, p := range perms {
+			if !knownPermissions[p] {
+				return nil, fmt.Errorf("role %q: unknown permission %q", role, p)
+			}
+		}
+	}
+	return r, nil
+}
+
+func (r Roles) Allows(role string, perm Permission) bool {
+	for _, p := range r[role] {
+		if p == perm || p == PermAll {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether u may use perm in r, an API key restricts its
+// owner to the key's scopes.
+func allowed(r *http.Request, u User, perm Permission) bool {
+	if key := apiKeyFrom(r); key != nil && !key.allows(perm) {
+		return false
+	}
+	return roles.Allows(u.Role, perm)
+}
+
+// isStaff reports whether the role belongs to an admin account, those can
+// only be managed by holders of PermAdminsManage.
+func isStaff(role string) bool {
+	return role != RoleUser
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	t.Run("load roles", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "roles.json")
+		ioutil.WriteFile(path, []byte(`{"moderator": ["users:inspect"]}`), 0600)
+		r, err := LoadRoles(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !r.Allows("moderator", PermUsersInspect) || r.Allows("moderator", PermUsersBan) {
+			t.Errorf("Unexpected permissions: %v", r)
+		}
+		if r.Allows(RoleSuperadmin, PermUsersBan) {
+			t.Errorf("roles from the file should replace the default ones")
+		}
+	})
+
+	t.Run("unknown permission", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "roles.json")
+		ioutil.WriteFile(path, []byte(`{"moderator": ["users:delete"]}`), 0600)
+		if _, err := LoadRoles(path); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		r, err := LoadRoles(filepath.Join(t.TempDir(), "roles.json"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !r.Allows(RoleSuperadmin, PermAdminsPromote) || !r.Allows(RoleAdmin, PermUsersBan) || r.Allows(RoleAdmin, PermAdminsFire) {
+			t.Errorf("Unexpected default roles: %v", r)
+		}
+	})
+}
+
+func TestJWTAuthorize_OutdatedRole(t *testing.T) {
+	doRequest := createRequester(t)
+	u := newTestUserService()
+	u.repository.Add("test@mail.com", User{Email: "test@mail.com", FavoriteCake: "cake", Role: RoleAdmin})
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	ts := httptest.NewServer(j.jwtAuthorize(u.repository, inspectHandler, PermUsersInspect))
+	defer ts.Close()
+
+	user, _ := u.repository.Get("test@mail.com")
+	token, _ := j.GenearateJWT(user)
+	user.Role = RoleUser
+	u.repository.Update(user.Email, user)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	resp := doRequest(req, nil)
+	assertError(t, 401, "unauthorized", "unauthorized", resp)
+}
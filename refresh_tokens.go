@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// RefreshToken is the server side record of an issued refresh token. Only
+// the hash of the token is stored. Every token obtained by rotating another
+// one shares its Family, so a reused token can revoke all of its successors.
+type RefreshToken struct {
+	Hash      string
+	Family    string
+	Email     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	Used      bool
+	Revoked   bool
+}
+
+type RefreshTokenStore interface {
+	Save(RefreshToken) error
+	Get(hash string) (RefreshToken, error)
+	// MarkUsed flags the token as rotated. It fails if the token was
+	// already used, so only one of concurrent refreshes can win.
+	MarkUsed(hash string) error
+	RevokeFamily(family string) error
+}
+
+var (
+	errRefreshTokenNotFound = newUnauthorizedError("invalid_refresh_token", "invalid refresh token")
+	errRefreshTokenRevoked  = newUnauthorizedError("refresh_token_revoked", "refresh token has been revoked")
+	errRefreshTokenUsed     = errors.New("refresh token has already been used")
+)
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type InMemoryRefreshTokenStore struct {
+	lock   sync.Mutex
+	tokens map[string]RefreshToken
+}
+
+func NewInMemoryRefreshTokenStore() *InMemoryRefreshTokenStore {
+	return &InMemoryRefreshTokenStore{
+		tokens: make(map[string]RefreshToken),
+	}
+}
+
+func (i *InMemoryRefreshTokenStore) Save(t RefreshToken) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.tokens[t.Hash] = t
+	return nil
+}
+
+func (i *InMemoryRefreshTokenStore) Get(hash string) (RefreshToken, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	t, ok := i.tokens[hash]
+	if !ok {
+		return RefreshToken{}, errRefreshTokenNotFound
+	}
+	return t, nil
+}
+
+func (i *InMemoryRefreshTokenStore) MarkUsed(hash string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	t, ok := i.tokens[hash]
+	if !ok {
+		return errRefreshTokenNotFound
+	}
+	if t.Used {
+		return errRefreshTokenUsed
+	}
+	t.Used = true
+	i.tokens[hash] = t
+	return nil
+}
+
+func (i *InMemoryRefreshTokenStore) RevokeFamily(family string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for hash, t := range i.tokens {
+		if t.Family == family {
+			t.Revoked = true
+			i.tokens[hash] = t
+		}
+	}
+	return nil
+}
+
+const refreshTokensSchema = `
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	hash       TEXT PRIMARY KEY,
+	family     TEXT NOT NULL,
+	email      TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL,
+	used       INTEGER NOT NULL DEFAULT 0,
+	revoked    INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_family ON refresh_tokens(family);
+`
+
+type SQLiteRefreshTokenStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteRefreshTokenStore(db *sql.DB) (*SQLiteRefreshTokenStore, error) {
+	if _, err := db.Exec(refreshTokensSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteRefreshTokenStore{db: db}, nil
+}
+
+func (s *SQLiteRefreshTokenStore) Save(t RefreshToken) error {
+	_, err := s.db.Exec(`INSERT INTO refresh_tokens (hash, family, email, created_at, expires_at, used, revoked)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, t.Hash, t.Family, t.Email, t.CreatedAt, t.ExpiresAt, t.Used, t.Revoked)
+	return err
+}
+
+func (s *SQLiteRefreshTokenStore) Get(hash string) (RefreshToken, error) {
+	t := RefreshToken{}
+	err := s.db.QueryRow(`SELECT hash, family, email, created_at, expires_at, used, revoked
+		FROM refresh_tokens WHERE hash = ?`, hash).
+		Scan(&t.Hash, &t.Family, &t.Email, &t.CreatedAt, &t.ExpiresAt, &t.Used, &t.Revoked)
+	if err == sql.ErrNoRows {
+		return RefreshToken{}, errRefreshTokenNotFound
+	}
+	return t, err
+}
+
+func (s *SQLiteRefreshTokenStore) MarkUsed(hash string) error {
+	res, err := s.db.Exec(`UPDATE refresh_tokens SET used = 1 WHERE hash = ? AND used = 0`, hash)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := s.Get(hash); err != nil {
+			return err
+		}
+		return errRefreshTokenUsed
+	}
+	return nil
+}
+
+func (s *SQLiteRefreshTokenStore) RevokeFamily(family string) error {
+	_, err := s.db.Exec(`UPDATE refresh_tokens SET revoked = 1 WHERE family = ?`, family)
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUsers_Refresh(t *testing.T) {
+	doRequest := createRequester(t)
+	login := func(t *testing.T, u *UserService, j *JWTService) TokenPair {
+		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
+		ts_2 := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		defer ts_1.Close()
+		defer ts_2.Close()
+		params := map[string]interface{}{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": "cake",
+		}
+		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params)))
+		resp := doRequest(http.NewRequest(http.MethodPost, ts_2.URL, prepareParams(t, params)))
+		tokens := TokenPair{}
+		if err := json.Unmarshal(resp.body, &tokens); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return tokens
+	}
+
+	t.Run("refresh rotates tokens", func(t *testing.T) {
+		u := newTestUserService()
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+		if err != nil {
+			t.FailNow()
+		}
+		tokens := login(t, u, j)
+		ts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.Refresh)))
+		defer ts.Close()
+
+		params := map[string]interface{}{"refresh_token": tokens.RefreshToken}
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		assertStatus(t, 200, resp)
+		rotated := TokenPair{}
+		json.Unmarshal(resp.body, &rotated)
+		if rotated.RefreshToken == "" || rotated.RefreshToken == tokens.RefreshToken {
+			t.Errorf("refresh token was not rotated")
+		}
+		if auth, err := j.ParseJWT(rotated.AccessToken); err != nil || auth.Email != "test@mail.com" {
+			t.Errorf("Unexpected access token: %v", err)
+		}
+	})
+
+	t.Run("reuse revokes the family", func(t *testing.T) {
+		u := newTestUserService()
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+		if err != nil {
+			t.FailNow()
+		}
+		tokens := login(t, u, j)
+		ts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.Refresh)))
+		defer ts.Close()
+
+		params := map[string]interface{}{"refresh_token": tokens.RefreshToken}
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		rotated := TokenPair{}
+		json.Unmarshal(resp.body, &rotated)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		assertError(t, 401, "refresh_token_reused", "refresh token reuse detected", resp)
+
+		params = map[string]interface{}{"refresh_token": rotated.RefreshToken}
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		assertError(t, 401, "refresh_token_revoked", "refresh token has been revoked", resp)
+	})
+
+	t.Run("expired access token", func(t *testing.T) {
+		u := newTestUserService()
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+		if err != nil {
+			t.FailNow()
+		}
+		j.AccessTTL = -time.Minute
+		u.repository.Add("test@mail.com", User{Email: "test@mail.com", FavoriteCake: "cake"})
+		user, _ := u.repository.Get("test@mail.com")
+		token, _ := j.GenearateJWT(user)
+		ts := httptest.NewServer(j.jwtAuthorize(u.repository, getMyData))
+		defer ts.Close()
+
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		resp := doRequest(req, nil)
+		assertStatus(t, 401, resp)
+	})
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	cases := map[string]string{
+		"":                                       contentTypeJSON,
+		"*/*":                                    contentTypeJSON,
+		"text/plain":                             contentTypePlain,
+		"text/*":                                 contentTypePlain,
+		"application/json":                       contentTypeJSON,
+		"text/plain;q=0.5, application/json":     contentTypeJSON,
+		"application/json;q=0.2, text/plain":     contentTypePlain,
+		"text/html, text/plain;q=0.9, */*;q=0.1": contentTypePlain,
+	}
+	for accept, expected := range cases {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		if actual := negotiate(r, contentTypeJSON, contentTypePlain); actual != expected {
+			t.Errorf("Accept %q: expected %s, actual %s", accept, expected, actual)
+		}
+	}
+}
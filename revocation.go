@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// RevocationStore keeps track of access tokens which must be refused before
+// they expire: single tokens are denylisted by their JTI, all tokens of a
+// user are invalidated by moving the user's watermark forward.
+type RevocationStore interface {
+	RevokeToken(jti string, expiresAt time.Time) error
+	IsTokenRevoked(jti string) (bool, error)
+	RevokeUser(email string, before time.Time) error
+	// RevokedBefore returns the user's watermark, tokens issued before it
+	// are invalid. Zero time means nothing has been revoked.
+	RevokedBefore(email string) (time.Time, error)
+}
+
+// revocations is consulted by every auth middleware.
+var revocations RevocationStore = NewInMemoryRevocationStore()
+
+// revokeUserTokens invalidates every token issued to email so far and ends
+// the sessions.
+func revokeUserTokens(email string) {
+	if err := revocations.RevokeUser(email, time.Now()); err != nil {
+		log.Println("Could not revoke tokens of", email, err)
+	}
+	if err := sessions.DeleteUser(email, ""); err != nil {
+		log.Println("Could not end sessions of", email, err)
+	}
+}
+
+// issuedAtSecond is when a token whose iat only has a one second resolution
+// was issued at the latest. Such a token is only refused by a revocation of
+// a later second, the same second can't tell a token issued before the
+// revocation from a login right after it.
+func issuedAtSecond(iat int64) time.Time {
+	return time.Unix(iat, int64(time.Second-1))
+}
+
+// issuedAt is when a token was issued, as precisely as its claims tell.
+func issuedAt(iat, iatNano int64) time.Time {
+	if iatNano != 0 {
+		return time.Unix(0, iatNano)
+	}
+	return issuedAtSecond(iat)
+}
+
+// isRevoked compares issuedAt with the watermark at full precision.
+func isRevoked(email, jti string, issuedAt time.Time) (bool, error) {
+	if jti != "" {
+		revoked, err := revocations.IsTokenRevoked(jti)
+		if err != nil || revoked {
+			return true, err
+		}
+	}
+	before, err := revocations.RevokedBefore(email)
+	if err != nil {
+		return true, err
+	}
+	return issuedAt.Before(before), nil
+}
+
+type InMemoryRevocationStore struct {
+	lock      sync.RWMutex
+	tokens    map[string]time.Time
+	watermark map[string]time.Time
+}
+
+func NewInMemoryRevocationStore() *InMemoryRevocationStore {
+	return &InMemoryRevocationStore{
+		tokens:    make(map[string]time.Time),
+		watermark: make(map[string]time.Time),
+	}
+}
+
+func (i *InMemoryRevocationStore) RevokeToken(jti string, expiresAt time.Time) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	now := time.Now()
+	for key, exp := range i.tokens {
+		if exp.Before(now) {
+			delete(i.tokens, key)
+		}
+	}
+	i.tokens[jti] = expiresAt
+	return nil
+}
+
+func (i *InMemoryRevocationStore) IsTokenRevoked(jti string) (bool, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	_, ok := i.tokens[jti]
+	return ok, nil
+}
+
+func (i *InMemoryRevocationStore) RevokeUser(email string, before time.Time) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if before.After(i.watermark[email]) {
+		i.watermark[email] = before
+	}
+	return nil
+}
+
+func (i *InMemoryRevocationStore) RevokedBefore(email string) (time.Time, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.watermark[email], nil
+}
+
+const revocationSchema = `
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	jti        TEXT PRIMARY KEY,
+	expires_at DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS token_watermarks (
+	email  TEXT PRIMARY KEY,
+	before DATETIME NOT NULL
+);
+`
+
+// SQLiteRevocationStore stores the times in UTC, sqlite compares them as
+// text.
+type SQLiteRevocationStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteRevocationStore(db *sql.DB) (*SQLiteRevocationStore, error) {
+	if _, err := db.Exec(revocationSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteRevocationStore{db: db}, nil
+}
+
+func (s *SQLiteRevocationStore) RevokeToken(jti string, expiresAt time.Time) error {
+	if _, err := s.db.Exec(`DELETE FROM revoked_tokens WHERE expires_at < ?`, time.Now().UTC()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO revoked_tokens (jti, expires_at) VALUES (?, ?)`, jti, expiresAt.UTC())
+	return err
+}
+
+func (s *SQLiteRevocationStore) IsTokenRevoked(jti string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM revoked_tokens WHERE jti = ?`, jti).Scan(&n)
+	return n > 0, err
+}
+
+func (s *SQLiteRevocationStore) RevokeUser(email string, before time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO token_watermarks (email, before) VALUES (?, ?)
+		ON CONFLICT(email) DO UPDATE SET before = excluded.before WHERE excluded.before > token_watermarks.before`,
+		email, before.UTC())
+	return err
+}
+
+func (s *SQLiteRevocationStore) RevokedBefore(email string) (time.Time, error) {
+	var before time.Time
+	err := s.db.QueryRow(`SELECT before FROM token_watermarks WHERE email = ?`, email).Scan(&before)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return before, err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func forgeTokenIssuedAt(t *testing.T, j *JWTService, email string, iat time.Time) string {
+	token, err := j.forgeToken(User{Email: email, Role: RoleUser},
+		jwt.MapClaims{"iat": iat.Unix(), "iat_ns": iat.UnixNano(), "jti": email + iat.String()})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return token
+}
+
+func TestRevocation(t *testing.T) {
+	doRequest := createRequester(t)
+	t.Run("banned user token is refused", func(t *testing.T) {
+		u := newTestUserService()
+		Superadmin := User{os.Getenv("CAKE_ADMIN_EMAIL"), os.Getenv("CAKE_ADMIN_PASSWORD"),
+			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}, "", ""}
+		u.repository.Add(Superadmin.Email, Superadmin)
+		u.repository.Add("revoke-ban@mail.com", User{Email: "revoke-ban@mail.com", FavoriteCake: "cake", BanHistory: *NewBanHistory()})
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+		if err != nil {
+			t.FailNow()
+		}
+		ts_1 := httptest.NewServer(j.jwtAuthorize(u.repository, banHandler, PermUsersBan))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, getMyData))
+		defer ts_1.Close()
+		defer ts_2.Close()
+
+		userToken := forgeTokenIssuedAt(t, j, "revoke-ban@mail.com", time.Now().Add(-time.Minute))
+		req, _ := http.NewRequest(http.MethodGet, ts_2.URL, nil)
+		req.Header.Add("Authorization", "Bearer "+userToken)
+		assertStatus(t, 200, doRequest(req, nil))
+
+		admin, _ := u.repository.Get(os.Getenv("CAKE_ADMIN_EMAIL"))
+		token, _ := j.GenearateJWT(admin)
+		banparams := map[string]interface{}{
+			"email":  "revoke-ban@mail.com",
+			"reason": "because",
+		}
+		req, _ = http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, banparams))
+		req.Header.Add("Authorization", "Bearer "+token)
+		assertStatus(t, 201, doRequest(req, nil))
+
+		req, _ = http.NewRequest(http.MethodGet, ts_2.URL, nil)
+		req.Header.Add("Authorization", "Bearer "+userToken)
+		resp := doRequest(req, nil)
+		assertError(t, 401, "unauthorized", "unauthorized", resp)
+	})
+
+	t.Run("password change revokes older tokens", func(t *testing.T) {
+		u := newTestUserService()
+		u.repository.Add("revoke-pass@mail.com", User{Email: "revoke-pass@mail.com", FavoriteCake: "cake"})
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+		if err != nil {
+			t.FailNow()
+		}
+		ts := httptest.NewServer(j.jwtAuthorize(u.repository, changePassHandler))
+		defer ts.Close()
+		token := forgeTokenIssuedAt(t, j, "revoke-pass@mail.com", time.Now().Add(-time.Minute))
+		params := map[string]interface{}{
+			"email":    "revoke-pass@mail.com",
+			"password": "mynewpass",
+		}
+		req, _ := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Add("Authorization", "Bearer "+token)
+		assertStatus(t, 201, doRequest(req, nil))
+
+		req, _ = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Add("Authorization", "Bearer "+token)
+		assertStatus(t, 401, doRequest(req, nil))
+	})
+
+	t.Run("denylisted token is refused", func(t *testing.T) {
+		u := newTestUserService()
+		u.repository.Add("revoke-jti@mail.com", User{Email: "revoke-jti@mail.com", FavoriteCake: "cake"})
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+		if err != nil {
+			t.FailNow()
+		}
+		ts := httptest.NewServer(j.jwtAuthorize(u.repository, getMyData))
+		defer ts.Close()
+		user, _ := u.repository.Get("revoke-jti@mail.com")
+		token, _ := j.GenearateJWT(user)
+		parsed, _ := j.ParseJWT(token)
+		revocations.RevokeToken(parsed.Id, time.Unix(parsed.ExpiresAt, 0))
+
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		assertStatus(t, 401, doRequest(req, nil))
+	})
+
+	t.Run("revocation is precise within a second", func(t *testing.T) {
+		u := newTestUserService()
+		u.repository.Add("revoke-same@mail.com", User{Email: "revoke-same@mail.com", FavoriteCake: "cake"})
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+		if err != nil {
+			t.FailNow()
+		}
+		ts := httptest.NewServer(j.jwtAuthorize(u.repository, getMyData))
+		defer ts.Close()
+		send := func(token string) parsedResponse {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+			req.Header.Add("Authorization", "Bearer "+token)
+			return doRequest(req, nil)
+		}
+		user, _ := u.repository.Get("revoke-same@mail.com")
+		before, _ := j.GenearateJWT(user)
+		revokeUserTokens(user.Email)
+		after, _ := j.GenearateJWT(user)
+		assertStatus(t, 401, send(before))
+		assertStatus(t, 200, send(after))
+
+		// tokens without iat_ns only lose to a revocation of a later second
+		watermark, _ := revocations.RevokedBefore(user.Email)
+		legacy, _ := j.forgeToken(user, jwt.MapClaims{"iat": watermark.Unix(), "iat_ns": nil})
+		assertStatus(t, 200, send(legacy))
+		legacy, _ = j.forgeToken(user, jwt.MapClaims{"iat": watermark.Unix() - 1, "iat_ns": nil})
+		assertStatus(t, 401, send(legacy))
+	})
+}
+
+func TestSQLiteRevocationStore(t *testing.T) {
+	users := newTestSQLiteStorage(t)
+	s, err := NewSQLiteRevocationStore(users.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sqlite compares the times as text, the local zone must not matter
+	defer func(local *time.Location) { time.Local = local }(time.Local)
+	time.Local = time.FixedZone("east", 5*3600)
+	west := time.FixedZone("west", -10*3600)
+	now := time.Now()
+	s.RevokeUser("test@mail.com", now.In(west))
+	s.RevokeUser("test@mail.com", now.Add(-time.Millisecond))
+	before, err := s.RevokedBefore("test@mail.com")
+	if err != nil || !before.Equal(now) {
+		t.Fatalf("Unexpected watermark: %v, %v", before, err)
+	}
+	s.RevokeToken("first", now.Add(time.Hour).In(west))
+	s.RevokeToken("second", now.Add(time.Hour))
+	if revoked, err := s.IsTokenRevoked("first"); err != nil || !revoked {
+		t.Errorf("a revoked token which hasn't expired should stay revoked: %v", err)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session is a login on a device. Its ID is the family of its refresh
+// tokens and the sid claim of its access tokens, so ending a session refuses
+// both at once.
+type Session struct {
+	ID        string
+	Email     string
+	Device    string
+	UserAgent string
+	IP        string
+	CreatedAt time.Time
+	LastSeen  time.Time
+	// ExpiresAt moves forward with every refresh, like the refresh tokens.
+	ExpiresAt time.Time
+}
+
+type SessionStore interface {
+	Save(Session) error
+	Get(id string) (Session, error)
+	// List returns the unexpired sessions of email, last seen first.
+	List(email string) ([]Session, error)
+	Delete(id string) error
+	// DeleteUser deletes the sessions of email, but keep.
+	DeleteUser(email, keep string) error
+}
+
+var sessions SessionStore = NewInMemorySessionStore()
+
+const (
+	maxDeviceLength = 64
+	// sessionTouchInterval spares a write on every request to keep LastSeen
+	// up to date.
+	sessionTouchInterval = time.Minute
+)
+
+var (
+	errSessionEnded = newUnauthorizedError("session_ended", "This session has ended")
+	errNoSession    = newBadRequestError("no_session", "This token doesn't belong to a session")
+)
+
+type sessionContextKey struct{}
+
+func withSession(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, id))
+}
+
+// sessionFrom returns the ID of the session r was authenticated with, empty
+// for tokens issued without one and API keys.
+func sessionFrom(r *http.Request) string {
+	id, _ := r.Context().Value(sessionContextKey{}).(string)
+	return id
+}
+
+// StartSession records a login of u from r and issues its first tokens.
+func (j *JWTService) StartSession(r *http.Request, u User, device string) (TokenPair, error) {
+	id, err := randomToken(16)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if runes := []rune(device); len(runes) > maxDeviceLength {
+		device = string(runes[:maxDeviceLength])
+	}
+	now := time.Now()
+	err = sessions.Save(Session{
+		ID:        id,
+		Email:     u.Email,
+		Device:    device,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(j.RefreshTTL),
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return j.IssueTokens(u, id)
+}
+
+// activeSession returns the unexpired session id of email.
+func activeSession(id, email string, now time.Time) (Session, error) {
+	s, err := sessions.Get(id)
+	if err != nil {
+		return Session{}, err
+	}
+	if s.Email != email || now.After(s.ExpiresAt) {
+		return Session{}, errSessionEnded
+	}
+	return s, nil
+}
+
+// touchSession records that s is used from r.
+func touchSession(s Session, r *http.Request, now time.Time) {
+	if now.Sub(s.LastSeen) < sessionTouchInterval {
+		return
+	}
+	s.LastSeen, s.IP = now, clientIP(r)
+	if err := sessions.Save(s); err != nil {
+		log.Println("Could not update session of", s.Email, err)
+	}
+}
+
+type SessionRecord struct {
+	ID        string    `json:"id"`
+	Device    string    `json:"device"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	Current   bool      `json:"current"`
+}
+
+type SessionsResponse struct {
+	Sessions []SessionRecord `json:"sessions"`
+}
+
+func listSessionsHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	list, err := sessions.List(u.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	current := sessionFrom(r)
+	resp := SessionsResponse{Sessions: []SessionRecord{}}
+	for _, s := range list {
+		resp.Sessions = append(resp.Sessions, SessionRecord{
+			ID:        s.ID,
+			Device:    s.Device,
+			UserAgent: s.UserAgent,
+			IP:        s.IP,
+			CreatedAt: s.CreatedAt,
+			LastSeen:  s.LastSeen,
+			Current:   s.ID == current,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// logoutHandler ends the session of the request, its tokens stop working
+// right away.
+func logoutHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	id := sessionFrom(r)
+	if id == "" {
+		handleError(errNoSession, w)
+		return
+	}
+	if err := sessions.Delete(id); err != nil {
+		handleError(err, w)
+		return
+	}
+	clearSessionCookies(w)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("You have been logged out"))
+}
+
+func logoutOthersHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	id := sessionFrom(r)
+	if id == "" {
+		handleError(errNoSession, w)
+		return
+	}
+	if err := sessions.DeleteUser(u.Email, id); err != nil {
+		handleError(err, w)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("Your other sessions have been logged out"))
+}
+
+type InMemorySessionStore struct {
+	lock     sync.Mutex
+	sessions map[string]Session
+}
+
+func NewInMemorySessionStore() *InMemorySessionStore {
+	return &InMemorySessionStore{sessions: make(map[string]Session)}
+}
+
+func (i *InMemorySessionStore) Save(s Session) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	now := time.Now()
+	for id, old := range i.sessions {
+		if now.After(old.ExpiresAt) {
+			delete(i.sessions, id)
+		}
+	}
+	i.sessions[s.ID] = s
+	return nil
+}
+
+func (i *InMemorySessionStore) Get(id string) (Session, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	s, ok := i.sessions[id]
+	if !ok {
+		return Session{}, errSessionEnded
+	}
+	return s, nil
+}
+
+func (i *InMemorySessionStore) List(email string) ([]Session, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	now := time.Now()
+	list := []Session{}
+	for _, s := range i.sessions {
+		if s.Email == email && !now.After(s.ExpiresAt) {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].LastSeen.After(list[b].LastSeen) })
+	return list, nil
+}
+
+func (i *InMemorySessionStore) Delete(id string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	delete(i.sessions, id)
+	return nil
+}
+
+func (i *InMemorySessionStore) DeleteUser(email, keep string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for id, s := range i.sessions {
+		if s.Email == email && id != keep {
+			delete(i.sessions, id)
+		}
+	}
+	return nil
+}
+
+const sessionsSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id         TEXT PRIMARY KEY,
+	email      TEXT NOT NULL,
+	device     TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip         TEXT NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL,
+	last_seen  DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessions_email ON sessions(email);
+`
+
+type SQLiteSessionStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteSessionStore(db *sql.DB) (*SQLiteSessionStore, error) {
+	if _, err := db.Exec(sessionsSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteSessionStore{db: db}, nil
+}
+
+func (s *SQLiteSessionStore) Save(session Session) error {
+	if _, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at < ?`, time.Now()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO sessions (id, email, device, user_agent, ip, created_at, last_seen, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, session.ID, session.Email, session.Device, session.UserAgent, session.IP,
+		session.CreatedAt, session.LastSeen, session.ExpiresAt)
+	return err
+}
+
+func scanSession(row rowScanner) (Session, error) {
+	s := Session{}
+	err := row.Scan(&s.ID, &s.Email, &s.Device, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeen, &s.ExpiresAt)
+	return s, err
+}
+
+func (s *SQLiteSessionStore) Get(id string) (Session, error) {
+	session, err := scanSession(s.db.QueryRow(`SELECT id, email, device, user_agent, ip, created_at, last_seen, expires_at
+		FROM sessions WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return Session{}, errSessionEnded
+	}
+	return session, err
+}
+
+func (s *SQLiteSessionStore) List(email string) ([]Session, error) {
+	rows, err := s.db.Query(`SELECT id, email, device, user_agent, ip, created_at, last_seen, expires_at
+		FROM sessions WHERE email = ? AND expires_at >= ? ORDER BY last_seen DESC`, email, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, session)
+	}
+	return list, rows.Err()
+}
+
+func (s *SQLiteSessionStore) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
+
+func (s *SQLiteSessionStore) DeleteUser(email, keep string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE email = ? AND id != ?`, email, keep)
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useSessions gives the test its own session store.
+func useSessions(t *testing.T) {
+	old := sessions
+	sessions = NewInMemorySessionStore()
+	t.Cleanup(func() { sessions = old })
+}
+
+func TestSessions(t *testing.T) {
+	doRequest := createRequester(t)
+	useLockoutPolicy(t, defaultLockoutPolicy())
+	useSessions(t)
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	u := newTestUserService()
+	digest, _ := hashPassword("somepass")
+	u.repository.Add("test@mail.com", User{"test@mail.com", digest, "cake", RoleUser, false, BanHistory{}, "", ""})
+	superadmin := User{"super@mail.com", "", "cake", RoleSuperadmin, false, BanHistory{}, "", ""}
+	u.repository.Add(superadmin.Email, superadmin)
+	login := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+	defer login.Close()
+	refresh := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.Refresh)))
+	defer refresh.Close()
+	list := httptest.NewServer(j.jwtAuthorize(u.repository, listSessionsHandler))
+	defer list.Close()
+	logout := httptest.NewServer(j.jwtAuthorize(u.repository, logoutHandler))
+	defer logout.Close()
+	logoutOthers := httptest.NewServer(j.jwtAuthorize(u.repository, logoutOthersHandler))
+	defer logoutOthers.Close()
+	ban := httptest.NewServer(j.jwtAuthorize(u.repository, banHandler, PermUsersBan))
+	defer ban.Close()
+
+	signIn := func(device, agent string) TokenPair {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, login.URL, prepareParams(t, map[string]interface{}{
+			"email": "test@mail.com", "password": "somepass", "device": device}))
+		req.Header.Set("User-Agent", agent)
+		resp := doRequest(req, nil)
+		assertStatus(t, 200, resp)
+		tokens := TokenPair{}
+		json.Unmarshal(resp.body, &tokens)
+		return tokens
+	}
+	send := func(method, url, token string, params map[string]interface{}) parsedResponse {
+		req, _ := http.NewRequest(method, url, prepareParams(t, params))
+		req.Header.Add("Authorization", "Bearer "+token)
+		return doRequest(req, nil)
+	}
+	listSessions := func(token string) []SessionRecord {
+		t.Helper()
+		resp := send(http.MethodGet, list.URL, token, nil)
+		assertStatus(t, 200, resp)
+		list := SessionsResponse{}
+		json.Unmarshal(resp.body, &list)
+		return list.Sessions
+	}
+	refreshWith := func(tokens TokenPair) parsedResponse {
+		return doRequest(http.NewRequest(http.MethodPost, refresh.URL,
+			prepareParams(t, map[string]interface{}{"refresh_token": tokens.RefreshToken})))
+	}
+
+	t.Run("list the sessions", func(t *testing.T) {
+		laptop := signIn("laptop", "Firefox")
+		signIn("phone", "Safari")
+		list := listSessions(laptop.AccessToken)
+		if len(list) != 2 {
+			t.Fatalf("Unexpected sessions: %+v", list)
+		}
+		for _, s := range list {
+			want := map[string]string{"laptop": "Firefox", "phone": "Safari"}[s.Device]
+			if s.UserAgent != want || s.IP == "" || s.CreatedAt.IsZero() || s.Current != (s.Device == "laptop") {
+				t.Errorf("Unexpected session: %+v", s)
+			}
+		}
+		assertStatus(t, 201, send(http.MethodPost, logoutOthers.URL, laptop.AccessToken, nil))
+		assertStatus(t, 201, send(http.MethodPost, logout.URL, laptop.AccessToken, nil))
+	})
+
+	t.Run("logout ends the session", func(t *testing.T) {
+		tokens := signIn("laptop", "Firefox")
+		resp := send(http.MethodPost, logout.URL, tokens.AccessToken, nil)
+		assertStatus(t, 201, resp)
+		assertBody(t, "You have been logged out", resp)
+		assertStatus(t, 401, send(http.MethodGet, list.URL, tokens.AccessToken, nil))
+		assertError(t, 401, "session_ended", "This session has ended", refreshWith(tokens))
+	})
+
+	t.Run("logout others keeps the current session", func(t *testing.T) {
+		laptop := signIn("laptop", "Firefox")
+		phone := signIn("phone", "Safari")
+		resp := send(http.MethodPost, logoutOthers.URL, laptop.AccessToken, nil)
+		assertStatus(t, 201, resp)
+		assertBody(t, "Your other sessions have been logged out", resp)
+		assertStatus(t, 401, send(http.MethodGet, list.URL, phone.AccessToken, nil))
+		assertStatus(t, 401, refreshWith(phone))
+		if list := listSessions(laptop.AccessToken); len(list) != 1 || !list[0].Current {
+			t.Errorf("Unexpected sessions: %+v", list)
+		}
+		resp = refreshWith(laptop)
+		assertStatus(t, 200, resp)
+		rotated := TokenPair{}
+		json.Unmarshal(resp.body, &rotated)
+		if list := listSessions(rotated.AccessToken); len(list) != 1 || !list[0].Current {
+			t.Errorf("refresh should keep the session: %+v", list)
+		}
+		assertStatus(t, 201, send(http.MethodPost, logout.URL, rotated.AccessToken, nil))
+	})
+
+	t.Run("tokens without a session can't log out", func(t *testing.T) {
+		token, _ := j.GenearateJWT(User{Email: "test@mail.com"})
+		assertError(t, 400, "no_session", "This token doesn't belong to a session",
+			send(http.MethodPost, logout.URL, token, nil))
+	})
+
+	t.Run("ban ends the sessions", func(t *testing.T) {
+		tokens := signIn("laptop", "Firefox")
+		admin, _ := j.GenearateJWT(superadmin)
+		assertStatus(t, 201, send(http.MethodPost, ban.URL, admin, map[string]interface{}{
+			"email": "test@mail.com", "reason": "spam"}))
+		if list, _ := sessions.List("test@mail.com"); len(list) != 0 {
+			t.Errorf("Unexpected sessions: %+v", list)
+		}
+		assertStatus(t, 401, send(http.MethodGet, list.URL, tokens.AccessToken, nil))
+		assertStatus(t, 401, refreshWith(tokens))
+	})
+}
+
+func TestSQLiteSessionStore(t *testing.T) {
+	users := newTestSQLiteStorage(t)
+	s, err := NewSQLiteSessionStore(users.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+	s.Save(Session{ID: "a", Email: "test@mail.com", Device: "laptop", UserAgent: "Firefox", IP: "10.0.0.1",
+		CreatedAt: now, LastSeen: now, ExpiresAt: now.Add(time.Hour)})
+	s.Save(Session{ID: "b", Email: "test@mail.com", CreatedAt: now, LastSeen: now.Add(time.Minute), ExpiresAt: now.Add(time.Hour)})
+	s.Save(Session{ID: "c", Email: "test@mail.com", CreatedAt: now, LastSeen: now, ExpiresAt: now.Add(-time.Hour)})
+	if session, err := s.Get("a"); err != nil || session.Device != "laptop" || !session.LastSeen.Equal(now) {
+		t.Fatalf("Unexpected session: %+v, %v", session, err)
+	}
+	list, err := s.List("test@mail.com")
+	if err != nil || len(list) != 2 || list[0].ID != "b" {
+		t.Fatalf("Unexpected sessions: %+v, %v", list, err)
+	}
+	s.DeleteUser("test@mail.com", "a")
+	if list, _ := s.List("test@mail.com"); len(list) != 1 || list[0].ID != "a" {
+		t.Errorf("Unexpected sessions: %+v", list)
+	}
+	s.Delete("a")
+	if _, err := s.Get("a"); err != errSessionEnded {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
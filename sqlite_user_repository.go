@@ -0,0 +1,527 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	email           TEXT PRIMARY KEY,
+	password_digest TEXT NOT NULL,
+	favorite_cake   TEXT NOT NULL,
+	role            TEXT NOT NULL DEFAULT '',
+	banned          INTEGER NOT NULL DEFAULT 0,
+	verification    TEXT NOT NULL DEFAULT '',
+	id              TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS ban_events (
+	user_email TEXT NOT NULL REFERENCES users(email) ON DELETE CASCADE,
+	seq        INTEGER NOT NULL,
+	type       TEXT NOT NULL,
+	at         DATETIME NOT NULL,
+	actor      TEXT NOT NULL,
+	reason     TEXT NOT NULL DEFAULT '',
+	until      DATETIME,
+	PRIMARY KEY (user_email, seq)
+);
+`
+
+type SQLiteUserStorage struct {
+	lock sync.RWMutex
+	db   *sql.DB
+}
+
+func NewSQLiteUserStorage(path string) (*SQLiteUserStorage, error) {
+	db, err := sql.Open("sqlite3", path+"?_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+	// sqlite allows a single writer, one connection keeps it simple
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateBanHistory(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := addColumnIfMissing(db, "users", "verification", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := assignUserIDs(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// Rename moves the two-factor setup along with the account
+	if _, err := db.Exec(twoFactorSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteUserStorage{db: db}, nil
+}
+
+func (s *SQLiteUserStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteUserStorage) Add(email string, u User) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	exists, err := userExists(tx, email)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrUserExists
+	}
+	id, err := newUserID()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO users (email, password_digest, favorite_cake, role, banned, verification, id)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, email, u.PasswordDigest, u.FavoriteCake, u.Role, u.Banned, u.PendingVerification, id)
+	if err != nil {
+		return err
+	}
+	if err := insertBanEvents(tx, email, u.BanHistory, 0); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteUserStorage) Get(email string) (User, error) {
+	return s.getBy("email", email)
+}
+
+func (s *SQLiteUserStorage) GetByID(id string) (User, error) {
+	return s.getBy("id", id)
+}
+
+func (s *SQLiteUserStorage) getBy(column, value string) (User, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	u := User{}
+	row := s.db.QueryRow(`SELECT email, password_digest, favorite_cake, role, banned, verification, id
+		FROM users WHERE `+column+` = ?`, value)
+	err := row.Scan(&u.Email, &u.PasswordDigest, &u.FavoriteCake, &u.Role, &u.Banned, &u.PendingVerification, &u.ID)
+	if err == sql.ErrNoRows {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	history, err := s.loadBanHistory(u.Email)
+	if err != nil {
+		return User{}, err
+	}
+	u.BanHistory = *history
+	return u, nil
+}
+
+func (s *SQLiteUserStorage) Update(email string, u User) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	exists, err := userExists(tx, email)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	// the ban log is append-only, only the events it doesn't have yet
+	// are stored
+	last, err := lastBanEvent(tx, email)
+	if err != nil {
+		return err
+	}
+	if !u.BanHistory.follows(last) {
+		return ErrUserChanged
+	}
+	_, err = tx.Exec(`UPDATE users SET password_digest = ?, favorite_cake = ?, role = ?, banned = ?, verification = ?
+		WHERE email = ?`, u.PasswordDigest, u.FavoriteCake, u.Role, u.Banned, u.PendingVerification, email)
+	if err != nil {
+		return err
+	}
+	if err := insertBanEvents(tx, email, u.BanHistory, last.Seq); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Rename moves the row, the ban events and the two-factor setup in one
+// transaction, a failure leaves the account where it was. The foreign keys
+// are only checked at the end, once the ban events follow the row.
+func (s *SQLiteUserStorage) Rename(email string, u User) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	exists, err := userExists(tx, email)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	taken, err := userExists(tx, u.Email)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrUserExists
+	}
+	last, err := lastBanEvent(tx, email)
+	if err != nil {
+		return err
+	}
+	if !u.BanHistory.follows(last) {
+		return ErrUserChanged
+	}
+	if _, err := tx.Exec(`PRAGMA defer_foreign_keys = ON`); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE users SET email = ?, password_digest = ?, favorite_cake = ?, role = ?, banned = ?,
+		verification = ? WHERE email = ?`, u.Email, u.PasswordDigest, u.FavoriteCake, u.Role, u.Banned,
+		u.PendingVerification, email)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE ban_events SET user_email = ? WHERE user_email = ?`, u.Email, email); err != nil {
+		return err
+	}
+	if err := insertBanEvents(tx, u.Email, u.BanHistory, last.Seq); err != nil {
+		return err
+	}
+	// a setup left by a deleted account with the new email isn't the user's
+	if _, err := tx.Exec(`DELETE FROM two_factor WHERE email = ?`, u.Email); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE two_factor SET email = ? WHERE email = ?`, u.Email, email); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteUserStorage) Delete(email string) (User, error) {
+	u, err := s.Get(email)
+	if err != nil {
+		return User{}, ErrUserNotFound
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res, err := s.db.Exec(`DELETE FROM users WHERE email = ?`, email)
+	if err != nil {
+		return User{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return User{}, ErrUserNotFound
+	}
+	return u, nil
+}
+
+func (s *SQLiteUserStorage) Stats() (UserStats, error) {
+	stats := UserStats{}
+	err := s.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(banned), 0), COALESCE(SUM(role != ''), 0) FROM users`).
+		Scan(&stats.Total, &stats.Banned, &stats.Admins)
+	return stats, err
+}
+
+var sortColumns = map[string]string{
+	SortByEmail:        "email",
+	SortByFavoriteCake: "favorite_cake",
+	SortByRole:         "role",
+}
+
+func (s *SQLiteUserStorage) List(opts ListOptions) (UserPage, error) {
+	field, desc, err := parseSort(opts.Sort)
+	if err != nil {
+		return UserPage{}, err
+	}
+	cursor, err := decodeCursor(opts.After, opts.Sort)
+	if err != nil {
+		return UserPage{}, err
+	}
+	where := []string{"1 = 1"}
+	args := []interface{}{}
+	f := opts.Filter
+	if f.Role != nil {
+		where = append(where, "role = ?")
+		args = append(args, *f.Role)
+	}
+	if f.Banned != nil {
+		where = append(where, "banned = ?")
+		args = append(args, *f.Banned)
+	}
+	if f.EmailPrefix != "" {
+		// LIKE would ignore case and treat % and _ as wildcards
+		where = append(where, "substr(email, 1, length(?)) = ?")
+		args = append(args, f.EmailPrefix, f.EmailPrefix)
+	}
+	if f.FavoriteCake != "" {
+		where = append(where, "favorite_cake = ?")
+		args = append(args, f.FavoriteCake)
+	}
+	if f.ExcludeStaff {
+		where = append(where, "role = ''")
+	}
+	column := sortColumns[field]
+	order, compare := "ASC", ">"
+	if desc {
+		order, compare = "DESC", "<"
+	}
+	if cursor != nil {
+		where = append(where, "("+column+" "+compare+" ? OR ("+column+" = ? AND email "+compare+" ?))")
+		args = append(args, cursor.Key, cursor.Key, cursor.Email)
+	}
+	query := `SELECT email, password_digest, favorite_cake, role, banned, verification, id FROM users WHERE ` +
+		strings.Join(where, " AND ") + ` ORDER BY ` + column + ` ` + order + `, email ` + order
+	if opts.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, opts.Limit+1)
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return UserPage{}, err
+	}
+	defer rows.Close()
+	page := UserPage{Users: []User{}}
+	for rows.Next() {
+		u := User{}
+		if err := rows.Scan(&u.Email, &u.PasswordDigest, &u.FavoriteCake, &u.Role, &u.Banned, &u.PendingVerification, &u.ID); err != nil {
+			return UserPage{}, err
+		}
+		page.Users = append(page.Users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return UserPage{}, err
+	}
+	if opts.Limit > 0 && len(page.Users) > opts.Limit {
+		page.Users = page.Users[:opts.Limit]
+		page.Next = nextCursor(opts, field, page.Users)
+	}
+	return page, nil
+}
+
+// ExpiredBans returns the banned users whose last ban is temporary. The end
+// of the ban is compared by the caller, sqlite has no real time type.
+func (s *SQLiteUserStorage) ExpiredBans(now time.Time) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	rows, err := s.db.Query(`SELECT u.email, e.until FROM users u
+		JOIN ban_events e ON e.user_email = u.email
+		WHERE u.banned = 1 AND e.type = ? AND e.until IS NOT NULL
+		AND e.seq = (SELECT MAX(seq) FROM ban_events WHERE user_email = u.email AND type = ?)`,
+		BanEventBan, BanEventBan)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	emails := []string{}
+	for rows.Next() {
+		var email string
+		var until time.Time
+		if err := rows.Scan(&email, &until); err != nil {
+			return nil, err
+		}
+		if !until.After(now) {
+			emails = append(emails, email)
+		}
+	}
+	return emails, rows.Err()
+}
+
+func (s *SQLiteUserStorage) loadBanHistory(email string) (*BanHistory, error) {
+	rows, err := s.db.Query(`SELECT type, at, actor, reason, until
+		FROM ban_events WHERE user_email = ? ORDER BY seq`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := NewBanHistory()
+	for rows.Next() {
+		e := BanEvent{}
+		until := sql.NullTime{}
+		if err := rows.Scan(&e.Type, &e.At, &e.Actor, &e.Reason, &until); err != nil {
+			return nil, err
+		}
+		e.Until = until.Time
+		history.Append(e)
+	}
+	return history, rows.Err()
+}
+
+// assignUserIDs gives an ID to the users added before there were IDs.
+func assignUserIDs(db *sql.DB) error {
+	if err := addColumnIfMissing(db, "users", "id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	rows, err := db.Query(`SELECT email FROM users WHERE id = ''`)
+	if err != nil {
+		return err
+	}
+	emails := []string{}
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			rows.Close()
+			return err
+		}
+		emails = append(emails, email)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, email := range emails {
+		id, err := newUserID()
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(`UPDATE users SET id = ? WHERE email = ?`, id, email); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS users_id ON users(id)`)
+	return err
+}
+
+// migrateBanHistory moves the bans of the ban_history table, which held a
+// row per ban, to the ban_events log. When a ban was lifted wasn't recorded,
+// the time of the ban stands in for it.
+func migrateBanHistory(db *sql.DB) error {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'ban_history'`).Scan(&n)
+	if err != nil || n == 0 {
+		return err
+	}
+	if err := addColumnIfMissing(db, "ban_history", "until", "DATETIME"); err != nil {
+		return err
+	}
+	rows, err := db.Query(`SELECT user_email, who_banned, when_banned, why, who_unbanned, until
+		FROM ban_history ORDER BY user_email, id`)
+	if err != nil {
+		return err
+	}
+	logs := map[string]*BanHistory{}
+	for rows.Next() {
+		var email, whoUnbanned string
+		ban := BanEvent{Type: BanEventBan}
+		until := sql.NullTime{}
+		if err := rows.Scan(&email, &ban.Actor, &ban.At, &ban.Reason, &whoUnbanned, &until); err != nil {
+			rows.Close()
+			return err
+		}
+		ban.Until = until.Time
+		if logs[email] == nil {
+			logs[email] = NewBanHistory()
+		}
+		logs[email].Append(ban)
+		switch whoUnbanned {
+		case "":
+		case systemActor:
+			logs[email].Append(BanEvent{Type: BanEventExpired, At: ban.Until, Actor: systemActor, Reason: "ban expired"})
+		default:
+			logs[email].Append(BanEvent{Type: BanEventUnban, At: ban.At, Actor: whoUnbanned})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for email, history := range logs {
+		if err := insertBanEvents(tx, email, *history, 0); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DROP TABLE ban_history`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
+}
+
+func userExists(tx *sql.Tx, email string) (bool, error) {
+	var n int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE email = ?`, email).Scan(&n)
+	return n > 0, err
+}
+
+// lastBanEvent returns the latest stored event of the user, the zero event
+// when there is none.
+func lastBanEvent(tx *sql.Tx, email string) (BanEvent, error) {
+	e := BanEvent{}
+	until := sql.NullTime{}
+	err := tx.QueryRow(`SELECT seq, type, at, actor, reason, until FROM ban_events
+		WHERE user_email = ? ORDER BY seq DESC LIMIT 1`, email).Scan(&e.Seq, &e.Type, &e.At, &e.Actor, &e.Reason, &until)
+	if err == sql.ErrNoRows {
+		return BanEvent{}, nil
+	}
+	e.Until = until.Time
+	return e, err
+}
+
+// insertBanEvents stores the events of b after the first skip ones.
+func insertBanEvents(tx *sql.Tx, email string, b BanHistory, skip int) error {
+	for _, e := range b.Events() {
+		if e.Seq <= skip {
+			continue
+		}
+		until := sql.NullTime{Time: e.Until.UTC(), Valid: !e.Until.IsZero()}
+		_, err := tx.Exec(`INSERT INTO ban_events (user_email, seq, type, at, actor, reason, until)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, email, e.Seq, e.Type, e.At.UTC(), e.Actor, e.Reason, until)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteStorage(t *testing.T) *SQLiteUserStorage {
+	s, err := NewSQLiteUserStorage(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLiteUserStorage(t *testing.T) {
+	t.Run("add and get", func(t *testing.T) {
+		s := newTestSQLiteStorage(t)
+		u := User{Email: "test@mail.com", PasswordDigest: "digest", FavoriteCake: "cake", BanHistory: *NewBanHistory()}
+		if err := s.Add(u.Email, u); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got, err := s.Get(u.Email)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.Email != u.Email || got.PasswordDigest != u.PasswordDigest || got.FavoriteCake != u.FavoriteCake {
+			t.Errorf("Unexpected user. Expected: %+v, actual: %+v", u, got)
+		}
+	})
+
+	t.Run("same errors as in-memory storage", func(t *testing.T) {
+		s := newTestSQLiteStorage(t)
+		u := User{Email: "test@mail.com", FavoriteCake: "cake"}
+		s.Add(u.Email, u)
+		if err := s.Add(u.Email, u); err != ErrUserExists {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if _, err := s.Get("none@mail.com"); err != ErrUserNotFound {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if err := s.Update("none@mail.com", u); err != ErrUserNotFound {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if _, err := s.Delete("none@mail.com"); err != ErrUserNotFound {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if err := s.Rename("none@mail.com", User{Email: "other@mail.com"}); err != ErrUserNotFound {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("rename moves the ban history and two-factor setup", func(t *testing.T) {
+		s := newTestSQLiteStorage(t)
+		tfs, err := NewSQLiteTwoFactorStore(s.db)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		history := NewBanHistory()
+		history.Append(BanEvent{Type: BanEventBan, At: time.Now(), Actor: "admin@mail.com", Reason: "because"})
+		history.Append(BanEvent{Type: BanEventUnban, At: time.Now(), Actor: "admin@mail.com", Reason: "sorry"})
+		u := User{Email: "test@mail.com", FavoriteCake: "cake", Role: RoleAdmin, BanHistory: *history}
+		s.Add(u.Email, u)
+		s.Add("taken@mail.com", User{Email: "taken@mail.com", FavoriteCake: "pie"})
+		tfs.Save(TwoFactor{Email: u.Email, Secret: "secret", Enabled: true})
+		u, _ = s.Get(u.Email)
+
+		renamed := u
+		renamed.Email = "taken@mail.com"
+		if err := s.Rename(u.Email, renamed); err != ErrUserExists {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if got, err := s.Get(u.Email); err != nil || got.BanHistory.Len() != 2 {
+			t.Errorf("a failed rename should leave the account alone: %+v %v", got, err)
+		}
+		if got, _ := s.Get("taken@mail.com"); got.FavoriteCake != "pie" {
+			t.Errorf("a failed rename should leave the other account alone: %+v", got)
+		}
+
+		renamed.Email = "new@mail.com"
+		if err := s.Rename(u.Email, renamed); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := s.Get(u.Email); err != ErrUserNotFound {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		got, err := s.Get("new@mail.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.Role != RoleAdmin || got.BanHistory.Len() != 2 || got.ID == "" || got.ID != u.ID {
+			t.Errorf("Unexpected user: %+v", got)
+		}
+		if tf, _ := tfs.Get("new@mail.com"); !tf.Enabled || tf.Secret != "secret" {
+			t.Errorf("Unexpected two-factor setup: %+v", tf)
+		}
+		if tf, _ := tfs.Get(u.Email); tf.Secret != "" {
+			t.Errorf("two-factor setup left behind: %+v", tf)
+		}
+	})
+
+	t.Run("users get an id", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.db")
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the table before ids
+		db.Exec(`CREATE TABLE users (email TEXT PRIMARY KEY, password_digest TEXT NOT NULL, favorite_cake TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT '', banned INTEGER NOT NULL DEFAULT 0, verification TEXT NOT NULL DEFAULT '')`)
+		db.Exec(`INSERT INTO users (email, password_digest, favorite_cake) VALUES ('old@mail.com', '', 'cake')`)
+		db.Close()
+
+		s, err := NewSQLiteUserStorage(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer s.Close()
+		s.Add("new@mail.com", User{Email: "new@mail.com", FavoriteCake: "pie", ID: "chosen"})
+		old, _ := s.Get("old@mail.com")
+		added, _ := s.Get("new@mail.com")
+		if old.ID == "" || added.ID == "" || old.ID == added.ID || added.ID == "chosen" {
+			t.Fatalf("Unexpected ids: %q %q", old.ID, added.ID)
+		}
+		if got, err := s.GetByID(old.ID); err != nil || got.Email != "old@mail.com" {
+			t.Errorf("Unexpected user: %+v %v", got, err)
+		}
+		added.ID = "changed"
+		s.Update(added.Email, added)
+		if got, _ := s.Get(added.Email); got.ID == "changed" {
+			t.Errorf("the id should never change")
+		}
+		if _, err := s.GetByID("none"); err != ErrUserNotFound {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ban history survives reopening", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.db")
+		s, err := NewSQLiteUserStorage(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		history := NewBanHistory()
+		history.Append(BanEvent{Type: BanEventBan, At: time.Now(), Actor: "admin@mail.com", Reason: "because"})
+		history.Append(BanEvent{Type: BanEventUnban, At: time.Now(), Actor: "admin@mail.com", Reason: "sorry"})
+		history.Append(BanEvent{Type: BanEventBan, At: time.Now(), Actor: "admin@mail.com", Reason: "again", Until: time.Now().Add(time.Hour)})
+		u := User{Email: "test@mail.com", FavoriteCake: "cake", Banned: true, BanHistory: *history}
+		s.Add(u.Email, u)
+		s.Close()
+
+		s, err = NewSQLiteUserStorage(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer s.Close()
+		got, err := s.Get(u.Email)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		bans := got.BanHistory.Bans()
+		if !got.Banned || len(bans) != 2 {
+			t.Fatalf("Unexpected user: %+v", got)
+		}
+		if bans[0].Why != "because" || bans[0].UnbanReason != "sorry" || bans[1].Why != "again" {
+			t.Errorf("Unexpected ban history order: %+v", bans)
+		}
+	})
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	twoFactorAudience = "two_factor"
+	recoveryCodeCount = 10
+)
+
+// TwoFactor is the TOTP setup of a user. It is enabled once a first code
+// has been confirmed.
+type TwoFactor struct {
+	Email string
+	// Secret is the TOTP key, computing codes needs it in clear.
+	Secret  string
+	Enabled bool
+	// RecoveryCodes are the hashes of the unused recovery codes.
+	RecoveryCodes []string
+	// LastCounter is the time step of the last accepted code, codes up to
+	// it are refused so that none works twice.
+	LastCounter int64
+}
+
+type TwoFactorStore interface {
+	// Get returns the zero TwoFactor of email when it has none.
+	Get(email string) (TwoFactor, error)
+	Save(TwoFactor) error
+	// Replace saves tf unless the stored setup isn't old anymore, which ok
+	// false reports. Spending a code this way keeps two requests from
+	// both using it.
+	Replace(old, tf TwoFactor) (ok bool, err error)
+	Delete(email string) error
+}
+
+type TwoFactorPolicy struct {
+	// Issuer is the account name shown by authenticator apps.
+	Issuer string
+	// RequiredForStaff keeps the users with a role out of the admin
+	// routes until they enable two-factor authentication.
+	RequiredForStaff bool
+	ChallengeTTL     time.Duration
+}
+
+func defaultTwoFactorPolicy() TwoFactorPolicy {
+	return TwoFactorPolicy{Issuer: "Cake", ChallengeTTL: 5 * time.Minute}
+}
+
+var (
+	twoFactorPolicy                = defaultTwoFactorPolicy()
+	twoFactors      TwoFactorStore = NewInMemoryTwoFactorStore()
+)
+
+var (
+	errTwoFactorEnabled    = newConflictError("two_factor_enabled", "Two-factor authentication is already enabled")
+	errTwoFactorNotEnabled = newConflictError("two_factor_not_enabled", "Two-factor authentication is not enabled")
+	errTwoFactorRequired   = newForbiddenError("two_factor_required", "Enable two-factor authentication to access this page")
+	errInvalidChallenge    = newUnauthorizedError("invalid_challenge", "Invalid or expired challenge")
+	errInvalidCode         = newUnauthorizedError("invalid_code", "Invalid two-factor code")
+)
+
+// verify accepts a TOTP code or an unused recovery code, which is spent. The
+// caller stores tf when it passes.
+func (tf *TwoFactor) verify(code string, now time.Time) bool {
+	code = strings.TrimSpace(code)
+	if counter, ok := matchTOTP(tf.Secret, code, now); ok && counter > tf.LastCounter {
+		tf.LastCounter = counter
+		return true
+	}
+	hash := hashToken(normalizeRecoveryCode(code))
+	for i, h := range tf.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			tf.RecoveryCodes = append(tf.RecoveryCodes[:i:i], tf.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// use verifies code and saves tf with the code spent, of the requests racing
+// with the same code only one succeeds.
+func (tf *TwoFactor) use(code string, now time.Time) (bool, error) {
+	old := *tf
+	if !tf.verify(code, now) {
+		return false, nil
+	}
+	return twoFactors.Replace(old, *tf)
+}
+
+func (tf TwoFactor) equal(other TwoFactor) bool {
+	if tf.Email != other.Email || tf.Secret != other.Secret || tf.Enabled != other.Enabled ||
+		tf.LastCounter != other.LastCounter || len(tf.RecoveryCodes) != len(other.RecoveryCodes) {
+		return false
+	}
+	for i := range tf.RecoveryCodes {
+		if tf.RecoveryCodes[i] != other.RecoveryCodes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// newRecoveryCodes returns codes like "abcd-efgh" and their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes, hashes := []string{}, []string{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(b))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// checkStaffTwoFactor refuses u when the policy requires it to have enabled
+// two-factor authentication.
+func checkStaffTwoFactor(u User) error {
+	if !twoFactorPolicy.RequiredForStaff || !isStaff(u.Role) {
+		return nil
+	}
+	tf, err := twoFactors.Get(u.Email)
+	if err != nil {
+		return err
+	}
+	if !tf.Enabled {
+		return errTwoFactorRequired
+	}
+	return nil
+}
+
+// moveTwoFactor follows a change of email, for the stores which
+// UserRepository.Rename doesn't move the setup of.
+func moveTwoFactor(from, to string) error {
+	tf, err := twoFactors.Get(from)
+	if err != nil || tf.Secret == "" {
+		return err
+	}
+	tf.Email = to
+	if err := twoFactors.Save(tf); err != nil {
+		return err
+	}
+	return twoFactors.Delete(from)
+}
+
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// enrollTwoFactorHandler gives the user a new secret. It is enabled by
+// confirmTwoFactorHandler.
+func enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	tf, err := twoFactors.Get(u.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	if tf.Enabled {
+		handleError(errTwoFactorEnabled, w)
+		return
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	if err := twoFactors.Save(TwoFactor{Email: u.Email, Secret: secret}); err != nil {
+		handleError(err, w)
+		return
+	}
+	writeJSON(w, http.StatusCreated, TwoFactorEnrollment{Secret: secret, URI: totpURI(twoFactorPolicy.Issuer, u.Email, secret)})
+}
+
+type TwoFactorCodeParams struct {
+	Code string `json:"code"`
+}
+
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+// confirmTwoFactorHandler enables two-factor authentication with a first
+// code and returns the recovery codes, which are never shown again. Wrong
+// codes count as failed logins.
+func confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	params := &TwoFactorCodeParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(ErrInvalidParams, w)
+		return
+	}
+	now := time.Now()
+	attempt, err := beginLoginAttempt(w, loginAttemptKeys(r, u.Email), now)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	defer attempt.end()
+	tf, err := twoFactors.Get(u.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	if tf.Enabled {
+		handleError(errTwoFactorEnabled, w)
+		return
+	}
+	if tf.Secret == "" {
+		handleError(newConflictError("two_factor_not_enrolled", "Enroll before confirming"), w)
+		return
+	}
+	ok, err := tf.use(params.Code, now)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	if !ok {
+		attempt.fail(u)
+		handleError(newValidationError("code", "Invalid code"), w)
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	tf.Enabled = true
+	tf.RecoveryCodes = hashes
+	if err := twoFactors.Save(tf); err != nil {
+		handleError(err, w)
+		return
+	}
+	writeJSON(w, http.StatusCreated, RecoveryCodes{Codes: codes})
+}
+
+// recoveryCodesHandler replaces the recovery codes, given a valid code.
+func recoveryCodesHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	tf, ok := enabledTwoFactor(w, r, u)
+	if !ok {
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	tf.RecoveryCodes = hashes
+	if err := twoFactors.Save(tf); err != nil {
+		handleError(err, w)
+		return
+	}
+	writeJSON(w, http.StatusCreated, RecoveryCodes{Codes: codes})
+}
+
+// disableTwoFactorHandler turns two-factor authentication off, given a
+// valid code.
+func disableTwoFactorHandler(w http.ResponseWriter, r *http.Request, u User, us UserRepository) {
+	if _, ok := enabledTwoFactor(w, r, u); !ok {
+		return
+	}
+	if err := twoFactors.Delete(u.Email); err != nil {
+		handleError(err, w)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("Two-factor authentication have been disabled"))
+}
+
+// enabledTwoFactor returns the setup of u once the code of the request is
+// checked and spent, or writes the error. Wrong codes count as failed
+// logins.
+func enabledTwoFactor(w http.ResponseWriter, r *http.Request, u User) (TwoFactor, bool) {
+	params := &TwoFactorCodeParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(ErrInvalidParams, w)
+		return TwoFactor{}, false
+	}
+	now := time.Now()
+	attempt, err := beginLoginAttempt(w, loginAttemptKeys(r, u.Email), now)
+	if err != nil {
+		handleError(err, w)
+		return TwoFactor{}, false
+	}
+	defer attempt.end()
+	tf, err := twoFactors.Get(u.Email)
+	if err != nil {
+		handleError(err, w)
+		return TwoFactor{}, false
+	}
+	if !tf.Enabled {
+		handleError(errTwoFactorNotEnabled, w)
+		return TwoFactor{}, false
+	}
+	ok, err := tf.use(params.Code, now)
+	if err != nil {
+		handleError(err, w)
+		return TwoFactor{}, false
+	}
+	if !ok {
+		attempt.fail(u)
+		handleError(newValidationError("code", "Invalid code"), w)
+		return TwoFactor{}, false
+	}
+	return tf, true
+}
+
+type TwoFactorChallenge struct {
+	Challenge string `json:"challenge"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+// writeTwoFactorChallenge answers the first step of a login with two-factor
+// authentication, the challenge goes with a code to JWTTwoFactor.
+func writeTwoFactorChallenge(w http.ResponseWriter, jwtService *JWTService, email string) {
+	challenge, err := signScopedToken(jwtService.keys, twoFactorAudience, email, "", twoFactorPolicy.ChallengeTTL)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	logins.Inc("challenged")
+	writeJSON(w, http.StatusAccepted, TwoFactorChallenge{
+		Challenge: challenge,
+		ExpiresIn: int64(twoFactorPolicy.ChallengeTTL / time.Second),
+	})
+}
+
+type TwoFactorLoginParams struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+	// Session is "cookie" to get the tokens in cookies.
+	Session string `json:"session"`
+	// Device labels the session, like "work laptop".
+	Device string `json:"device"`
+}
+
+// JWTTwoFactor is the second step of a login with two-factor
+// authentication. Wrong codes count as failed logins.
+func (u *UserService) JWTTwoFactor(w http.ResponseWriter, r *http.Request, jwtService *JWTService) {
+	params := &TwoFactorLoginParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(ErrInvalidParams, w)
+		return
+	}
+	claims, err := parseScopedToken(jwtService.keys, params.Challenge, twoFactorAudience)
+	if err != nil {
+		handleError(errInvalidChallenge, w)
+		return
+	}
+	now := time.Now()
+	attempt, err := beginLoginAttempt(w, loginAttemptKeys(r, claims.Subject), now)
+	if err != nil {
+		logins.Inc("throttled")
+		handleError(err, w)
+		return
+	}
+	defer attempt.end()
+	// a password reset since the challenge was issued voids it
+	revoked, err := isRevoked(claims.Subject, "", issuedAtSecond(claims.IssuedAt))
+	if err != nil || revoked {
+		handleError(errInvalidChallenge, w)
+		return
+	}
+	user, err := u.repository.Get(claims.Subject)
+	if err != nil {
+		handleError(errInvalidChallenge, w)
+		return
+	}
+	tf, err := twoFactors.Get(user.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	if !tf.Enabled {
+		handleError(errInvalidChallenge, w)
+		return
+	}
+	ok, err := tf.use(params.Code, now)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	if !ok {
+		logins.Inc("failure")
+		attempt.fail(user)
+		handleError(errInvalidCode, w)
+		return
+	}
+	if err := recordLoginSuccess(user.Email); err != nil {
+		handleError(err, w)
+		return
+	}
+	user, err = u.checkCanLogin(user)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	tokens, err := jwtService.StartSession(r, user, params.Device)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	logins.Inc("success")
+	writeTokens(w, jwtService, tokens, params.Session)
+}
+
+type InMemoryTwoFactorStore struct {
+	lock  sync.Mutex
+	setup map[string]TwoFactor
+}
+
+func NewInMemoryTwoFactorStore() *InMemoryTwoFactorStore {
+	return &InMemoryTwoFactorStore{setup: make(map[string]TwoFactor)}
+}
+
+func (i *InMemoryTwoFactorStore) Get(email string) (TwoFactor, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	tf, ok := i.setup[email]
+	if !ok {
+		return TwoFactor{Email: email}, nil
+	}
+	tf.RecoveryCodes = append([]string{}, tf.RecoveryCodes...)
+	return tf, nil
+}
+
+func (i *InMemoryTwoFactorStore) Save(tf TwoFactor) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	tf.RecoveryCodes = append([]string{}, tf.RecoveryCodes...)
+	i.setup[tf.Email] = tf
+	return nil
+}
+
+func (i *InMemoryTwoFactorStore) Replace(old, tf TwoFactor) (bool, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	current, ok := i.setup[old.Email]
+	if !ok {
+		current = TwoFactor{Email: old.Email}
+	}
+	if !current.equal(old) {
+		return false, nil
+	}
+	tf.RecoveryCodes = append([]string{}, tf.RecoveryCodes...)
+	i.setup[tf.Email] = tf
+	return true, nil
+}
+
+func (i *InMemoryTwoFactorStore) Delete(email string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	delete(i.setup, email)
+	return nil
+}
+
+const twoFactorSchema = `
+CREATE TABLE IF NOT EXISTS two_factor (
+	email          TEXT PRIMARY KEY,
+	secret         TEXT NOT NULL,
+	enabled        INTEGER NOT NULL DEFAULT 0,
+	recovery_codes TEXT NOT NULL DEFAULT '[]',
+	last_counter   INTEGER NOT NULL DEFAULT 0
+);
+`
+
+type SQLiteTwoFactorStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteTwoFactorStore(db *sql.DB) (*SQLiteTwoFactorStore, error) {
+	if _, err := db.Exec(twoFactorSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteTwoFactorStore{db: db}, nil
+}
+
+func (s *SQLiteTwoFactorStore) Get(email string) (TwoFactor, error) {
+	tf := TwoFactor{Email: email}
+	var codes string
+	err := s.db.QueryRow(`SELECT secret, enabled, recovery_codes, last_counter FROM two_factor WHERE email = ?`, email).
+		Scan(&tf.Secret, &tf.Enabled, &codes, &tf.LastCounter)
+	if err == sql.ErrNoRows {
+		return tf, nil
+	}
+	if err != nil {
+		return TwoFactor{}, err
+	}
+	if err := json.Unmarshal([]byte(codes), &tf.RecoveryCodes); err != nil {
+		return TwoFactor{}, err
+	}
+	return tf, nil
+}
+
+func (s *SQLiteTwoFactorStore) Save(tf TwoFactor) error {
+	codes, err := json.Marshal(append([]string{}, tf.RecoveryCodes...))
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO two_factor (email, secret, enabled, recovery_codes, last_counter)
+		VALUES (?, ?, ?, ?, ?)`, tf.Email, tf.Secret, tf.Enabled, string(codes), tf.LastCounter)
+	return err
+}
+
+func (s *SQLiteTwoFactorStore) Replace(old, tf TwoFactor) (bool, error) {
+	oldCodes, err := json.Marshal(append([]string{}, old.RecoveryCodes...))
+	if err != nil {
+		return false, err
+	}
+	codes, err := json.Marshal(append([]string{}, tf.RecoveryCodes...))
+	if err != nil {
+		return false, err
+	}
+	res, err := s.db.Exec(`UPDATE two_factor SET secret = ?, enabled = ?, recovery_codes = ?, last_counter = ?
+		WHERE email = ? AND secret = ? AND enabled = ? AND recovery_codes = ? AND last_counter = ?`,
+		tf.Secret, tf.Enabled, string(codes), tf.LastCounter,
+		old.Email, old.Secret, old.Enabled, string(oldCodes), old.LastCounter)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *SQLiteTwoFactorStore) Delete(email string) error {
+	_, err := s.db.Exec(`DELETE FROM two_factor WHERE email = ?`, email)
+	return err
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTwoFactors gives the test its own two-factor store and policy.
+func useTwoFactors(t *testing.T, p TwoFactorPolicy) {
+	oldPolicy, oldStore := twoFactorPolicy, twoFactors
+	twoFactorPolicy, twoFactors = p, NewInMemoryTwoFactorStore()
+	t.Cleanup(func() { twoFactorPolicy, twoFactors = oldPolicy, oldStore })
+}
+
+func totpAt(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, totpCounter(at))
+}
+
+func TestTOTP(t *testing.T) {
+	// the SHA1 vectors of RFC 6238, truncated to 6 digits
+	key := []byte("12345678901234567890")
+	cases := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for at, want := range cases {
+		if got := totpCode(key, totpCounter(time.Unix(at, 0))); got != want {
+			t.Errorf("%d: got %s, want %s", at, got, want)
+		}
+	}
+
+	secret := totpEncoding.EncodeToString(key)
+	now := time.Now()
+	if _, ok := matchTOTP(secret, totpAt(t, secret, now.Add(-totpPeriod*time.Second)), now); !ok {
+		t.Error("a code one period late should pass")
+	}
+	if _, ok := matchTOTP(secret, totpAt(t, secret, now.Add(-3*totpPeriod*time.Second)), now); ok {
+		t.Error("an old code shouldn't pass")
+	}
+	uri := totpURI("Cake", "test@mail.com", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/Cake:test@mail.com?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("Unexpected uri: %s", uri)
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	doRequest := createRequester(t)
+	useLockoutPolicy(t, defaultLockoutPolicy())
+	policy := defaultTwoFactorPolicy()
+	policy.RequiredForStaff = true
+	useTwoFactors(t, policy)
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	u := newTestUserService()
+	digest, _ := hashPassword("somepass")
+	admin := User{"admin@mail.com", digest, "cake", RoleAdmin, false, BanHistory{}, "", ""}
+	u.repository.Add(admin.Email, admin)
+	enroll := httptest.NewServer(j.jwtAuthorize(u.repository, enrollTwoFactorHandler))
+	defer enroll.Close()
+	confirm := httptest.NewServer(j.jwtAuthorize(u.repository, confirmTwoFactorHandler))
+	defer confirm.Close()
+	disable := httptest.NewServer(j.jwtAuthorize(u.repository, disableTwoFactorHandler))
+	defer disable.Close()
+	lockouts := httptest.NewServer(j.jwtAuthorize(u.repository, lockoutsHandler, PermUsersInspect))
+	defer lockouts.Close()
+	login := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+	defer login.Close()
+	second := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWTTwoFactor)))
+	defer second.Close()
+	token, _ := j.GenearateJWT(admin)
+	send := func(url string, params map[string]interface{}) parsedResponse {
+		req, _ := http.NewRequest(http.MethodPost, url, prepareParams(t, params))
+		req.Header.Add("Authorization", "Bearer "+token)
+		return doRequest(req, nil)
+	}
+	credentials := map[string]interface{}{"email": admin.Email, "password": "somepass"}
+
+	assertError(t, 403, "two_factor_required", "Enable two-factor authentication to access this page",
+		send(lockouts.URL, nil))
+
+	resp := send(enroll.URL, nil)
+	assertStatus(t, 201, resp)
+	enrollment := TwoFactorEnrollment{}
+	json.Unmarshal(resp.body, &enrollment)
+	assertError(t, 422, "validation_failed", "Invalid code", send(confirm.URL, map[string]interface{}{"code": "000000"}))
+	now := time.Now()
+	resp = send(confirm.URL, map[string]interface{}{"code": totpAt(t, enrollment.Secret, now)})
+	assertStatus(t, 201, resp)
+	recovery := RecoveryCodes{}
+	json.Unmarshal(resp.body, &recovery)
+	if len(recovery.Codes) != recoveryCodeCount {
+		t.Fatalf("Unexpected recovery codes: %s", resp.body)
+	}
+	assertStatus(t, 200, send(lockouts.URL, nil))
+	assertError(t, 409, "two_factor_enabled", "Two-factor authentication is already enabled", send(enroll.URL, nil))
+
+	challenge := func() string {
+		resp := send(login.URL, credentials)
+		assertStatus(t, 202, resp)
+		c := TwoFactorChallenge{}
+		json.Unmarshal(resp.body, &c)
+		return c.Challenge
+	}
+
+	t.Run("login with a code", func(t *testing.T) {
+		c := challenge()
+		assertError(t, 401, "invalid_code", "Invalid two-factor code",
+			send(second.URL, map[string]interface{}{"challenge": c, "code": "000000"}))
+		code := totpAt(t, enrollment.Secret, now.Add(totpPeriod*time.Second))
+		assertStatus(t, 200, send(second.URL, map[string]interface{}{"challenge": c, "code": code}))
+		assertStatus(t, 401, send(second.URL, map[string]interface{}{"challenge": challenge(), "code": code}))
+	})
+
+	t.Run("login with a recovery code", func(t *testing.T) {
+		code := strings.ToUpper(recovery.Codes[0])
+		assertStatus(t, 200, send(second.URL, map[string]interface{}{"challenge": challenge(), "code": code}))
+		assertStatus(t, 401, send(second.URL, map[string]interface{}{"challenge": challenge(), "code": code}))
+	})
+
+	t.Run("challenge isn't an access token", func(t *testing.T) {
+		c := challenge()
+		req, _ := http.NewRequest(http.MethodGet, lockouts.URL, nil)
+		req.Header.Add("Authorization", "Bearer "+c)
+		assertStatus(t, 401, doRequest(req, nil))
+		assertError(t, 401, "invalid_challenge", "Invalid or expired challenge",
+			send(second.URL, map[string]interface{}{"challenge": token, "code": "000000"}))
+	})
+
+	t.Run("a code is spent once by racing requests", func(t *testing.T) {
+		first, _ := twoFactors.Get(admin.Email)
+		second, _ := twoFactors.Get(admin.Email)
+		at := now.Add(2 * totpPeriod * time.Second)
+		code := totpAt(t, enrollment.Secret, at)
+		if ok, err := first.use(code, at); !ok || err != nil {
+			t.Fatalf("the code should pass once: %v", err)
+		}
+		if ok, _ := second.use(code, at); ok {
+			t.Error("the code should not pass twice")
+		}
+	})
+
+	t.Run("wrong codes are throttled", func(t *testing.T) {
+		loginAttempts.Reset(AttemptKey{AttemptsAccount, admin.Email})
+		for i := 0; i <= lockoutPolicy.Account.FreeFailures; i++ {
+			assertError(t, 422, "validation_failed", "Invalid code", send(disable.URL, map[string]interface{}{"code": "000000"}))
+		}
+		assertStatus(t, 429, send(disable.URL, map[string]interface{}{"code": "000000"}))
+		if tf, _ := twoFactors.Get(admin.Email); !tf.Enabled {
+			t.Error("two-factor authentication should still be enabled")
+		}
+	})
+}
+
+func TestSQLiteTwoFactorStore(t *testing.T) {
+	users := newTestSQLiteStorage(t)
+	s, err := NewSQLiteTwoFactorStore(users.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf, err := s.Get("test@mail.com"); err != nil || tf.Enabled || tf.Secret != "" {
+		t.Fatalf("Unexpected setup: %+v, %v", tf, err)
+	}
+	s.Save(TwoFactor{Email: "test@mail.com", Secret: "SECRET", Enabled: true, RecoveryCodes: []string{"a", "b"}, LastCounter: 42})
+	tf, err := s.Get("test@mail.com")
+	if err != nil || !tf.Enabled || len(tf.RecoveryCodes) != 2 || tf.LastCounter != 42 {
+		t.Errorf("Unexpected setup: %+v, %v", tf, err)
+	}
+	spent := tf
+	spent.LastCounter = 43
+	if ok, err := s.Replace(tf, spent); !ok || err != nil {
+		t.Errorf("Unexpected replace: %v", err)
+	}
+	if ok, _ := s.Replace(tf, spent); ok {
+		t.Error("a stale setup should not replace the stored one")
+	}
+	s.Delete("test@mail.com")
+	if tf, _ := s.Get("test@mail.com"); tf.Enabled {
+		t.Errorf("Unexpected setup: %+v", tf)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// UserFilter selects users, the zero value selects everyone.
+type UserFilter struct {
+	// Role selects a single role when set, RoleUser included.
+	Role        *string
+	Banned      *bool
+	EmailPrefix string
+	// FavoriteCake matches the whole cake name.
+	FavoriteCake string
+	// ExcludeStaff hides admins and superadmins.
+	ExcludeStaff bool
+}
+
+func (f UserFilter) matches(u User) bool {
+	return (f.Role == nil || u.Role == *f.Role) &&
+		(f.Banned == nil || u.Banned == *f.Banned) &&
+		strings.HasPrefix(u.Email, f.EmailPrefix) &&
+		(f.FavoriteCake == "" || u.FavoriteCake == f.FavoriteCake) &&
+		!(f.ExcludeStaff && isStaff(u.Role))
+}
+
+// Sort fields of a listing. Ties are broken by email so that the order, and
+// with it the cursors, are stable.
+const (
+	SortByEmail        = "email"
+	SortByFavoriteCake = "favorite_cake"
+	SortByRole         = "role"
+)
+
+var sortFields = map[string]func(User) string{
+	SortByEmail:        func(u User) string { return u.Email },
+	SortByFavoriteCake: func(u User) string { return u.FavoriteCake },
+	SortByRole:         func(u User) string { return u.Role },
+}
+
+// ListOptions describe a page of users. Sort is a sort field, prefixed by
+// "-" for descending order. After is the cursor returned with the previous
+// page.
+type ListOptions struct {
+	Filter UserFilter
+	Sort   string
+	After  string
+	Limit  int
+}
+
+// UserPage is a page of users. Their ban history may be left empty. Next is
+// the cursor of the following page, empty on the last one.
+type UserPage struct {
+	Users []User
+	Next  string
+}
+
+var errInvalidCursor = newValidationError("cursor", "Invalid cursor")
+
+// listCursor is the position of the last user of a page.
+type listCursor struct {
+	Sort  string `json:"s"`
+	Key   string `json:"k"`
+	Email string `json:"e"`
+}
+
+func (c listCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s, sortBy string) (*listCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	c := &listCursor{}
+	if err := json.Unmarshal(b, c); err != nil || c.Sort != sortBy {
+		return nil, errInvalidCursor
+	}
+	return c, nil
+}
+
+// parseSort splits a sort option into its field and direction.
+func parseSort(s string) (field string, desc bool, err error) {
+	if s == "" {
+		return SortByEmail, false, nil
+	}
+	field = strings.TrimPrefix(s, "-")
+	if _, ok := sortFields[field]; !ok {
+		return "", false, newValidationError("sort", "Unknown sort field")
+	}
+	return field, field != s, nil
+}
+
+func nextCursor(opts ListOptions, field string, page []User) string {
+	if len(page) == 0 {
+		return ""
+	}
+	last := page[len(page)-1]
+	return listCursor{opts.Sort, sortFields[field](last), last.Email}.encode()
+}
+
+// listUsers pages through users in memory, for repositories without a
+// better way.
+func listUsers(users []User, opts ListOptions) (UserPage, error) {
+	field, desc, err := parseSort(opts.Sort)
+	if err != nil {
+		return UserPage{}, err
+	}
+	cursor, err := decodeCursor(opts.After, opts.Sort)
+	if err != nil {
+		return UserPage{}, err
+	}
+	key := sortFields[field]
+	before := func(a, b listCursor) bool {
+		if a.Key != b.Key {
+			return (a.Key < b.Key) != desc
+		}
+		if a.Email == b.Email {
+			return false
+		}
+		return (a.Email < b.Email) != desc
+	}
+	position := func(u User) listCursor {
+		return listCursor{Key: key(u), Email: u.Email}
+	}
+
+	selected := []User{}
+	for _, u := range users {
+		if !opts.Filter.matches(u) {
+			continue
+		}
+		if cursor != nil && !before(listCursor{Key: cursor.Key, Email: cursor.Email}, position(u)) {
+			continue
+		}
+		selected = append(selected, u)
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return before(position(selected[i]), position(selected[j]))
+	})
+	page := UserPage{Users: selected}
+	if opts.Limit > 0 && len(selected) > opts.Limit {
+		page.Users = selected[:opts.Limit]
+		page.Next = nextCursor(opts, field, page.Users)
+	}
+	return page, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func addListUsers(t *testing.T, us UserRepository) {
+	t.Helper()
+	users := []User{
+		{Email: "anna@mail.com", FavoriteCake: "cheesecake"},
+		{Email: "bob@mail.com", FavoriteCake: "brownie", Banned: true},
+		{Email: "boris@mail.com", FavoriteCake: "cheesecake"},
+		{Email: "carl@mail.com", FavoriteCake: "brownie", Role: RoleAdmin},
+		{Email: "dora@mail.com", FavoriteCake: "napoleon", Role: RoleSuperadmin},
+		{Email: "Bea@mail.com", FavoriteCake: "napoleon"},
+	}
+	for _, u := range users {
+		if err := us.Add(u.Email, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func emails(users []User) string {
+	s := []string{}
+	for _, u := range users {
+		s = append(s, u.Email)
+	}
+	return strings.Join(s, ",")
+}
+
+func TestUserRepository_List(t *testing.T) {
+	banned, admin := true, RoleAdmin
+	cases := []struct {
+		name string
+		opts ListOptions
+		want string
+	}{
+		{"all", ListOptions{}, "Bea@mail.com,anna@mail.com,bob@mail.com,boris@mail.com,carl@mail.com,dora@mail.com"},
+		{"prefix is case sensitive", ListOptions{Filter: UserFilter{EmailPrefix: "b"}}, "bob@mail.com,boris@mail.com"},
+		{"banned", ListOptions{Filter: UserFilter{Banned: &banned}}, "bob@mail.com"},
+		{"role", ListOptions{Filter: UserFilter{Role: &admin}}, "carl@mail.com"},
+		{"cake", ListOptions{Filter: UserFilter{FavoriteCake: "brownie"}}, "bob@mail.com,carl@mail.com"},
+		{"no staff", ListOptions{Filter: UserFilter{ExcludeStaff: true, FavoriteCake: "napoleon"}}, "Bea@mail.com"},
+		{"by cake descending", ListOptions{Sort: "-favorite_cake"}, "dora@mail.com,Bea@mail.com,boris@mail.com,anna@mail.com,carl@mail.com,bob@mail.com"},
+	}
+	repositories := map[string]func(t *testing.T) UserRepository{
+		"memory": func(t *testing.T) UserRepository { return NewInMemoryUserStorage() },
+		"sqlite": func(t *testing.T) UserRepository { return newTestSQLiteStorage(t) },
+	}
+	for name, newRepository := range repositories {
+		t.Run(name, func(t *testing.T) {
+			us := newRepository(t)
+			addListUsers(t, us)
+			for _, c := range cases {
+				page, err := us.List(c.opts)
+				if err != nil {
+					t.Fatalf("%s: unexpected error: %v", c.name, err)
+				}
+				if got := emails(page.Users); got != c.want || page.Next != "" {
+					t.Errorf("%s: got %s, next %q", c.name, got, page.Next)
+				}
+			}
+
+			t.Run("cursor", func(t *testing.T) {
+				opts := ListOptions{Sort: "-favorite_cake", Limit: 4}
+				first, err := us.List(opts)
+				if err != nil || first.Next == "" {
+					t.Fatalf("Unexpected first page: %+v, %v", first, err)
+				}
+				opts.After = first.Next
+				second, err := us.List(opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := emails(first.Users) + "," + emails(second.Users); got != cases[len(cases)-1].want || second.Next != "" {
+					t.Errorf("Unexpected pages: %s", got)
+				}
+			})
+
+			t.Run("cursor of another sort", func(t *testing.T) {
+				page, _ := us.List(ListOptions{Limit: 1})
+				if _, err := us.List(ListOptions{Sort: "role", After: page.Next}); err != errInvalidCursor {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			})
+		})
+	}
+}
+
+func TestAdmin_ListUsers(t *testing.T) {
+	doRequest := createRequester(t)
+	u := newTestUserService()
+	addListUsers(t, u.repository)
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	ts := httptest.NewServer(j.jwtAuthorize(u.repository, listUsersHandler, PermUsersInspect))
+	defer ts.Close()
+	list := func(email, query string) parsedResponse {
+		user, _ := u.repository.Get(email)
+		token, _ := j.GenearateJWT(user)
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+query, nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		return doRequest(req, nil)
+	}
+	listed := func(resp parsedResponse) string {
+		page := UsersPage{}
+		json.Unmarshal(resp.body, &page)
+		s := []string{}
+		for _, user := range page.Users {
+			s = append(s, user.Email)
+		}
+		return strings.Join(s, ",")
+	}
+
+	t.Run("admin doesn't see admins", func(t *testing.T) {
+		resp := list("carl@mail.com", "?cake=brownie")
+		assertStatus(t, 200, resp)
+		if got := listed(resp); got != "bob@mail.com" {
+			t.Errorf("Unexpected users: %s", got)
+		}
+		assertError(t, 403, "permission_denied", "Only superadmin can inspect admin!", list("carl@mail.com", "?role=admin"))
+	})
+
+	t.Run("superadmin sees admins", func(t *testing.T) {
+		resp := list("dora@mail.com", "?role=admin")
+		if got := listed(resp); got != "carl@mail.com" {
+			t.Errorf("Unexpected users: %s", got)
+		}
+	})
+
+	t.Run("plain users", func(t *testing.T) {
+		resp := list("dora@mail.com", "?role=user&banned=false&sort=-email&limit=2")
+		page := UsersPage{}
+		json.Unmarshal(resp.body, &page)
+		if got := listed(resp); got != "boris@mail.com,anna@mail.com" || page.Next == "" {
+			t.Errorf("Unexpected users: %s", got)
+		}
+		resp = list("dora@mail.com", "?role=user&banned=false&sort=-email&limit=2&cursor="+page.Next)
+		if got := listed(resp); got != "Bea@mail.com" {
+			t.Errorf("Unexpected users: %s", got)
+		}
+	})
+
+	t.Run("bad params", func(t *testing.T) {
+		assertError(t, 422, "validation_failed", "Unknown sort field", list("dora@mail.com", "?sort=password_digest"))
+		assertError(t, 422, "validation_failed", "banned must be true or false", list("dora@mail.com", "?banned=maybe"))
+		assertError(t, 422, "validation_failed", "Invalid cursor", list("dora@mail.com", "?cursor=nope"))
+	})
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"errors"
 	"sync"
+	"time"
 )
 
 type InMemoryUserStorage struct {
@@ -18,41 +18,129 @@ func NewInMemoryUserStorage() *InMemoryUserStorage {
 }
 
 func (i *InMemoryUserStorage) Add(s string, u User) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
 	_, ok := i.storage[s]
 	if ok == true {
-		return errors.New("This user is already registered")
+		return ErrUserExists
 	} else {
+		id, err := newUserID()
+		if err != nil {
+			return err
+		}
+		u.ID = id
 		i.storage[s] = u
 		return nil
 	}
 }
 
 func (i *InMemoryUserStorage) Get(s string) (User, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
 	_, ok := i.storage[s]
 	if ok != true {
-		return User{}, errors.New("This user doesn't exist")
+		return User{}, ErrUserNotFound
 	} else {
 		return i.storage[s], nil
 	}
 }
 
 func (i *InMemoryUserStorage) Update(s string, u User) error {
-	_, ok := i.storage[s]
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	old, ok := i.storage[s]
 	if ok != true {
-		return errors.New("This user doesn't exist")
+		return ErrUserNotFound
 	} else {
+		history, err := u.BanHistory.appendedTo(old.BanHistory)
+		if err != nil {
+			return err
+		}
+		u.BanHistory = history
+		u.ID = old.ID
 		i.storage[s] = u
 		return nil
 	}
 }
 
+func (i *InMemoryUserStorage) GetByID(id string) (User, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	for _, u := range i.storage {
+		if u.ID == id {
+			return u, nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+func (i *InMemoryUserStorage) Rename(s string, u User) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	old, ok := i.storage[s]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if _, taken := i.storage[u.Email]; taken {
+		return ErrUserExists
+	}
+	history, err := u.BanHistory.appendedTo(old.BanHistory)
+	if err != nil {
+		return err
+	}
+	u.BanHistory = history
+	u.ID = old.ID
+	delete(i.storage, s)
+	i.storage[u.Email] = u
+	return nil
+}
+
 func (i *InMemoryUserStorage) Delete(s string) (User, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
 	_, ok := i.storage[s]
 	if ok != true {
-		return User{}, errors.New("There is no such user")
+		return User{}, ErrUserNotFound
 	} else {
 		a := i.storage[s]
 		delete(i.storage, s)
 		return a, nil
 	}
 }
+
+func (i *InMemoryUserStorage) List(opts ListOptions) (UserPage, error) {
+	i.lock.RLock()
+	users := make([]User, 0, len(i.storage))
+	for _, u := range i.storage {
+		users = append(users, u)
+	}
+	i.lock.RUnlock()
+	return listUsers(users, opts)
+}
+
+func (i *InMemoryUserStorage) Stats() (UserStats, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	stats := UserStats{Total: len(i.storage)}
+	for _, u := range i.storage {
+		if u.Banned {
+			stats.Banned++
+		}
+		if isStaff(u.Role) {
+			stats.Admins++
+		}
+	}
+	return stats, nil
+}
+
+func (i *InMemoryUserStorage) ExpiredBans(now time.Time) ([]string, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	emails := []string{}
+	for email, u := range i.storage {
+		if banExpired(u, now) {
+			emails = append(emails, email)
+		}
+	}
+	return emails, nil
+}
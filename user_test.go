@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 )
 
 type parsedResponse struct {
@@ -63,11 +64,23 @@ func assertBody(t *testing.T, expected string, r parsedResponse) {
 	}
 }
 
+func assertError(t *testing.T, status int, code, message string, r parsedResponse) {
+	assertStatus(t, status, r)
+	res := errorResponse{}
+	if err := json.Unmarshal(r.body, &res); err != nil || res.Error == nil {
+		t.Errorf("Unexpected error response: %s", string(r.body))
+		return
+	}
+	if res.Error.Code != code || res.Error.Message != message {
+		t.Errorf("Unexpected error. Expected: %s %q, actual: %s %q", code, message, res.Error.Code, res.Error.Message)
+	}
+}
+
 func TestUsers_JWT(t *testing.T) {
 	doRequest := createRequester(t)
 	t.Run("user does not exist", func(t *testing.T) {
 		u := newTestUserService()
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
@@ -78,13 +91,12 @@ func TestUsers_JWT(t *testing.T) {
 			"password": "somepass",
 		}
 		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
-		assertStatus(t, 422, resp)
-		assertBody(t, "This user doesn't exist", resp)
+		assertError(t, 401, "invalid_credentials", "invalid login params", resp)
 	})
 
 	t.Run("wrong password", func(t *testing.T) {
 		u := newTestUserService()
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
@@ -103,13 +115,12 @@ func TestUsers_JWT(t *testing.T) {
 		}
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params_1)))
 		resp := doRequest(http.NewRequest(http.MethodPost, ts_2.URL, prepareParams(t, params_2)))
-		assertStatus(t, 422, resp)
-		assertBody(t, "invalid login params", resp)
+		assertError(t, 401, "invalid_credentials", "invalid login params", resp)
 	})
 
 	t.Run("register", func(t *testing.T) {
 		u := newTestUserService()
-		_, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		_, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
@@ -127,7 +138,7 @@ func TestUsers_JWT(t *testing.T) {
 
 	t.Run("register the same email", func(t *testing.T) {
 		u := newTestUserService()
-		_, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		_, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
@@ -141,13 +152,12 @@ func TestUsers_JWT(t *testing.T) {
 		}
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params)))
 		resp_2 := doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params)))
-		assertStatus(t, 422, resp_2)
-		assertBody(t, "This user is already registered", resp_2)
+		assertError(t, 409, "user_already_exists", "This user is already registered", resp_2)
 	})
 
 	t.Run("register wrong cake", func(t *testing.T) {
 		u := newTestUserService()
-		_, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		_, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
@@ -163,17 +173,15 @@ func TestUsers_JWT(t *testing.T) {
 			"favorite_cake": "cake12",
 		}
 		resp_1 := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params_1)))
-		assertStatus(t, 422, resp_1)
-		assertBody(t, "Enter your cake", resp_1)
+		assertError(t, 422, "validation_failed", "Enter your cake", resp_1)
 
 		resp_2 := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params_2)))
-		assertStatus(t, 422, resp_2)
-		assertBody(t, "Invalid cake: should consist only letters!", resp_2)
+		assertError(t, 422, "validation_failed", "Invalid cake: should consist only letters!", resp_2)
 	})
 
 	t.Run("register with wrong password", func(t *testing.T) {
 		u := newTestUserService()
-		_, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		_, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
@@ -185,13 +193,12 @@ func TestUsers_JWT(t *testing.T) {
 			"favorite_cake": "cake",
 		}
 		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
-		assertStatus(t, 422, resp)
-		assertBody(t, "Password should consist at least 8 characters", resp)
+		assertError(t, 422, "validation_failed", "Password should consist at least 8 characters", resp)
 	})
 
 	t.Run("register wrong email", func(t *testing.T) {
 		u := newTestUserService()
-		_, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		_, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
@@ -213,21 +220,35 @@ func TestUsers_JWT(t *testing.T) {
 			"favorite_cake": "cake",
 		}
 		resp_1 := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params_1)))
-		assertStatus(t, 422, resp_1)
-		assertBody(t, "Invalid email", resp_1)
+		assertError(t, 422, "validation_failed", "Invalid email", resp_1)
 
 		resp_2 := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params_2)))
-		assertStatus(t, 422, resp_2)
-		assertBody(t, "Invalid email", resp_2)
+		assertError(t, 422, "validation_failed", "Invalid email", resp_2)
 
 		resp_3 := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params_3)))
-		assertStatus(t, 422, resp_3)
-		assertBody(t, "Invalid email", resp_3)
+		assertError(t, 422, "validation_failed", "Invalid email", resp_3)
+	})
+
+	t.Run("validation error names the field", func(t *testing.T) {
+		u := newTestUserService()
+		ts := httptest.NewServer(http.HandlerFunc(u.Register))
+		defer ts.Close()
+		params := map[string]interface{}{
+			"email":         "test@mail.com",
+			"password":      "pass",
+			"favorite_cake": "cake",
+		}
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		res := errorResponse{}
+		json.Unmarshal(resp.body, &res)
+		if res.Error == nil || len(res.Error.Fields) != 1 || res.Error.Fields[0].Field != "password" {
+			t.Errorf("Unexpected error response: %s", string(resp.body))
+		}
 	})
 
 	t.Run("get JWT", func(t *testing.T) {
 		u := newTestUserService()
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
@@ -240,43 +261,46 @@ func TestUsers_JWT(t *testing.T) {
 			"password":      "somepass",
 			"favorite_cake": "cake",
 		}
-		user := User{
-			Email:          "test@mail.com",
-			PasswordDigest: "somepass",
-		}
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
-		token, _ := jwtService.GenearateJWT(user)
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params)))
 		resp_2 := doRequest(http.NewRequest(http.MethodPost, ts_2.URL, prepareParams(t, params)))
 		assertStatus(t, 200, resp_2)
-		assertBody(t, token, resp_2)
+		tokens := TokenPair{}
+		if err := json.Unmarshal(resp_2.body, &tokens); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		auth, err := j.ParseJWT(tokens.AccessToken)
+		if err != nil || auth.Email != "test@mail.com" {
+			t.Errorf("Unexpected access token: %v", err)
+		}
+		if tokens.RefreshToken == "" || tokens.ExpiresIn != int64(defaultAccessTTL/time.Second) {
+			t.Errorf("Unexpected tokens: %+v", tokens)
+		}
 	})
 
 	t.Run("access to data being unauthorized", func(t *testing.T) {
 		u := newTestUserService()
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
-		ts := httptest.NewServer(j.jwtAuth(u.repository, getMyData))
+		ts := httptest.NewServer(j.jwtAuthorize(u.repository, getMyData))
 		defer ts.Close()
 		params := map[string]interface{}{
 			"email":    "test@mail.com",
 			"password": "somepass",
 		}
 		resp := doRequest(http.NewRequest(http.MethodGet, ts.URL, prepareParams(t, params)))
-		assertStatus(t, 401, resp)
-		assertBody(t, "unauthorized", resp)
+		assertError(t, 401, "unauthorized", "unauthorized", resp)
 	})
 
 	t.Run("access to data", func(t *testing.T) {
 		u := newTestUserService()
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuth(u.repository, getMyData))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, getMyData))
 		defer ts_1.Close()
 		defer ts_2.Close()
 		params := map[string]interface{}{
@@ -287,7 +311,7 @@ func TestUsers_JWT(t *testing.T) {
 
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params)))
 
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		user, _ := u.repository.Get("test@mail.com")
 		token, _ := jwtService.GenearateJWT(user)
 
@@ -295,17 +319,25 @@ func TestUsers_JWT(t *testing.T) {
 		req.Header.Add("Authorization", "Bearer "+string(token))
 		resp := doRequest(req, err)
 
+		assertStatus(t, 200, resp)
+		assertBody(t, `{"email":"test@mail.com","favorite_cake":"cake"}`+"\n", resp)
+
+		req, _ = http.NewRequest(http.MethodGet, ts_2.URL, prepareParams(t, params))
+		req.Header.Add("Authorization", "Bearer "+string(token))
+		req.Header.Add("Accept", "text/plain")
+		resp = doRequest(req, err)
+
 		assertStatus(t, 200, resp)
 		assertBody(t, user.Email+"\n"+user.FavoriteCake, resp)
 	})
 
 	t.Run("unauthorized access to cake changer", func(t *testing.T) {
 		u := newTestUserService()
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
-		ts := httptest.NewServer(j.jwtAuth(u.repository, changeCakeHandler))
+		ts := httptest.NewServer(j.jwtAuthorize(u.repository, changeCakeHandler))
 		defer ts.Close()
 		params := map[string]interface{}{
 			"email":         "test@mail.com",
@@ -313,52 +345,49 @@ func TestUsers_JWT(t *testing.T) {
 			"favorite_cake": "brauni",
 		}
 		resp := doRequest(http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params)))
-		assertStatus(t, 401, resp)
-		assertBody(t, "unauthorized", resp)
+		assertError(t, 401, "unauthorized", "unauthorized", resp)
 	})
 
 	t.Run("unauthorized access to pass changer", func(t *testing.T) {
 		u := newTestUserService()
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
-		ts := httptest.NewServer(j.jwtAuth(u.repository, changePassHandler))
+		ts := httptest.NewServer(j.jwtAuthorize(u.repository, changePassHandler))
 		defer ts.Close()
 		params := map[string]interface{}{
 			"email":    "test@mail.com",
 			"password": "somepass",
 		}
 		resp := doRequest(http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params)))
-		assertStatus(t, 401, resp)
-		assertBody(t, "unauthorized", resp)
+		assertError(t, 401, "unauthorized", "unauthorized", resp)
 	})
 
 	t.Run("unauthorized access to email changer", func(t *testing.T) {
 		u := newTestUserService()
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
-		ts := httptest.NewServer(j.jwtAuth(u.repository, changeEmailHandler))
+		ts := httptest.NewServer(j.jwtAuthorize(u.repository, changeEmailHandler))
 		defer ts.Close()
 		params := map[string]interface{}{
 			"email":    "test@mail.com",
 			"password": "somepass",
 		}
 		resp := doRequest(http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params)))
-		assertStatus(t, 401, resp)
-		assertBody(t, "unauthorized", resp)
+		assertError(t, 401, "unauthorized", "unauthorized", resp)
 	})
 
 	t.Run("invalid cake changer", func(t *testing.T) {
 		u := newTestUserService()
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuth(u.repository, changeCakeHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, changeCakeHandler))
 		defer ts_1.Close()
 		defer ts_2.Close()
 		params_1 := map[string]interface{}{
@@ -372,25 +401,24 @@ func TestUsers_JWT(t *testing.T) {
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params_1)))
 
 		user, _ := u.repository.Get("test@mail.com")
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		token, _ := jwtService.GenearateJWT(user)
 
 		req, _ := http.NewRequest(http.MethodPut, ts_2.URL, prepareParams(t, params_2))
 		req.Header.Add("Authorization", "Bearer "+string(token))
 		resp := doRequest(req, err)
 
-		assertStatus(t, 422, resp)
-		assertBody(t, "Invalid cake", resp)
+		assertError(t, 422, "validation_failed", "Invalid cake", resp)
 	})
 
 	t.Run("cake changer", func(t *testing.T) {
 		u := newTestUserService()
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuth(u.repository, changeCakeHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, changeCakeHandler))
 		defer ts_1.Close()
 		defer ts_2.Close()
 		params_1 := map[string]interface{}{
@@ -406,7 +434,7 @@ func TestUsers_JWT(t *testing.T) {
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params_1)))
 
 		user, _ := u.repository.Get("test@mail.com")
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		token, _ := jwtService.GenearateJWT(user)
 
 		req, _ := http.NewRequest(http.MethodPut, ts_2.URL, prepareParams(t, params_2))
@@ -419,12 +447,12 @@ func TestUsers_JWT(t *testing.T) {
 
 	t.Run("invalid pass changer", func(t *testing.T) {
 		u := newTestUserService()
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuth(u.repository, changePassHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, changePassHandler))
 		defer ts_1.Close()
 		defer ts_2.Close()
 		params_1 := map[string]interface{}{
@@ -439,25 +467,24 @@ func TestUsers_JWT(t *testing.T) {
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params_1)))
 
 		user, _ := u.repository.Get("test@mail.com")
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		token, _ := jwtService.GenearateJWT(user)
 
 		req, _ := http.NewRequest(http.MethodPut, ts_2.URL, prepareParams(t, params_2))
 		req.Header.Add("Authorization", "Bearer "+string(token))
 		resp := doRequest(req, err)
 
-		assertStatus(t, 422, resp)
-		assertBody(t, "Invalid password", resp)
+		assertError(t, 422, "validation_failed", "Invalid password", resp)
 	})
 
 	t.Run("pass changer", func(t *testing.T) {
 		u := newTestUserService()
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuth(u.repository, changePassHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, changePassHandler))
 		defer ts_1.Close()
 		defer ts_2.Close()
 		params_1 := map[string]interface{}{
@@ -473,7 +500,7 @@ func TestUsers_JWT(t *testing.T) {
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params_1)))
 
 		user, _ := u.repository.Get("test@mail.com")
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		token, _ := jwtService.GenearateJWT(user)
 
 		req, _ := http.NewRequest(http.MethodPut, ts_2.URL, prepareParams(t, params_2))
@@ -484,14 +511,66 @@ func TestUsers_JWT(t *testing.T) {
 		assertBody(t, "Your password have been changed", resp)
 	})
 
+	t.Run("settings changes keep the role and ban history", func(t *testing.T) {
+		u := newTestUserService()
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+		if err != nil {
+			t.FailNow()
+		}
+		ts_1 := httptest.NewServer(j.jwtAuthorize(u.repository, changeCakeHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, changePassHandler))
+		defer ts_1.Close()
+		defer ts_2.Close()
+		history := BanHistory{}
+		history.Append(BanEvent{Type: BanEventBan, At: time.Now().Add(-time.Hour), Actor: "root@mail.com", Reason: "spam"})
+		history.Append(BanEvent{Type: BanEventUnban, At: time.Now(), Actor: "root@mail.com", Reason: "appeal"})
+		digest, _ := hashPassword("somepass")
+		u.repository.Add("test@mail.com", User{
+			Email:          "test@mail.com",
+			PasswordDigest: digest,
+			FavoriteCake:   "cake",
+			Role:           RoleAdmin,
+			BanHistory:     history,
+		})
+		user, _ := u.repository.Get("test@mail.com")
+		token, _ := j.GenearateJWT(user)
+
+		params_1 := map[string]interface{}{
+			"email":         "test@mail.com",
+			"favorite_cake": "newcake",
+		}
+		req, _ := http.NewRequest(http.MethodPut, ts_1.URL, prepareParams(t, params_1))
+		req.Header.Add("Authorization", "Bearer "+string(token))
+		assertStatus(t, 201, doRequest(req, err))
+
+		params_2 := map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "mynewpass",
+		}
+		req, _ = http.NewRequest(http.MethodPut, ts_2.URL, prepareParams(t, params_2))
+		req.Header.Add("Authorization", "Bearer "+string(token))
+		assertStatus(t, 201, doRequest(req, err))
+
+		user, _ = u.repository.Get("test@mail.com")
+		if user.FavoriteCake != "newcake" {
+			t.Errorf("Unexpected cake: %s", user.FavoriteCake)
+		}
+		if user.Role != RoleAdmin {
+			t.Errorf("Unexpected role: %q", user.Role)
+		}
+		if user.Banned || user.BanHistory.Len() != 2 {
+			t.Errorf("Unexpected ban state: %v %v", user.Banned, user.BanHistory.Events())
+		}
+	})
+
 	t.Run("invalid email changer", func(t *testing.T) {
 		u := newTestUserService()
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuth(u.repository, changeEmailHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, changeEmailHandler))
 		defer ts_1.Close()
 		defer ts_2.Close()
 		params_1 := map[string]interface{}{
@@ -507,25 +586,24 @@ func TestUsers_JWT(t *testing.T) {
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params_1)))
 
 		user, _ := u.repository.Get("test@mail.com")
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		token, _ := jwtService.GenearateJWT(user)
 
 		req, _ := http.NewRequest(http.MethodPut, ts_2.URL, prepareParams(t, params_2))
 		req.Header.Add("Authorization", "Bearer "+string(token))
 		resp := doRequest(req, err)
 
-		assertStatus(t, 422, resp)
-		assertBody(t, "Invalid email", resp)
+		assertError(t, 422, "validation_failed", "Invalid email", resp)
 	})
 
 	t.Run("email changer", func(t *testing.T) {
 		u := newTestUserService()
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuth(u.repository, changeEmailHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, changeEmailHandler))
 		defer ts_1.Close()
 		defer ts_2.Close()
 		params_1 := map[string]interface{}{
@@ -541,7 +619,7 @@ func TestUsers_JWT(t *testing.T) {
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params_1)))
 
 		user, _ := u.repository.Get("test@mail.com")
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		token, _ := jwtService.GenearateJWT(user)
 
 		req, _ := http.NewRequest(http.MethodPut, ts_2.URL, prepareParams(t, params_2))
@@ -552,17 +630,47 @@ func TestUsers_JWT(t *testing.T) {
 		assertBody(t, "Your email have been changed", resp)
 	})
 
+	t.Run("email changer to a taken email", func(t *testing.T) {
+		u := newTestUserService()
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+		if err != nil {
+			t.FailNow()
+		}
+		ts := httptest.NewServer(j.jwtAuthorize(u.repository, changeEmailHandler))
+		defer ts.Close()
+		u.repository.Add("test@mail.com", User{Email: "test@mail.com", FavoriteCake: "cake"})
+		u.repository.Add("taken@mail.com", User{Email: "taken@mail.com", FavoriteCake: "pie"})
+		params := map[string]interface{}{
+			"email":     "test@mail.com",
+			"new email": "taken@mail.com",
+		}
+
+		user, _ := u.repository.Get("test@mail.com")
+		token, _ := j.GenearateJWT(user)
+		req, _ := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Add("Authorization", "Bearer "+string(token))
+		resp := doRequest(req, err)
+
+		assertError(t, 409, "user_already_exists", "This user is already registered", resp)
+		if _, err := u.repository.Get("test@mail.com"); err != nil {
+			t.Errorf("the account should be kept: %v", err)
+		}
+		if other, _ := u.repository.Get("taken@mail.com"); other.FavoriteCake != "pie" {
+			t.Errorf("Unexpected user: %+v", other)
+		}
+	})
+
 	t.Run("banned authorisation", func(t *testing.T) {
 		u := newTestUserService()
 		Superadmin := User{os.Getenv("CAKE_ADMIN_EMAIL"), os.Getenv("CAKE_ADMIN_PASSWORD"),
-			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}}
+			os.Getenv("CAKE_ADMIN_CAKE"), "superadmin", false, BanHistory{}, "", ""}
 		u.repository.Add(Superadmin.Email, Superadmin)
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		if err != nil {
 			t.FailNow()
 		}
 		ts_1 := httptest.NewServer(http.HandlerFunc(u.Register))
-		ts_2 := httptest.NewServer(j.jwtAuthAdmin(u.repository, banHandler))
+		ts_2 := httptest.NewServer(j.jwtAuthorize(u.repository, banHandler, PermUsersBan))
 		ts_3 := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
 		defer ts_1.Close()
 		defer ts_2.Close()
@@ -580,7 +688,7 @@ func TestUsers_JWT(t *testing.T) {
 
 		doRequest(http.NewRequest(http.MethodPost, ts_1.URL, prepareParams(t, params)))
 
-		jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		jwtService, err := NewJWTService("privkey.rsa", "pubkey.rsa")
 		admin, _ := u.repository.Get(os.Getenv("CAKE_ADMIN_EMAIL"))
 		token, _ := jwtService.GenearateJWT(admin)
 
@@ -590,11 +698,6 @@ func TestUsers_JWT(t *testing.T) {
 		user, _ := u.repository.Get("test@mail.com")
 
 		resp := doRequest(http.NewRequest(http.MethodPost, ts_3.URL, prepareParams(t, params)))
-		assertStatus(t, 401, resp)
-		for key, _ := range user.BanHistory.history {
-			if user.BanHistory.history[key].WhoUnbanned == "" {
-				assertBody(t, "Your are banned because : "+user.BanHistory.history[key].Why, resp)
-			}
-		}
+		assertError(t, 403, "user_banned", "Your are banned because : "+user.BanHistory.active().Why, resp)
 	})
 }
@@ -1,9 +1,7 @@
 package main
 
 import (
-	"crypto/md5"
 	"encoding/json"
-	"errors"
 	"net/http"
 	"regexp"
 	"unicode"
@@ -16,13 +14,34 @@ type User struct {
 	Role           string
 	Banned         bool
 	BanHistory     BanHistory
+	// PendingVerification is the id of the token able to verify the
+	// email, it is empty once the email is verified.
+	PendingVerification string
+	// ID never changes, unlike the email, and is never given to another
+	// user. The repositories assign it on Add.
+	ID string
+}
+
+func (u User) Verified() bool {
+	return u.PendingVerification == ""
+}
+
+func newUserID() (string, error) {
+	return randomToken(16)
 }
 
 type UserRepository interface {
 	Add(string, User) error
 	Get(string) (User, error)
+	GetByID(string) (User, error)
+	// Update and Rename keep the ID of the user.
 	Update(string, User) error
 	Delete(string) (User, error)
+	List(ListOptions) (UserPage, error)
+	// Rename moves the account of the email to u.Email and stores u there,
+	// with its ban history. It fails with ErrUserExists, leaving both
+	// accounts alone, when u.Email is taken.
+	Rename(string, User) error
 }
 
 type UserService struct {
@@ -54,24 +73,24 @@ var emailRegex = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z
 
 func validateRegisterParams(p *UserRegisterParams) error {
 	if !emailRegex.MatchString(p.Email) {
-		return errors.New("Invalid email")
+		return newValidationError("email", "Invalid email")
 	}
 
 	if len(p.Email) < 3 {
-		return errors.New("Invalid email")
+		return newValidationError("email", "Invalid email")
 	}
 
 	if len(p.Password) < 8 {
-		return errors.New("Password should consist at least 8 characters")
+		return newValidationError("password", "Password should consist at least 8 characters")
 	}
 
 	if p.FavoriteCake == "" {
-		return errors.New("Enter your cake")
+		return newValidationError("favorite_cake", "Enter your cake")
 	}
 
 	for _, i := range p.FavoriteCake {
 		if !unicode.IsLetter(i) {
-			return errors.New("Invalid cake: should consist only letters!")
+			return newValidationError("favorite_cake", "Invalid cake: should consist only letters!")
 		}
 	}
 	return nil
@@ -79,29 +98,29 @@ func validateRegisterParams(p *UserRegisterParams) error {
 
 func validateEmailParams(p *ChangeEmailParams) error {
 	if !emailRegex.MatchString(p.New_email) {
-		return errors.New("Invalid email")
+		return newValidationError("new email", "Invalid email")
 	}
 	if len(p.New_email) < 3 {
-		return errors.New("Invalid email")
+		return newValidationError("new email", "Invalid email")
 	}
 	return nil
 }
 
 func validatePassParams(p *ChangePassParams) error {
 	if len(p.Password) < 8 {
-		return errors.New("Invalid password")
+		return newValidationError("password", "Invalid password")
 	}
 	return nil
 }
 
 func validateCakeParams(p *ChangeCakeParams) error {
 	if p.FavoriteCake == "" {
-		return errors.New("Invalid cake")
+		return newValidationError("favorite_cake", "Invalid cake")
 	}
 
 	for _, i := range p.FavoriteCake {
 		if !unicode.IsLetter(i) {
-			return errors.New("Invalid cake: should consist only letters!")
+			return newValidationError("favorite_cake", "Invalid cake: should consist only letters!")
 		}
 	}
 	return nil
@@ -111,7 +130,7 @@ func (u *UserService) Register(w http.ResponseWriter, r *http.Request) {
 	params := &UserRegisterParams{}
 	err := json.NewDecoder(r.Body).Decode(params)
 	if err != nil {
-		handleError(errors.New("could not read params"), w)
+		handleError(ErrInvalidParams, w)
 		return
 	}
 
@@ -120,20 +139,36 @@ func (u *UserService) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	passwordDigest := md5.New().Sum([]byte(params.Password))
+	passwordDigest, err := hashPassword(params.Password)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
 	newUser := User{
 		Email:          params.Email,
-		PasswordDigest: string(passwordDigest),
+		PasswordDigest: passwordDigest,
 		FavoriteCake:   params.FavoriteCake,
 		BanHistory:     *NewBanHistory(),
 	}
+	var token string
+	if emailVerification != nil {
+		token, err = emailVerification.start(&newUser)
+		if err != nil {
+			handleError(err, w)
+			return
+		}
+	}
 	err = u.repository.Add(params.Email, newUser)
 
 	if err != nil {
 		handleError(err, w)
 		return
 	}
+	if emailVerification != nil {
+		emailVerification.send(newUser.Email, token)
+	}
 
+	registrations.Inc()
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("registered"))
 }
@@ -143,7 +178,7 @@ func changeCakeHandler(w http.ResponseWriter, r *http.Request, u User, us UserRe
 	err := json.NewDecoder(r.Body).Decode(params)
 
 	if err != nil {
-		handleError(errors.New("could not read params"), w)
+		handleError(ErrInvalidParams, w)
 		return
 	}
 
@@ -153,17 +188,12 @@ func changeCakeHandler(w http.ResponseWriter, r *http.Request, u User, us UserRe
 	}
 
 	if params.Email != u.Email {
-		w.WriteHeader(401)
-		w.Write([]byte("Your are not logged in"))
+		handleError(ErrNotAccountOwner, w)
 		return
 	}
 
-	newCake := User{
-		Email:          u.Email,
-		FavoriteCake:   params.FavoriteCake,
-		PasswordDigest: u.PasswordDigest,
-	}
-	err = us.Update(u.Email, newCake)
+	u.FavoriteCake = params.FavoriteCake
+	err = us.Update(u.Email, u)
 
 	if err != nil {
 		handleError(err, w)
@@ -179,7 +209,7 @@ func changePassHandler(w http.ResponseWriter, r *http.Request, u User, us UserRe
 	err := json.NewDecoder(r.Body).Decode(params)
 
 	if err != nil {
-		handleError(errors.New("could not read params"), w)
+		handleError(ErrInvalidParams, w)
 		return
 	}
 
@@ -189,23 +219,23 @@ func changePassHandler(w http.ResponseWriter, r *http.Request, u User, us UserRe
 	}
 
 	if params.Email != u.Email {
-		w.WriteHeader(401)
-		w.Write([]byte("Your are not logged in"))
+		handleError(ErrNotAccountOwner, w)
 		return
 	}
 
-	passwordDigest := md5.New().Sum([]byte(params.Password))
-	newPass := User{
-		Email:          u.Email,
-		FavoriteCake:   u.FavoriteCake,
-		PasswordDigest: string(passwordDigest),
+	passwordDigest, err := hashPassword(params.Password)
+	if err != nil {
+		handleError(err, w)
+		return
 	}
-	err = us.Update(u.Email, newPass)
+	u.PasswordDigest = passwordDigest
+	err = us.Update(u.Email, u)
 
 	if err != nil {
 		handleError(err, w)
 		return
 	}
+	revokeUserTokens(u.Email)
 
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("Your password have been changed"))
@@ -216,7 +246,7 @@ func changeEmailHandler(w http.ResponseWriter, r *http.Request, u User, us UserR
 	err := json.NewDecoder(r.Body).Decode(params)
 
 	if err != nil {
-		handleError(errors.New("could not read params"), w)
+		handleError(ErrInvalidParams, w)
 		return
 	}
 
@@ -226,29 +256,36 @@ func changeEmailHandler(w http.ResponseWriter, r *http.Request, u User, us UserR
 	}
 
 	if params.Email != u.Email {
-		w.WriteHeader(401)
-		w.Write([]byte("Your are not logged in"))
+		handleError(ErrNotAccountOwner, w)
 		return
 	}
 
-	newEmail := User{
-		Email:          params.New_email,
-		FavoriteCake:   u.FavoriteCake,
-		PasswordDigest: u.PasswordDigest,
+	newEmail := u
+	newEmail.Email = params.New_email
+	// the new address has to be verified again
+	var token string
+	if emailVerification != nil {
+		token, err = emailVerification.start(&newEmail)
+		if err != nil {
+			handleError(err, w)
+			return
+		}
 	}
-	us.Delete(u.Email)
-	err = us.Add(params.New_email, newEmail)
+	err = us.Rename(u.Email, newEmail)
 
 	if err != nil {
 		handleError(err, w)
 		return
 	}
+	revokeUserTokens(u.Email)
+	if err := moveTwoFactor(u.Email, newEmail.Email); err != nil {
+		handleError(err, w)
+		return
+	}
+	if emailVerification != nil {
+		emailVerification.send(newEmail.Email, token)
+	}
 
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("Your email have been changed"))
 }
-
-func handleError(err error, w http.ResponseWriter) {
-	w.WriteHeader(http.StatusUnprocessableEntity)
-	w.Write([]byte(err.Error()))
-}
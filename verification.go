@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultVerificationTTL = 24 * time.Hour
+	defaultVerificationURL = "http://localhost:8080/user/verify?token="
+	verificationAudience   = "email_verification"
+)
+
+var (
+	errInvalidVerificationToken = newBadRequestError("invalid_verification_token", "Invalid or expired verification token")
+	errEmailNotVerified         = newForbiddenError("email_not_verified", "Verify your email before logging in")
+)
+
+// EmailVerifier mails the tokens verifying the email of an account. A token
+// is a signed JWT carrying the email and the id of the pending verification
+// of the user, so it works once and only until another one is sent.
+type EmailVerifier struct {
+	keys   *KeyRing
+	Mailer Mailer
+	TTL    time.Duration
+	// URL is the verification link, the token is appended to it.
+	URL string
+	// Required refuses tokens to the users whose email isn't verified.
+	Required bool
+}
+
+// emailVerification is nil when emails aren't verified.
+var emailVerification *EmailVerifier
+
+func NewEmailVerifier(j *JWTService, m Mailer) *EmailVerifier {
+	return &EmailVerifier{
+		keys:   j.keys,
+		Mailer: m,
+		TTL:    defaultVerificationTTL,
+		URL:    defaultVerificationURL,
+	}
+}
+
+// start gives u a new pending verification and returns its token, the
+// tokens sent before stop working once u is stored.
+func (v *EmailVerifier) start(u *User) (string, error) {
+	id, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	token, err := signScopedToken(v.keys, verificationAudience, u.Email, id, v.TTL)
+	if err != nil {
+		return "", err
+	}
+	u.PendingVerification = id
+	return token, nil
+}
+
+// send mails token to email. Failures are only logged, the user can ask
+// for another mail.
+func (v *EmailVerifier) send(email, token string) {
+	err := v.Mailer.Send(Mail{
+		To:      email,
+		Subject: "Verify your email",
+		Body: "Follow this link to verify your email:\r\n\r\n" + v.URL + token +
+			"\r\n\r\nIt expires in " + v.TTL.String() + ".",
+	})
+	if err != nil {
+		log.Println("Could not send verification email to", email, err)
+	}
+}
+
+type VerifyParams struct {
+	Token string `json:"token"`
+}
+
+// Verify verifies the email of the token given in the query, as in the
+// link of the mail, or in the body.
+func (u *UserService) Verify(w http.ResponseWriter, r *http.Request) {
+	if emailVerification == nil {
+		handleError(newNotFoundError("verification_disabled", "Email verification is disabled"), w)
+		return
+	}
+	params := &VerifyParams{Token: r.URL.Query().Get("token")}
+	if params.Token == "" {
+		if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+			handleError(ErrInvalidParams, w)
+			return
+		}
+	}
+	claims, err := parseScopedToken(emailVerification.keys, params.Token, verificationAudience)
+	if err != nil {
+		handleError(errInvalidVerificationToken, w)
+		return
+	}
+	user, err := u.repository.Get(claims.Subject)
+	if err == ErrUserNotFound || (err == nil && (user.Verified() || user.PendingVerification != claims.Id)) {
+		handleError(errInvalidVerificationToken, w)
+		return
+	}
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	user.PendingVerification = ""
+	if err := u.repository.Update(user.Email, user); err != nil {
+		handleError(err, w)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("Your email have been verified"))
+}
+
+type ResendVerificationParams struct {
+	Email string `json:"email"`
+}
+
+// ResendVerification mails a new token to an unverified account. The answer
+// is the same whether or not a mail was sent.
+func (u *UserService) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	if emailVerification == nil {
+		handleError(newNotFoundError("verification_disabled", "Email verification is disabled"), w)
+		return
+	}
+	params := &ResendVerificationParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(ErrInvalidParams, w)
+		return
+	}
+	user, err := u.repository.Get(params.Email)
+	if err != nil && err != ErrUserNotFound {
+		handleError(err, w)
+		return
+	}
+	if err == nil && !user.Verified() {
+		token, err := emailVerification.start(&user)
+		if err != nil {
+			handleError(err, w)
+			return
+		}
+		if err := u.repository.Update(user.Email, user); err != nil {
+			handleError(err, w)
+			return
+		}
+		emailVerification.send(user.Email, token)
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("If this account isn't verified yet, a new email have been sent"))
+}
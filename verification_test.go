@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// useEmailVerifier turns email verification on for the test and returns
+// the outbox receiving the mails.
+func useEmailVerifier(t *testing.T, j *JWTService, required bool) *InMemoryOutbox {
+	old := emailVerification
+	outbox := NewInMemoryOutbox()
+	emailVerification = NewEmailVerifier(j, outbox)
+	emailVerification.Required = required
+	t.Cleanup(func() { emailVerification = old })
+	return outbox
+}
+
+// lastMailToken returns the token in the link of the last mail sent to
+// email.
+func lastMailToken(t *testing.T, outbox *InMemoryOutbox, email string) string {
+	t.Helper()
+	mails := outbox.Mails(email)
+	if len(mails) == 0 {
+		t.Fatalf("no mail sent to %s", email)
+	}
+	body := mails[len(mails)-1].Body
+	start := strings.Index(body, "token=") + len("token=")
+	return body[start : start+strings.Index(body[start:], "\r\n")]
+}
+
+func TestEmailVerification(t *testing.T) {
+	doRequest := createRequester(t)
+	useLockoutPolicy(t, defaultLockoutPolicy())
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	outbox := useEmailVerifier(t, j, true)
+	u := newTestUserService()
+	register := httptest.NewServer(http.HandlerFunc(u.Register))
+	defer register.Close()
+	login := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+	defer login.Close()
+	verify := httptest.NewServer(http.HandlerFunc(u.Verify))
+	defer verify.Close()
+	resend := httptest.NewServer(http.HandlerFunc(u.ResendVerification))
+	defer resend.Close()
+	post := func(url string, params map[string]interface{}) parsedResponse {
+		return doRequest(http.NewRequest(http.MethodPost, url, prepareParams(t, params)))
+	}
+	verifyLink := func(token string) parsedResponse {
+		return doRequest(http.NewRequest(http.MethodGet, verify.URL+"?token="+url.QueryEscape(token), nil))
+	}
+	credentials := map[string]interface{}{"email": "test@mail.com", "password": "somepass"}
+
+	assertStatus(t, 201, post(register.URL, map[string]interface{}{
+		"email": "test@mail.com", "password": "somepass", "favorite_cake": "cake"}))
+	first := lastMailToken(t, outbox, "test@mail.com")
+	assertError(t, 403, "email_not_verified", "Verify your email before logging in", post(login.URL, credentials))
+
+	t.Run("resend replaces the token", func(t *testing.T) {
+		assertStatus(t, 201, post(resend.URL, map[string]interface{}{"email": "test@mail.com"}))
+		assertError(t, 400, "invalid_verification_token", "Invalid or expired verification token", verifyLink(first))
+	})
+
+	t.Run("resend doesn't tell unknown accounts apart", func(t *testing.T) {
+		resp := post(resend.URL, map[string]interface{}{"email": "nobody@mail.com"})
+		assertStatus(t, 201, resp)
+		assertBody(t, "If this account isn't verified yet, a new email have been sent", resp)
+		if mails := outbox.Mails("nobody@mail.com"); len(mails) != 0 {
+			t.Errorf("Unexpected mails: %+v", mails)
+		}
+	})
+
+	t.Run("access tokens don't verify", func(t *testing.T) {
+		access, _ := j.GenearateJWT(User{Email: "test@mail.com"})
+		assertError(t, 400, "invalid_verification_token", "Invalid or expired verification token",
+			post(verify.URL, map[string]interface{}{"token": access}))
+	})
+
+	t.Run("verify once", func(t *testing.T) {
+		token := lastMailToken(t, outbox, "test@mail.com")
+		assertStatus(t, 201, verifyLink(token))
+		assertStatus(t, 200, post(login.URL, credentials))
+		assertStatus(t, 400, post(verify.URL, map[string]interface{}{"token": token}))
+		assertStatus(t, 201, post(resend.URL, map[string]interface{}{"email": "test@mail.com"}))
+		if mails := outbox.Mails("test@mail.com"); len(mails) != 2 {
+			t.Errorf("verified accounts shouldn't get mails: %+v", mails)
+		}
+	})
+}
+
+func TestEmailVerification_Optional(t *testing.T) {
+	doRequest := createRequester(t)
+	useLockoutPolicy(t, defaultLockoutPolicy())
+	j, err := NewJWTService("privkey.rsa", "pubkey.rsa")
+	if err != nil {
+		t.FailNow()
+	}
+	useEmailVerifier(t, j, false)
+	u := newTestUserService()
+	digest, _ := hashPassword("somepass")
+	u.repository.Add("test@mail.com", User{"test@mail.com", digest, "cake", RoleUser, false, BanHistory{}, "pending", ""})
+	login := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+	defer login.Close()
+	resp := doRequest(http.NewRequest(http.MethodPost, login.URL,
+		prepareParams(t, map[string]interface{}{"email": "test@mail.com", "password": "somepass"})))
+	assertStatus(t, 200, resp)
+}
+
+func TestSQLiteUserStorage_PendingVerification(t *testing.T) {
+	s := newTestSQLiteStorage(t)
+	s.Add("test@mail.com", User{Email: "test@mail.com", FavoriteCake: "cake", PendingVerification: "pending"})
+	u, err := s.Get("test@mail.com")
+	if err != nil || u.Verified() {
+		t.Fatalf("Unexpected user: %+v, %v", u, err)
+	}
+	u.PendingVerification = ""
+	s.Update(u.Email, u)
+	if u, _ := s.Get("test@mail.com"); !u.Verified() {
+		t.Errorf("Unexpected user: %+v", u)
+	}
+}